@@ -5,6 +5,7 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"image/color"
 	"math"
@@ -12,10 +13,10 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -25,6 +26,7 @@ import (
 	"gonum.org/v1/plot"
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
+	"layeh.com/gopus"
 )
 
 const (
@@ -33,12 +35,19 @@ const (
 	LogFile             = "log.txt"                                                     // LogFile - The file that is used for print and debug
 	SummarizedStatsFile = "./Stats/SummarizedStats.txt"                                 // SummarizedStatsFile - Summarizing the RTT, Inter-Arrival and jitter for all frame sizes
 	SongName            = "Eric Clapton - Nobody Knows You When You're Down & Out .mp3" // SongName - The song to send and play
-	PacketRequestSong   = iota                                                          // PacketRequestSong - .
-	PacketCloseChannel                                                                  // PacketCloseChannel - .
-	PacketRecord                                                                        // PacketRecord - For recording a stream with microphone
 	SampleRate          = 48000                                                         // SampleRate is the number of bits used to represent a full second of audio sampling
 	Channels            = 2                                                             // Channels - 1 for mono; 2 for stereo
 	MicroToSecond       = 1000000                                                       // MicroToSecond - Unit conversion
+	HandshakeTimeout    = 2 * time.Second                                               // HandshakeTimeout - How long to wait for the server to answer a Hello packet
+	HandshakeAttempts   = 3                                                             // HandshakeAttempts - How many Hello packets to send before giving up
+	MaxConcealedFrames  = 5                                                             // MaxConcealedFrames - The most missing frames synthesized for one gap, longer gaps are skipped
+)
+
+const (
+	recoveredNone             = iota // recoveredNone - The frame arrived in its own packet
+	recoveredByRedundancy            // recoveredByRedundancy - The frame was lost and taken from the redundancy of a later packet
+	recoveredByParity                // recoveredByParity - The packet was lost and rebuilt from the parity packet of its block
+	recoveredByRetransmission        // recoveredByRetransmission - The packet arrived after a NACK asked for it
 )
 
 type NetworkMetrics struct {
@@ -46,11 +55,17 @@ type NetworkMetrics struct {
 	endToEnd, roundTripTime        float64
 	interArrival, jitter           float64
 	unorderedArrivals, lostPackets float32
+	recoveredPackets               float32 // Lost on the network but recovered from redundancy, not counted in lostPackets
+	parityRecovered                float32 // Lost on the network but rebuilt from parity packets, not counted in lostPackets
+	retransmitted                  float32 // Arrived after a NACK, not counted in lostPackets
+	uplink, downlink, serverDwell  float64 // One way delays from the server timestamps, corrected by the clock offset
+	tlsHandshake                   float64 // Milliseconds, zero without TLS
+	tlsOverhead                    float64 // Bytes TLS added to every packet sent
 }
 
-func initChannels() (chan []int64, chan []byte, chan []byte, chan string, chan string) {
+func initChannels() (chan []int64, chan *Packet, chan []byte, chan string, chan string) {
 	statsChannel := make(chan []int64, BufferSize)
-	streamChannel := make(chan []byte, bufio.MaxScanTokenSize)
+	streamChannel := make(chan *Packet, bufio.MaxScanTokenSize)
 	handleResponseChannel := make(chan []byte, bufio.MaxScanTokenSize)
 	endSessionChannel := make(chan string, bufio.MaxScanTokenSize)
 	logChannel := make(chan string, bufio.MaxScanTokenSize)
@@ -77,45 +92,434 @@ func jitter(values []int64) float64 {
 	return math.Sqrt(quadDev)
 }
 
-func countUnordered(indexesList []int64) int {
-	var count int
-	if len(indexesList) == 0 {
-		return 0
+// decodeMedia returns the frames carried by a received media or parity packet, with how each one was recovered.
+// Packets lost in a block are rebuilt from its parity packet first, then frames lost in a row from the redundancy of the later packets
+func decodeMedia(packet *Packet, parityDecoder *ParityDecoder, redundancyDecoder *RedundancyDecoder) ([]*Packet, []int, error) {
+	packets, rebuilt := []*Packet{packet}, 0
+	if parityDecoder != nil {
+		var err error
+		if packets, rebuilt, err = parityDecoder.Decode(packet); err != nil {
+			return nil, nil, err
+		}
+	} else if packet.PacketType == PacketParity {
+		return nil, nil, nil
+	}
+
+	var frames []*Packet
+	var recoveries []int
+	for i, packet := range packets {
+		recovery := recoveredNone
+		if i < rebuilt {
+			recovery = recoveredByParity
+		}
+		if packet.PacketType != PacketRedundant {
+			frames, recoveries = append(frames, packet), append(recoveries, recovery)
+			continue
+		}
+		redundantFrames, recovered, err := redundancyDecoder.Decode(packet)
+		if err != nil {
+			return nil, nil, err
+		}
+		for j, frame := range redundantFrames {
+			frameRecovery := recovery
+			if j < recovered {
+				frameRecovery = recoveredByRedundancy
+			}
+			frames, recoveries = append(frames, frame), append(recoveries, frameRecovery)
+		}
+	}
+	return frames, recoveries, nil
+}
+
+// playout decodes the received frames in serial order. The frames missing at playout are synthesized,
+// the last one of a gap from the in-band FEC of the next packet and the ones before it with packet loss concealment
+type playout struct {
+	decoder                          *gopus.Decoder
+	frameSize                        int
+	started                          bool
+	streamID                         uint32 // The room participant played, its serials are not those of the one before
+	expected                         uint32
+	fecFrames, plcFrames, lateFrames int
+}
+
+// decode returns the PCM of the frame of the packet, preceded by the synthesized frames of the gap before it
+func (playout *playout) decode(packet *Packet) ([][]int16, error) {
+	data := packet.Data[:packet.DataSize]
+	if packet.StreamID != playout.streamID {
+		playout.started, playout.streamID = false, packet.StreamID
+	}
+	gap := 0
+	if playout.started {
+		gap = int(int32(packet.SerialNumber - playout.expected))
+	}
+	if gap < 0 {
+		playout.lateFrames++ // Already concealed
+		return nil, nil
+	}
+	playout.started, playout.expected = true, packet.SerialNumber+1
+
+	var frames [][]int16
+	concealed := min(gap, MaxConcealedFrames)
+	for i := 0; i < concealed; i++ {
+		var pcm []int16
+		var err error
+		if i == concealed-1 {
+			pcm, err = playout.decoder.Decode(data, playout.frameSize, true)
+			playout.fecFrames++
+		} else {
+			pcm, err = playout.decoder.Decode(nil, playout.frameSize, false)
+			playout.plcFrames++
+		}
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, pcm)
+	}
+
+	pcm, err := playout.decoder.Decode(data, playout.frameSize, false)
+	if err != nil {
+		return nil, err
+	}
+	return append(frames, pcm), nil
+}
+
+// reportedLoss is the packet loss percentage of the last RTCP report, the worse of how the server receives
+// the stream and how it comes back. It is false until a report arrived
+func reportedLoss(rtcp *RTCPSession) (int, bool) {
+	feedback := rtcp.Feedback()
+	if feedback.Remote.SSRC == 0 {
+		return 0, false
+	}
+	fractionLost := max(feedback.Remote.FractionLost, feedback.Local.FractionLost)
+	return (int(fractionLost)*100 + 255) / 256, true
+}
+
+// retransmitter asks the server for the frames missing from the echoed stream and answers the NACKs the server
+// forwards for the packets it never received. The frames after a gap are held until the missing frame is retransmitted,
+// or until the first of them reaches its playout deadline: its InitTime plus the playout delay
+type retransmitter struct {
+	playoutDelay time.Duration
+	history      *SendHistory
+	tracker      NackTracker
+	started      bool
+	next         uint32 // The serial of the next frame to play
+	held         map[uint32]*Packet
+}
+
+func newRetransmitter(playoutDelay time.Duration) *retransmitter {
+	return &retransmitter{
+		playoutDelay: playoutDelay,
+		history:      NewSendHistory(NackHistorySize),
+		held:         make(map[uint32]*Packet),
+	}
+}
+
+// receive takes a received frame and how it was recovered. It is false for duplicates
+func (retransmitter *retransmitter) receive(frame *Packet, recovery int) (int, bool) {
+	fresh, requested := retransmitter.tracker.Receive(frame.SerialNumber)
+	if requested && recovery == recoveredNone {
+		recovery = recoveredByRetransmission
+	}
+	return recovery, fresh
+}
+
+// nack returns a NACK for the frames found missing since the last call, nil when none are
+func (retransmitter *retransmitter) nack() *Packet {
+	return retransmitter.tracker.Nack(retransmitter.playoutDelay)
+}
+
+// answer sends again the packets a NACK forwarded by the server asks for, and returns how many were sent
+func (retransmitter *retransmitter) answer(link *Link, nack *Packet) (int, error) {
+	// The NACK was sent on our clock, the retransmission goes to the server and is echoed back
+	transit := time.Since(time.UnixMicro(int64(nack.InitTime))) + link.RTCP().Feedback().RTT
+	packets, _, err := retransmitter.history.Retransmissions(nack, transit)
+	if err != nil {
+		return 0, err
+	}
+	for i, packet := range packets {
+		if err := link.Send(packet); err != nil {
+			return i, err
+		}
+	}
+	return len(packets), nil
+}
+
+// playable takes a fresh frame and returns the frames to play now, in serial order
+func (retransmitter *retransmitter) playable(frame *Packet, now time.Time) []*Packet {
+	if !retransmitter.started {
+		retransmitter.started, retransmitter.next = true, frame.SerialNumber
+	}
+	if int32(frame.SerialNumber-retransmitter.next) < 0 {
+		return []*Packet{frame} // Its gap was given up, playout drops it as late
+	}
+	retransmitter.held[frame.SerialNumber] = frame
+
+	var frames []*Packet
+	for len(retransmitter.held) > 0 {
+		if frame, ok := retransmitter.held[retransmitter.next]; ok {
+			delete(retransmitter.held, retransmitter.next)
+			frames = append(frames, frame)
+			retransmitter.next++
+			continue
+		}
+		first := retransmitter.firstHeld()
+		if now.Before(time.UnixMicro(int64(first.InitTime)).Add(retransmitter.playoutDelay)) {
+			break
+		}
+		retransmitter.next = first.SerialNumber // Give up the gap
+	}
+	return frames
+}
+
+// flush returns the held frames in serial order, when the stream ended
+func (retransmitter *retransmitter) flush() []*Packet {
+	var frames []*Packet
+	for len(retransmitter.held) > 0 {
+		first := retransmitter.firstHeld()
+		delete(retransmitter.held, first.SerialNumber)
+		frames = append(frames, first)
+	}
+	return frames
+}
+
+func (retransmitter *retransmitter) firstHeld() *Packet {
+	var first *Packet
+	for _, frame := range retransmitter.held {
+		if first == nil || int32(frame.SerialNumber-first.SerialNumber) < 0 {
+			first = frame
+		}
+	}
+	return first
+}
+
+// e2ePeer is the end-to-end encryption of the client: with itself for the echo, with the other participant of a room
+// once the server announced its key. recordAndSend seals with the current session, handleResponseRoutine does the rest
+type e2ePeer struct {
+	keyPair  *E2EKeyPair
+	current  atomic.Pointer[E2ESession] // Nil while the room has no one else
+	peer     uint32                     // The stream ID of the other participant
+	sessions map[[E2EKeySize]byte]*E2ESession
+	lastJoin time.Time // When a Join was last sent again to learn the key of a stream
+}
+
+func newE2EPeer(keyPair *E2EKeyPair) *e2ePeer {
+	return &e2ePeer{keyPair: keyPair, sessions: make(map[[E2EKeySize]byte]*E2ESession)}
+}
+
+// meet starts the session with the peer of the stream and returns the fingerprint the users compare.
+// A peer met before gets its session back, a new one would reuse the nonces of the keys
+func (e2e *e2ePeer) meet(streamID uint32, peerKey [E2EKeySize]byte) (string, error) {
+	session, ok := e2e.sessions[peerKey]
+	if !ok {
+		var err error
+		if session, err = NewE2ESession(e2e.keyPair, peerKey); err != nil {
+			return "", err
+		}
+		e2e.sessions[peerKey] = session
+	}
+	e2e.peer = streamID
+	e2e.current.Store(session)
+	return E2EFingerprint(e2e.keyPair.Public, peerKey), nil
+}
+
+// part ends the session with the peer of the stream when it left the room
+func (e2e *e2ePeer) part(streamID uint32) {
+	if streamID == e2e.peer {
+		e2e.current.Store(nil)
+	}
+}
+
+// announced starts the session with the participant a Join packet announces with its key, or ends it when it leaves
+func (e2e *e2ePeer) announced(packet *Packet, logChannel chan string) {
+	if packet.PacketType == PacketLeave {
+		e2e.part(packet.StreamID)
+		return
+	}
+	if e2e.current.Load() != nil && e2e.peer == packet.StreamID {
+		return // Introduced again
+	}
+	peerKey := packet.RoomE2EKey()
+	if peerKey == ([E2EKeySize]byte{}) {
+		logMessage(logChannel, fmt.Sprintf("handleResponseRoutine stream %d joined without an end-to-end key", packet.StreamID))
+		return
+	}
+	fingerprint, err := e2e.meet(packet.StreamID, peerKey)
+	if err != nil {
+		logMessage(logChannel, "handleResponseRoutine error: "+err.Error())
+		return
+	}
+	fmt.Println("End-to-end encrypted with stream", packet.StreamID, "fingerprint:", fingerprint)
+}
+
+// openFrame decrypts a frame encrypted end-to-end into a copy of it, the parity decoder may still need the sealed one
+func openFrame(e2e *E2ESession, frame *Packet) (*Packet, error) {
+	data, err := e2e.Open(frame.SerialNumber, frame.Data[:frame.DataSize])
+	if err != nil {
+		return nil, err
+	}
+	opened := *frame
+	opened.Data, opened.DataSize = data, uint32(len(data))
+	return &opened, nil
+}
+
+// printPublicAddress asks a STUN server for the public address of this machine, the one to share with the bandmates
+func printPublicAddress(stunServer string) {
+	conn, err := net.ListenPacket("udp", ":0")
+	CheckError(err)
+	defer conn.Close()
+	address, err := QuerySTUN(conn, stunServer)
+	if err != nil {
+		fmt.Println("Could not learn the public address:", err)
+		return
+	}
+	fmt.Println("Public address, as", stunServer, "sees it:", address.IP)
+}
+
+// frameSizeLimit is the largest Opus frame a recorded packet of the link carries, after the header of a redundant
+// packet and the sealing of end-to-end encryption
+func frameSizeLimit(link *Link, redundant, endToEnd bool) int {
+	limit := link.MaxDataSize()
+	if redundant {
+		limit-- // The payload type of the primary block
+	}
+	if endToEnd {
+		limit -= SealOverhead
+	}
+	return limit
+}
+
+// requestedSessionParams are the audio parameters the client asks the server for
+func requestedSessionParams(opMode string, frameSize int) SessionParams {
+	params := SessionParams{
+		Version:       ProtocolVersion,
+		Codec:         CodecOpus,
+		Channels:      Channels,
+		SampleRate:    SampleRate,
+		FrameDuration: time.Duration(frameSize) * time.Second / SampleRate,
+	}
+	if opMode == "song" {
+		params.Codec = CodecMP3
+	}
+	return params
+}
+
+// openSession sends a Hello packet and waits for the server to accept (possibly adapting the parameters) or reject the session.
+// The Hello packet is resent a few times in case it was lost on the way (UDP)
+func openSession(link *Link, requested SessionParams) (SessionParams, error) {
+	conn := link.Conn()
+	var reply Packet
+	for attempt := 1; ; attempt++ {
+		if err := link.Send(HelloPacket(requested)); err != nil {
+			return SessionParams{}, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+			return SessionParams{}, err
+		}
+		err := link.Receive(&reply)
+		if errors.Is(err, os.ErrDeadlineExceeded) && attempt < HandshakeAttempts {
+			continue
+		}
+		if err != nil {
+			return SessionParams{}, err
+		}
+		break
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return SessionParams{}, err
 	}
 
-	prevIndex := indexesList[0]
-	
-	for i := 1; i < len(indexesList); i++ {
-		if indexesList[i] != prevIndex+1 {
-			count++
+	switch reply.PacketType {
+	case PacketAccept:
+		params, err := reply.SessionParams()
+		if err == nil && (params.Cipher != requested.Cipher || params.Salt != requested.Salt) {
+			return SessionParams{}, errors.New("server did not agree to the encryption of the session")
+		}
+		if err == nil && params.EndToEnd() != requested.EndToEnd() {
+			return SessionParams{}, errors.New("server did not relay a key for end-to-end encryption")
 		}
-		prevIndex = indexesList[i]
+		if err == nil && params != requested {
+			fmt.Println("Server adapted the session to", params)
+		}
+		return params, err
+
+	case PacketReject:
+		return SessionParams{}, errors.New("server rejected the session: " + string(reply.Data[:reply.DataSize]))
+
+	default:
+		return SessionParams{}, fmt.Errorf("unexpected packet type %d instead of the server's answer to Hello", reply.PacketType)
 	}
-	return count
 }
 
+// jamRoom is the room the client joined. streamRoutine plays a single stream, the one of the first participant heard
+type jamRoom struct {
+	name      string
+	streamID  uint32 // The stream ID the others hear the client as
+	following uint32 // The stream played, zero until a participant is heard
+}
 
-func countLostPackets(indexesList []int64) int {
-	maxItem := slices.Max(indexesList)
-	return int(maxItem+1) - len(indexesList)
+// joinRoom asks the server to put the client in the room and returns it with the stream ID of the client.
+// The Join packet is resent a few times in case it was lost on the way (UDP), the packets of the room meanwhile are dropped.
+// The others of the room are announced after the answer
+func joinRoom(link *Link, room string) (*jamRoom, error) {
+	conn := link.Conn()
+	defer conn.SetReadDeadline(time.Time{})
+	for attempt := 0; attempt < JoinAttempts; attempt++ {
+		join := JoinPacket(link.NextSerial(), room)
+		if err := link.Send(join); err != nil {
+			return nil, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(JoinTimeout)); err != nil {
+			return nil, err
+		}
+		for {
+			var reply Packet
+			err := link.Receive(&reply)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if errors.Is(err, ErrBadHeader) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			// The server answers with the Join packet itself, the others joining are announced with their own
+			if reply.PacketType == PacketJoin && reply.InitTime == join.InitTime {
+				return &jamRoom{name: room, streamID: reply.StreamID}, nil
+			}
+			if reply.PacketType == PacketReject && reply.InitTime == join.InitTime {
+				return nil, errors.New("server refused to let the client join room " + room + ": " + string(reply.Data[:reply.DataSize]))
+			}
+		}
+	}
+	return nil, errors.New("server did not answer the request to join room " + room)
 }
 
-func dial(netType, address string) (net.Conn, error) {
-	var (
-		conn net.Conn
-		err  error
-	)
-	switch netType {
-	case "tcp":
-		conn, err = net.Dial(netType, address)
-	case "udp":
-		udpConn, err := net.ResolveUDPAddr("udp", address)
-		CheckError(err)
+// follow reports whether a packet of the room is of the stream played. The client does not mix the streams of a room:
+// the first stream heard is played until its participant leaves, then the next one heard
+func (room *jamRoom) follow(packet *Packet) bool {
+	if room.following == 0 && packet.StreamID != 0 && packet.StreamID != room.streamID {
+		room.following = packet.StreamID
+		fmt.Println("Listening to stream", room.following, "of room", room.name)
+	}
+	return packet.StreamID == room.following
+}
 
-		conn, err = net.DialUDP("udp", nil, udpConn)
-		return conn, err
+// announce prints who joined or left the room and returns it for the log
+func (room *jamRoom) announce(packet *Packet) string {
+	if packet.StreamID == room.streamID {
+		return "got the answer to a Join packet sent again"
+	}
+	message := fmt.Sprintf("Stream %d joined room %s", packet.StreamID, room.name)
+	if packet.PacketType == PacketLeave {
+		message = fmt.Sprintf("Stream %d left room %s", packet.StreamID, room.name)
 	}
-	return conn, err
+	if packet.PacketType == PacketLeave && packet.StreamID == room.following {
+		room.following = 0
+		message += ", listening to the next stream heard"
+	}
+	fmt.Println(message)
+	return message
 }
 
 // CalculateInterArrival compute the differences between consecutive elements in a byte slice using map and a lambda function
@@ -289,6 +693,22 @@ func getPercentage(num int, outOf int64) float32 {
 	return 100 * (float32(num) / float32(outOf))
 }
 
+// frameSizePrefix starts the SummarizedStats line of a frame size, whole sizes are printed as integers
+func frameSizePrefix(frameSize float32) string {
+	if isWhole(frameSize) {
+		return fmt.Sprintf("Frame size: %4d ", int(frameSize))
+	}
+	return fmt.Sprintf("Frame size:%5.2f ", frameSize)
+}
+
+// summaryLine is the SummarizedStats line of a session
+func summaryLine(metrics *NetworkMetrics) string {
+	return frameSizePrefix(metrics.frameSize) + fmt.Sprintf("| Average End to End:%8.3f | Average RTT:%8.3f | Average Inter-Arrival:%8.3f | Jitter:%8.3f | Unordered Packets:%5.2f%% | Lost Packets:%5.2f%% | Uplink:%8.3f | Downlink:%8.3f | Server Dwell:%8.3f | Recovered Packets:%5.2f%% | FEC Recovered:%5.2f%% | Retransmitted:%5.2f%% | TLS Handshake:%8.3f | TLS Overhead:%6.2f",
+		metrics.endToEnd, metrics.roundTripTime, metrics.interArrival, metrics.jitter, metrics.unorderedArrivals, metrics.lostPackets,
+		metrics.uplink, metrics.downlink, metrics.serverDwell, metrics.recoveredPackets,
+		metrics.parityRecovered, metrics.retransmitted, metrics.tlsHandshake, metrics.tlsOverhead)
+}
+
 func updateStats(summarizedStatsFile string, metrics *NetworkMetrics) error {
 	file, err := os.OpenFile(summarizedStatsFile, os.O_CREATE|os.O_RDWR, 0666)
 	CheckError(err)
@@ -300,25 +720,11 @@ func updateStats(summarizedStatsFile string, metrics *NetworkMetrics) error {
 
 	for scanner.Scan() {
 		line := scanner.Text()
-		if isWhole(metrics.frameSize) {
-			frameSizeInt := int(metrics.frameSize)
-			if strings.HasPrefix(line, fmt.Sprintf("Frame size: %4d ", frameSizeInt)) {
-				newLine := fmt.Sprintf("Frame size: %4d | Average End to End:%8.3f | Average RTT:%8.3f | Average Inter-Arrival:%8.3f | Jitter:%8.3f | Unordered Packets:%5.2f%% | Lost Packets:%5.2f%%",
-					frameSizeInt, metrics.endToEnd, metrics.roundTripTime, metrics.interArrival, metrics.jitter, metrics.unorderedArrivals, metrics.lostPackets)
-				lines = append(lines, newLine)
-				found = true
-			} else {
-				lines = append(lines, line)
-			}
+		if strings.HasPrefix(line, frameSizePrefix(metrics.frameSize)) {
+			lines = append(lines, summaryLine(metrics))
+			found = true
 		} else {
-			if strings.HasPrefix(line, fmt.Sprintf("Frame size:%5.2f ", metrics.frameSize)) {
-				newLine := fmt.Sprintf("Frame size:%5.2f | Average End to End:%8.3f | Average RTT:%8.3f | Average Inter-Arrival:%8.3f | Jitter:%8.3f | Unordered Packets:%5.2f%% | Lost Packets:%5.2f%%",
-					metrics.frameSize, metrics.endToEnd, metrics.roundTripTime, metrics.interArrival, metrics.jitter, metrics.unorderedArrivals, metrics.lostPackets)
-				lines = append(lines, newLine)
-				found = true
-			} else {
-				lines = append(lines, line)
-			}
+			lines = append(lines, line)
 		}
 	}
 
@@ -327,16 +733,7 @@ func updateStats(summarizedStatsFile string, metrics *NetworkMetrics) error {
 	}
 
 	if !found {
-		if isWhole(metrics.frameSize) {
-			frameSizeInt := int(metrics.frameSize)
-			newLine := fmt.Sprintf("Frame size: %4d | Average End to End:%8.3f | Average RTT:%8.3f | Average Inter-Arrival:%8.3f | Jitter:%8.3f | Unordered Packets:%5.2f%% | Lost Packets:%5.2f%%",
-			frameSizeInt, metrics.endToEnd, metrics.roundTripTime, metrics.interArrival, metrics.jitter, metrics.unorderedArrivals, metrics.lostPackets)
-			lines = append(lines, newLine)
-		} else {
-			newLine := fmt.Sprintf("Frame size:%5.2f | Average End to End:%8.3f | Average RTT:%8.3f | Average Inter-Arrival:%8.3f | Jitter:%8.3f | Unordered Packets:%5.2f%% | Lost Packets:%5.2f%%",
-				metrics.frameSize, metrics.endToEnd, metrics.roundTripTime, metrics.interArrival, metrics.jitter, metrics.unorderedArrivals, metrics.lostPackets)
-			lines = append(lines, newLine)
-		}
+		lines = append(lines, summaryLine(metrics))
 	}
 
 	sort.Slice(lines, func(i, j int) bool {
@@ -3,11 +3,12 @@ package main
 
 import (
 	. "RemoteStudioLive/SharedUtils"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
-	"net"
 	"os"
 	"os/signal"
-	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,28 +22,158 @@ import (
 )
 
 func main() {
-	connSpecs := InitConnSpecs(os.Args[1], os.Args[2], os.Args[3], os.Args[4])
-	frameSize, _ := strconv.Atoi(os.Args[5])
+	wireFormatName := flag.String("wire", "native", "Wire format of the audio packets (native or rtp)")
+	redundancy := flag.Int("redundancy", 0, "Previous frames every recorded packet carries over udp (0 to 2)")
+	fec := flag.Int("fec", 0, "Recorded packets protected by every XOR parity packet over udp (0 for off, 2 to 32)")
+	nack := flag.Int("nack", 0, "Playout delay in milliseconds that retransmissions of lost packets must meet over udp (0 for off)")
+	cipherName := flag.String("cipher", "aes-gcm", "Cipher suite of encrypted sessions (aes-gcm or chacha20-poly1305)")
+	passphrase := flag.String("passphrase", os.Getenv(PassphraseEnv), "Passphrase to encrypt the session with, none for an unencrypted session (default $"+PassphraseEnv+")")
+	useTLS := flag.Bool("tls", false, "Connect over TLS, the server certificate is verified against the system roots unless -pin is given (tcp only)")
+	pin := flag.String("pin", "", "SHA-256 fingerprint of the server certificate to trust, as the server prints it (implies -tls)")
+	endToEnd := flag.Bool("e2e", false, "Encrypt the recorded Opus frames end-to-end, so the server relays them without being able to decode them. A room is then shared with one other participant")
+	stunServer := flag.String("stun", "", "STUN server (host:port) to learn the public address of this machine from, e.g. stun.l.google.com:19302 or the port of a udp server")
+	mtu := flag.Int("mtu", DefaultMTU, "MTU of the path to the server, udp packets are kept within it so they are never fragmented")
+	probeMTU := flag.Bool("probe-mtu", false, "Probe the path MTU up to -mtu with packets that must not be fragmented, the server echoes them (udp on Linux only)")
+	idleTimeout := flag.Duration("idle-timeout", DefaultIdleTimeout, "End the session when the server sends nothing, not even a heartbeat, for this long (0 to wait forever)")
+	room := flag.String("room", "", "Join this room of the server to hear its participants instead of the echo. The streams are not mixed: the first participant heard is played until it leaves")
+	flag.Parse()
+	wireFormat, err := ParseWireFormat(*wireFormatName)
+	CheckError(err)
+	cipherSuite, err := ParseCipherSuite(*cipherName)
+	CheckError(err)
 
-	conn, err := dial(connSpecs.Type, connSpecs.IP+":"+connSpecs.Port)
+	connSpecs := InitConnSpecs(flag.Arg(0), flag.Arg(1), flag.Arg(2), flag.Arg(3))
+	if *redundancy != 0 && connSpecs.Type != "udp" {
+		fmt.Println("Redundancy is only used over udp, tcp does not lose packets")
+		*redundancy = 0
+	}
+	if *fec != 0 && connSpecs.Type != "udp" {
+		fmt.Println("Parity FEC is only used over udp, tcp does not lose packets")
+		*fec = 0
+	}
+	var parityEncoder *ParityEncoder
+	if *fec != 0 {
+		parityEncoder, err = NewParityEncoder(*fec)
+		CheckError(err)
+	}
+	if *nack != 0 && connSpecs.Type != "udp" {
+		fmt.Println("Retransmissions are only used over udp, tcp does not lose packets")
+		*nack = 0
+	}
+	if *nack != 0 && *room != "" {
+		fmt.Println("Retransmissions are only used for the echo, the server does not keep the streams of a room")
+		*nack = 0
+	}
+	var tlsConfig *tls.Config
+	if (*useTLS || *pin != "") && connSpecs.Type != "tcp" {
+		fmt.Println("TLS is only used over tcp")
+	} else if *useTLS || *pin != "" {
+		tlsConfig = ClientTLSConfig(connSpecs.IP, *pin)
+	}
+	frameSize, _ := strconv.Atoi(flag.Arg(4))
+	if *stunServer != "" {
+		printPublicAddress(*stunServer)
+	}
+
+	transport, err := NewTransport(connSpecs.Type)
+	CheckError(err)
+	if tcp, ok := transport.(*TCPTransport); ok {
+		tcp.TLSConfig = tlsConfig
+	}
+	conn, err := transport.Dial(transport.Address(connSpecs.IP, connSpecs.Port))
 	CheckError(err)
-	defer conn.Close()
+	tlsConn, _ := conn.(*TLSConn)
+	if tlsConn != nil {
+		fmt.Println("TLS handshake took", tlsConn.HandshakeTime)
+	}
+	link := NewLink(conn, wireFormat)
+	link.SetMTU(*mtu)
+	defer link.Close()
+
+	// Agree on the audio parameters before any audio is sent
+	requested := requestedSessionParams(connSpecs.OpMode, frameSize)
+	var passphraseKey []byte
+	if *passphrase != "" && cipherSuite != CipherNone {
+		passphraseKey = PassphraseKey(*passphrase)
+		requested.Cipher = cipherSuite
+		requested.Salt, err = NewSalt()
+		CheckError(err)
+	}
+	var keyPair *E2EKeyPair
+	if *endToEnd && connSpecs.OpMode == "record" {
+		keyPair, err = NewE2EKeyPair()
+		CheckError(err)
+		requested.E2EKey = keyPair.Public
+	} else if *endToEnd {
+		fmt.Println("End-to-end encryption is only used for recorded Opus frames")
+	}
+	params, err := openSession(link, requested)
+	CheckError(err)
+	if params.Cipher != CipherNone {
+		cipher, err := NewSessionCipher(params.Cipher, passphraseKey, params.Salt, false)
+		CheckError(err)
+		link.SetCipher(cipher)
+	}
+	var e2e *e2ePeer
+	if params.EndToEnd() {
+		if params.E2EKey != keyPair.Public {
+			CheckError(errors.New("server replaced the end-to-end key of the client"))
+		}
+		e2e = newE2EPeer(keyPair)
+	}
+	if e2e != nil && *room == "" {
+		// The client is its own peer for the echo. In a room the server relays the key of the other participant,
+		// the same fingerprint on both ends shows it did not replace it
+		fingerprint, err := e2e.meet(0, keyPair.Public)
+		CheckError(err)
+		fmt.Println("End-to-end encrypted, fingerprint:", fingerprint)
+	}
+	if connSpecs.OpMode == "record" {
+		frameSize = params.FrameSize()
+	}
+	if *probeMTU {
+		if pathMTU, err := ProbePathMTU(link, *mtu); err != nil {
+			fmt.Println("Could not probe the path MTU:", err)
+		} else {
+			fmt.Println("Path MTU:", pathMTU)
+		}
+	}
+	var jam *jamRoom
+	if *room != "" {
+		jam, err = joinRoom(link, *room)
+		CheckError(err)
+		fmt.Println("Joined room", jam.name, "as stream", jam.streamID)
+	}
+	link.EnableRTCP()
+	link.EnableKeepalive(*idleTimeout)
 
 	// Create channels parallel sending, receiving, streaming and collecting messages.
 	statsChannel, streamChannel, handleResponseChannel, endSessionChannel, logChannel := initChannels()
+	clock := NewClockEstimator()
+	stopClockSync := make(chan struct{})
+	var retransmissions *retransmitter
+	if *nack > 0 {
+		retransmissions = newRetransmitter(time.Duration(*nack) * time.Millisecond)
+	}
 
 	var waitGroup sync.WaitGroup
-	waitGroup.Add(4)
+	waitGroup.Add(5)
 	{
 		go logRoutine(LogFile, logChannel, &waitGroup)
 		logFiles := []string{StatisticsLog, InterArrivalLog}
-		go statsRoutine(logFiles, statsChannel, logChannel, &waitGroup, frameSize)
-		go streamRoutine(streamChannel, logChannel, &waitGroup, connSpecs.OpMode, frameSize)
-		go handleResponseRoutine(conn, streamChannel, statsChannel, endSessionChannel, logChannel, &waitGroup)
+		go statsRoutine(logFiles, statsChannel, tlsConn, logChannel, &waitGroup, frameSize)
+		go streamRoutine(streamChannel, logChannel, &waitGroup, connSpecs.OpMode, params)
+		var parityDecoder *ParityDecoder
+		if *fec > 0 {
+			parityDecoder = NewParityDecoder()
+		}
+		go handleResponseRoutine(link, clock, parityDecoder, retransmissions, e2e, jam, streamChannel, statsChannel, endSessionChannel, logChannel, &waitGroup)
+		go clockSyncRoutine(link, stopClockSync, logChannel, &waitGroup)
 	}
 
 	// Close resources and synchronize goroutines
 	defer func() {
+		close(stopClockSync)
 		time.Sleep(10 * time.Second)
 		close(endSessionChannel)
 		close(handleResponseChannel)
@@ -61,17 +192,17 @@ func main() {
 
 	switch connSpecs.OpMode {
 	case "song":
-		sendSong(conn, SongName, endSessionChannel, logChannel)
+		sendSong(link, SongName, endSessionChannel, logChannel)
 	case "record":
 		fmt.Println("Starting session with", getAudioLength(frameSize), "millisecond framesize")
-		recordAndSend(conn, logChannel, endSessionChannel, 30, frameSize)
+		recordAndSend(link, logChannel, endSessionChannel, 30, params, *redundancy, parityEncoder, retransmissions, e2e)
 	}
 
 	logMessage(logChannel, "Exit Code 0")
 	fmt.Println("")
 }
 
-func sendSong(conn net.Conn, songFileName string, endSessionChannel, logChannel chan string) {
+func sendSong(link *Link, songFileName string, endSessionChannel, logChannel chan string) {
 	file, err := os.OpenFile(songFileName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
 	CheckError(err)
 	defer func() {
@@ -79,7 +210,7 @@ func sendSong(conn net.Conn, songFileName string, endSessionChannel, logChannel
 		logMessage(logChannel, "sendSong Done")
 	}()
 
-	buffer := make([]byte, DataFrameSize)
+	buffer := make([]byte, link.MaxDataSize())
 	// Send the song to the server (as packets)
 	packetsCounter := 0
 	for {
@@ -90,13 +221,13 @@ func sendSong(conn net.Conn, songFileName string, endSessionChannel, logChannel
 		if err != nil { // When reading EOF
 			logMessage(logChannel, "sendSong err:"+err.Error())
 			packet := Packet{PacketType: PacketCloseChannel}
-			packet.SendPacket(conn)
+			CheckError(link.Send(&packet))
 			break
 		}
 		tProcessing := time.Now().UnixMilli() - tInit
 		songPacket := InitPacket(PacketRequestSong, packetsCounter, tInit, tProcessing, bytesRead)
 		songPacket.SetData(buffer)
-		songPacket.SendPacket(conn)
+		CheckError(link.Send(songPacket))
 		packetsCounter++
 	}
 
@@ -114,7 +245,7 @@ func sendSong(conn net.Conn, songFileName string, endSessionChannel, logChannel
 	}
 }
 
-func recordAndSend(conn net.Conn, logChannel, endSessionChannel chan string, durationSeconds, frameSize int) {
+func recordAndSend(link *Link, logChannel, endSessionChannel chan string, durationSeconds int, params SessionParams, redundancy int, parityEncoder *ParityEncoder, retransmissions *retransmitter, e2e *e2ePeer) {
 	logMessage(logChannel, "recordAndSend Start")
 	defer logMessage(logChannel, "recordAndSend Done")
 
@@ -123,14 +254,30 @@ func recordAndSend(conn net.Conn, logChannel, endSessionChannel chan string, dur
 
 	portaudio.Initialize()
 	defer portaudio.Terminate()
-	audioBufferSize := frameSize * Channels
+	frameSize, channels, sampleRate := params.FrameSize(), int(params.Channels), int(params.SampleRate)
+	audioBufferSize := frameSize * channels
 	in := make([]int16, audioBufferSize)
-	stream, err := portaudio.OpenDefaultStream(Channels, 0, SampleRate, 1, in)
+	stream, err := portaudio.OpenDefaultStream(channels, 0, float64(sampleRate), 1, in)
 	CheckError(err)
 	defer stream.Close()
 
-	encoder, err := gopus.NewEncoder(SampleRate, Channels, gopus.Audio)
+	encoder, err := gopus.NewEncoder(sampleRate, channels, gopus.Audio)
 	CheckError(err)
+	// In-band FEC, planned for the loss the RTCP reports show once they arrive
+	CheckError(setInbandFEC(encoder, true))
+	expectedLoss := OpusInitialExpectedLoss
+	CheckError(setExpectedLoss(encoder, expectedLoss))
+	redundancyEncoder := NewRedundancyEncoder(redundancy)
+	redundancyEncoder.SetMaxSize(link.MaxDataSize())
+	if parityEncoder != nil {
+		parityEncoder.SetMaxSize(link.MaxDataSize())
+	}
+	// Frames are encoded within what the MTU carries, larger ones would be fragmented
+	maxFrameSize := min(audioBufferSize, frameSizeLimit(link, redundancy > 0, e2e != nil))
+	if expected := encoder.Bitrate() / 8 * frameSize / sampleRate; expected > maxFrameSize {
+		fmt.Printf("Frames of %d samples at %d kbit/s take about %d bytes, an MTU of %d carries %d: they are encoded at a lower quality\n",
+			frameSize, encoder.Bitrate()/1000, expected, link.MTU(), maxFrameSize)
+	}
 	tInit := time.Now().UnixMicro()
 	CheckError(stream.Start())
 
@@ -138,24 +285,59 @@ func recordAndSend(conn net.Conn, logChannel, endSessionChannel chan string, dur
 	fmt.Println("Record start")
 	for {
 		tRecordFrame := time.Now().UnixMicro()
+		if loss, ok := reportedLoss(link.RTCP()); ok && loss != expectedLoss {
+			expectedLoss = loss
+			CheckError(setExpectedLoss(encoder, expectedLoss))
+			logMessage(logChannel, fmt.Sprintf("recordAndSend expects %d%% packet loss", expectedLoss))
+		}
 		//time.Sleep(10*time.Millisecond)
 		CheckError(stream.Read())                                   //* Read filling the buffer by recording samples until the buffer is full
-		data, err := encoder.Encode(in, frameSize, audioBufferSize) //* Encode PCM to Opus
+		data, err := encoder.Encode(in, frameSize, maxFrameSize) //* Encode PCM to Opus
 		if err != nil {
 			logMessage(logChannel, "recordAndSend error: "+err.Error())
 			break
 		}
+		var sealer *E2ESession
+		if e2e != nil {
+			sealer = e2e.current.Load()
+		}
+		if sealer != nil {
+			data = sealer.Seal(uint32(packetsCounter), data)
+		}
 		tProcessing := time.Now().UnixMicro() - tRecordFrame
 		recordPacket := InitPacket(PacketRecord, packetsCounter, tRecordFrame, tProcessing, len(data))
 		packetsCounter++
 		recordPacket.SetData(data)
-		recordPacket.SendPacket(conn)
+		if e2e == nil || sealer != nil { // Until someone else in the room holds the key the frames are not sent, never in the clear
+			if redundancy > 0 {
+				recordPacket = redundancyEncoder.Encode(recordPacket)
+			}
+			err = link.Send(recordPacket)
+			if err == nil && retransmissions != nil {
+				retransmissions.history.Add(recordPacket)
+			}
+			if err == nil && parityEncoder != nil {
+				if parity := parityEncoder.Add(recordPacket); parity != nil {
+					err = link.Send(parity)
+				}
+			}
+		}
+		if err != nil {
+			logMessage(logChannel, "recordAndSend error: "+err.Error())
+			CheckError(stream.Stop())
+			break
+		}
 
 		select {
 		case <-sig:
 			CheckError(stream.Stop())
 			packet := Packet{PacketType: PacketCloseChannel}
-			packet.SendPacket(conn)
+			CheckError(link.Send(&packet))
+			return
+
+		case <-endSessionChannel: // The server is gone, nobody hears the recording anymore
+			logMessage(logChannel, "endSessionChannel got 'endSession' while recording")
+			CheckError(stream.Stop())
 			return
 
 		default:
@@ -163,7 +345,7 @@ func recordAndSend(conn net.Conn, logChannel, endSessionChannel chan string, dur
 				fmt.Println("Record end")
 				logMessage(logChannel, "recordAndPlay Timeout")
 				packet := Packet{PacketType: PacketCloseChannel}
-				packet.SendPacket(conn)
+				CheckError(link.Send(&packet))
 				CheckError(stream.Stop())
 				time.Sleep(5 * time.Second)
 				return
@@ -176,29 +358,128 @@ func recordAndSend(conn net.Conn, logChannel, endSessionChannel chan string, dur
 	logMessage(logChannel, "endSessionChannel got 'endSession' ")
 }
 
-func handleResponseRoutine(conn net.Conn, streamChannel chan []byte, statsChannel chan []int64, endSessionChannel, logChannel chan string, waitGroup *sync.WaitGroup) {
+func handleResponseRoutine(link *Link, clock *ClockEstimator, parityDecoder *ParityDecoder, retransmissions *retransmitter, e2e *e2ePeer, jam *jamRoom, streamChannel chan *Packet, statsChannel chan []int64, endSessionChannel, logChannel chan string, waitGroup *sync.WaitGroup) {
 	logMessage(logChannel, "handleResponseRoutine Start")
 	defer waitGroup.Done()
 	defer logMessage(logChannel, "handleResponseRoutine Done")
+	if retransmissions != nil {
+		defer func() {
+			retransmitted, expired := retransmissions.history.Counts()
+			logMessage(logChannel, fmt.Sprintf("handleResponseRoutine retransmitted %d packets, %d were asked for too late to be played",
+				retransmitted, expired))
+		}()
+	}
 
+	var redundancyDecoder RedundancyDecoder
+	versionWarned := false
 	for {
 		var receivePacket Packet
-		receivePacket.ReadPacket(conn)
+		err := link.Receive(&receivePacket)
+		if errors.Is(err, ErrBadHeader) {
+			var versionErr *VersionError
+			if errors.As(err, &versionErr) && !versionWarned {
+				fmt.Println("Incompatible server:", err)
+				versionWarned = true
+			}
+			logMessage(logChannel, "handleResponseRoutine dropped a packet: "+err.Error())
+			continue
+		}
+		if errors.Is(err, ErrIdleTimeout) {
+			fmt.Println("Session ended:", err)
+			logMessage(logChannel, "handleResponseRoutine ended the session: "+err.Error())
+			endSessionChannel <- "endSession"
+			return
+		}
+		if err != nil {
+			logMessage(logChannel, "handleResponseRoutine lost the connection: "+err.Error())
+			endSessionChannel <- "endSession"
+			return
+		}
 
 		switch receivePacket.PacketType {
 
-		case PacketRequestSong, PacketRecord:
-			timeStampFinal := time.Now().UnixMicro()
-			endToEnd := timeStampFinal - int64(receivePacket.InitTime)
-			statsChannel <- []int64{
-				int64(receivePacket.SerialNumber),
-				timeStampFinal,
-				int64(receivePacket.ProcessingTime),
-				endToEnd,
+		case PacketRequestSong, PacketRecord, PacketRedundant, PacketParity:
+			if jam != nil && !jam.follow(&receivePacket) {
+				continue
 			}
-			streamChannel <- receivePacket.Data[:receivePacket.DataSize]
+			frames, recoveries, err := decodeMedia(&receivePacket, parityDecoder, &redundancyDecoder)
+			if err != nil {
+				logMessage(logChannel, "handleResponseRoutine dropped a packet: "+err.Error())
+				continue
+			}
+			for i, frame := range frames {
+				recovery, fresh := recoveries[i], true
+				if retransmissions != nil {
+					recovery, fresh = retransmissions.receive(frame, recovery)
+				}
+				if fresh && e2e != nil {
+					opener := e2e.current.Load()
+					if opener == nil || frame.StreamID != e2e.peer {
+						// The Join packet of the stream was lost, the server tells the others again with the answer to a Join
+						if jam != nil && time.Since(e2e.lastJoin) > JoinTimeout {
+							e2e.lastJoin = time.Now()
+							if err := link.Send(JoinPacket(link.NextSerial(), jam.name)); err != nil {
+								logMessage(logChannel, "handleResponseRoutine error: "+err.Error())
+							}
+						}
+						logMessage(logChannel, fmt.Sprintf("handleResponseRoutine dropped a frame of stream %d, its end-to-end key is not known", frame.StreamID))
+						continue
+					}
+					if frame, err = openFrame(opener, frame); err != nil {
+						logMessage(logChannel, "handleResponseRoutine dropped a frame: "+err.Error())
+						continue
+					}
+				}
+				if fresh {
+					deliverFrame(frame, recovery, clock, retransmissions, streamChannel, statsChannel)
+				}
+			}
+			if retransmissions == nil {
+				continue
+			}
+			if nack := retransmissions.nack(); nack != nil {
+				if err := link.Send(nack); err != nil {
+					logMessage(logChannel, "handleResponseRoutine error: "+err.Error())
+				}
+			}
+
+		case PacketNack:
+			if retransmissions == nil {
+				continue
+			}
+			if _, err := retransmissions.answer(link, &receivePacket); err != nil {
+				logMessage(logChannel, "handleResponseRoutine error: "+err.Error())
+			}
+
+		case PacketRTCP:
+			logMessage(logChannel, link.RTCP().Feedback().String())
+
+		case PacketJoin, PacketLeave:
+			if jam == nil {
+				continue
+			}
+			following := jam.following
+			logMessage(logChannel, "handleResponseRoutine "+jam.announce(&receivePacket))
+			if e2e != nil && receivePacket.StreamID != jam.streamID {
+				e2e.announced(&receivePacket, logChannel)
+			}
+			if following != 0 && jam.following == 0 { // The serials of the next stream are not those of the one that left
+				redundancyDecoder = RedundancyDecoder{}
+				if parityDecoder != nil {
+					parityDecoder = NewParityDecoder()
+				}
+			}
+
+		case PacketClockProbe:
+			clock.AddProbeReply(&receivePacket, time.Now())
+			logMessage(logChannel, clock.String())
 
 		case PacketCloseChannel:
+			if retransmissions != nil {
+				for _, frame := range retransmissions.flush() {
+					streamChannel <- frame
+				}
+			}
 			endSessionChannel <- "endSession"
 			logMessage(logChannel, "handleResponseRoutine got 'endSession' message")
 			return
@@ -209,6 +490,52 @@ func handleResponseRoutine(conn net.Conn, streamChannel chan []byte, statsChanne
 	}
 }
 
+// deliverFrame passes a received frame to streamRoutine and its measures to statsRoutine.
+// With retransmissions the frames after a gap wait for the missing one before they are played
+func deliverFrame(packet *Packet, recovery int, clock *ClockEstimator, retransmissions *retransmitter, streamChannel chan *Packet, statsChannel chan []int64) {
+	timeStampFinal := time.Now().UnixMicro()
+	endToEnd := timeStampFinal - int64(packet.InitTime)
+	statsChannel <- []int64{
+		int64(packet.SerialNumber),
+		timeStampFinal,
+		int64(packet.ProcessingTime),
+		endToEnd,
+		int64(packet.InitTime + packet.ProcessingTime),
+		int64(packet.ServerReceive),
+		int64(packet.ServerTransmit),
+		clock.Offset(time.UnixMicro(timeStampFinal)).Microseconds(),
+		int64(recovery),
+	}
+	if retransmissions == nil {
+		streamChannel <- packet
+		return
+	}
+	for _, frame := range retransmissions.playable(packet, time.Now()) {
+		streamChannel <- frame
+	}
+}
+
+// clockSyncRoutine probes the clock of the server in the background so the one-way delays can be corrected by the clock offset
+func clockSyncRoutine(link *Link, stopChannel chan struct{}, logChannel chan string, waitGroup *sync.WaitGroup) {
+	logMessage(logChannel, "clockSyncRoutine Start")
+	defer waitGroup.Done()
+	defer logMessage(logChannel, "clockSyncRoutine Done")
+
+	ticker := time.NewTicker(ClockProbeInterval)
+	defer ticker.Stop()
+	for probesCounter := 0; ; probesCounter++ {
+		if err := link.Send(ClockProbe(probesCounter)); err != nil {
+			logMessage(logChannel, "clockSyncRoutine error: "+err.Error())
+			return
+		}
+		select {
+		case <-stopChannel:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func logRoutine(fileName string, logChannel chan string, waitGroup *sync.WaitGroup) {
 	defer waitGroup.Done()
 	logMessage(logChannel, "logRoutine Start")
@@ -230,7 +557,7 @@ func logRoutine(fileName string, logChannel chan string, waitGroup *sync.WaitGro
 	fmt.Fprint(logFile, logBuffer.String())
 }
 
-func statsRoutine(fileNames []string, statsChannel chan []int64, logChannel chan string, waitGroup *sync.WaitGroup, frameSize int) {
+func statsRoutine(fileNames []string, statsChannel chan []int64, tlsConn *TLSConn, logChannel chan string, waitGroup *sync.WaitGroup, frameSize int) {
 	logMessage(logChannel, "statsRoutine Start")
 	defer waitGroup.Done()
 	defer logMessage(logChannel, "statsRoutine Done")
@@ -239,8 +566,12 @@ func statsRoutine(fileNames []string, statsChannel chan []int64, logChannel chan
 	interArrivalFileName := strings.TrimSuffix(fileNames[1], ".txt") + " " + strconv.Itoa(frameSize) + ".txt"
 
 	var (
-		serialNumbers, endToEnds, roundTripTimes, arrivalTimes []int64
-		statisticsBuffer                                       strings.Builder
+		endToEnds, roundTripTimes, arrivalTimes []int64
+		uplinks, downlinks, serverDwells        []int64
+		sequence                                SequenceTracker
+		recoveredPackets, parityRecovered       int
+		retransmitted                           int
+		statisticsBuffer                        strings.Builder
 	)
 	// Listen on the channel
 	for {
@@ -249,18 +580,34 @@ func statsRoutine(fileNames []string, statsChannel chan []int64, logChannel chan
 			// The channel has been closed
 			break
 		}
-		serialNumber, arrivalTime := timeMeasures[0], timeMeasures[1]
+		serialNumber, arrivalTime := sequence.Update(uint32(timeMeasures[0])), timeMeasures[1]
 		processingTime, endToEnd := timeMeasures[2], timeMeasures[3]
+		switch timeMeasures[8] {
+		case recoveredByRedundancy:
+			recoveredPackets++
+		case recoveredByParity:
+			parityRecovered++
+		case recoveredByRetransmission:
+			retransmitted++
+		}
 		roundTripTime := endToEnd - processingTime
+
+		// Four timestamp exchange: the client sends at t1, the server receives at t2 and echoes at t3, the client receives at t4.
+		// The server times are moved to the client clock by the offset estimated by clockSyncRoutine
+		sendTime, serverReceive, serverTransmit, clockOffset := timeMeasures[4], timeMeasures[5], timeMeasures[6], timeMeasures[7]
+		uplink, downlink := serverReceive-clockOffset-sendTime, arrivalTime-(serverTransmit-clockOffset)
+		serverDwell := serverTransmit - serverReceive
 		infoString := fmt.Sprintf(
-			"Packet %4d | End To End: %5d microseconds | Round Trip Time: %4d microseconds\n",
-			serialNumber, endToEnd, roundTripTime)
+			"Packet %4d | End To End: %5d microseconds | Round Trip Time: %4d microseconds | Uplink: %5d microseconds | Downlink: %5d microseconds | Server Dwell: %4d microseconds\n",
+			serialNumber, endToEnd, roundTripTime, uplink, downlink, serverDwell)
 
 		statisticsBuffer.WriteString(infoString)
-		serialNumbers = append(serialNumbers, serialNumber)
 		endToEnds = append(endToEnds, endToEnd)
 		roundTripTimes = append(roundTripTimes, roundTripTime)
 		arrivalTimes = append(arrivalTimes, arrivalTime)
+		uplinks = append(uplinks, uplink)
+		downlinks = append(downlinks, downlink)
+		serverDwells = append(serverDwells, serverDwell)
 	}
 	// Export results to file
 	statisticsFile, err := os.OpenFile(statisticsFileName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
@@ -279,12 +626,18 @@ func statsRoutine(fileNames []string, statsChannel chan []int64, logChannel chan
 	meanRoundTripTime := mean(roundTripTimes)
 	rttJitter := jitter(roundTripTimes) // TODO: Should the jitter be calculated on end to end or rtt?
 
-	unordered := countUnordered(serialNumbers)
-	lostPackets := countLostPackets(serialNumbers)
-	sentPackets := slices.Max(serialNumbers) + 1
+	// The serials are extended across wraparounds and counted from the first one received
+	unordered := sequence.Unordered()
+	lostPackets := int(max(0, sequence.Lost()))
+	sentPackets := sequence.Expected()
 
 	unorderedPercentage := getPercentage(int(unordered), sentPackets)
 	lostPacketsPercentage := getPercentage(lostPackets, sentPackets)
+	logMessage(logChannel, fmt.Sprintf("statsRoutine recovered %d lost packets from redundancy, %d from parity and %d by retransmission, %d stayed lost",
+		recoveredPackets, parityRecovered, retransmitted, lostPackets))
+
+	rejectedPackets, _ := PacketsRejected()
+	logMessage(logChannel, fmt.Sprintf("statsRoutine rejected %d malformed packets", rejectedPackets))
 
 	//fmt.Println("Unordered packets:", unordered, " Out of", sentPackets, " Packets", unorderedPercentage, "%")
 	//fmt.Println("Lost packets:", lostPackets, " Out of", sentPackets, " Packets", lostPacketsPercentage, "%")
@@ -297,6 +650,18 @@ func statsRoutine(fileNames []string, statsChannel chan []int64, logChannel chan
 		jitter:            toMilli(rttJitter),
 		unorderedArrivals: unorderedPercentage,
 		lostPackets:       lostPacketsPercentage,
+		recoveredPackets:  getPercentage(recoveredPackets, sentPackets),
+		parityRecovered:   getPercentage(parityRecovered, sentPackets),
+		retransmitted:     getPercentage(retransmitted, sentPackets),
+		uplink:            toMilli(mean(uplinks)),
+		downlink:          toMilli(mean(downlinks)),
+		serverDwell:       toMilli(mean(serverDwells)),
+	}
+	if tlsConn != nil {
+		metrics.tlsHandshake = toMilli(float64(tlsConn.HandshakeTime.Microseconds()))
+		metrics.tlsOverhead = tlsConn.Overhead()
+		logMessage(logChannel, fmt.Sprintf("statsRoutine TLS handshake took %v and added %.2f bytes per packet",
+			tlsConn.HandshakeTime, metrics.tlsOverhead))
 	}
 
 	CheckError(updateStats(SummarizedStatsFile, &metrics))
@@ -330,7 +695,7 @@ func statsRoutine(fileNames []string, statsChannel chan []int64, logChannel chan
 	*/
 }
 
-func streamRoutine(streamChannel chan []byte, logChannel chan string, waitGroup *sync.WaitGroup, workMode string, frameSize int) {
+func streamRoutine(streamChannel chan *Packet, logChannel chan string, waitGroup *sync.WaitGroup, workMode string, params SessionParams) {
 	logMessage(logChannel, "streamRoutine Start")
 	defer func() {
 		waitGroup.Done()
@@ -339,39 +704,47 @@ func streamRoutine(streamChannel chan []byte, logChannel chan string, waitGroup
 	switch workMode {
 	case "song":
 		for {
-			chunk, ok := <-streamChannel
+			packet, ok := <-streamChannel
 			if !ok {
 				// The channel has been closed
 				return
 			}
-			pipeSongToMPG(chunk)
+			pipeSongToMPG(packet.Data[:packet.DataSize])
 		}
 
 	case "record":
-		decoder, err := gopus.NewDecoder(SampleRate, Channels)
+		frameSize, channels, sampleRate := params.FrameSize(), int(params.Channels), int(params.SampleRate)
+		decoder, err := gopus.NewDecoder(sampleRate, channels)
 		CheckError(err)
-		audioBufferSize := frameSize * Channels
-		CheckError(speaker.Init(beep.SampleRate(SampleRate), audioBufferSize))
+		playout := &playout{decoder: decoder, frameSize: frameSize}
+		defer func() {
+			logMessage(logChannel, fmt.Sprintf("streamRoutine synthesized %d missing frames from in-band FEC and %d with PLC, dropped %d late frames",
+				playout.fecFrames, playout.plcFrames, playout.lateFrames))
+		}()
+		audioBufferSize := frameSize * channels
+		CheckError(speaker.Init(beep.SampleRate(sampleRate), audioBufferSize))
 		var buffer [][2]float64
 
 		streamer := beep.StreamerFunc(func(samples [][2]float64) (n int, ok bool) {
 			if len(buffer) == 0 {
-				chunk, ok := <-streamChannel
+				packet, ok := <-streamChannel
 				if !ok {
 					// The channel has been closed
 					return 0, false
 				}
-				pcm, err := decoder.Decode(chunk, frameSize, false)
+				frames, err := playout.decode(packet)
 				if err != nil {
 					logMessage(logChannel, "Error in streamRoutine: "+err.Error())
 					return 0, false
 				}
 
-				for i := 0; i < len(pcm); i += 2 {
-					buffer = append(buffer, [2]float64{
-						float64(pcm[i]) / 32768.0,
-						float64(pcm[i+1]) / 32768.0,
-					})
+				for _, pcm := range frames {
+					for i := 0; i < len(pcm); i += channels {
+						buffer = append(buffer, [2]float64{
+							float64(pcm[i]) / 32768.0,
+							float64(pcm[i+channels-1]) / 32768.0, // Mono plays the same sample on both sides
+						})
+					}
 				}
 			}
 
@@ -0,0 +1,51 @@
+package main
+
+// extern int opus_encoder_ctl(void *encoder, int request, ...);
+//
+// static int opusEncoderCtl(void *encoder, int request, int value) {
+//   return opus_encoder_ctl(encoder, request, value);
+// }
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+
+	"layeh.com/gopus"
+)
+
+const (
+	opusSetInbandFECRequest   = 4012 // opusSetInbandFECRequest - OPUS_SET_INBAND_FEC_REQUEST of opus_defines.h
+	opusSetPacketLossRequest  = 4014 // opusSetPacketLossRequest - OPUS_SET_PACKET_LOSS_PERC_REQUEST of opus_defines.h
+	OpusInitialExpectedLoss   = 5    // OpusInitialExpectedLoss - The loss percentage the encoder plans for until the first RTCP report
+	opusMaxExpectedLossReport = 100
+)
+
+// gopusEncoder mirrors the layout of gopus.Encoder, which does not expose the controls below
+type gopusEncoder struct {
+	data     []byte
+	cEncoder unsafe.Pointer
+}
+
+func opusEncoderCtl(encoder *gopus.Encoder, request, value int) error {
+	cEncoder := (*gopusEncoder)(unsafe.Pointer(encoder)).cEncoder
+	if ret := C.opusEncoderCtl(cEncoder, C.int(request), C.int(value)); ret != 0 {
+		return fmt.Errorf("opus encoder ctl %d failed with %d", request, int(ret))
+	}
+	return nil
+}
+
+// setInbandFEC makes the encoder add a low bitrate copy of each frame to the next packet (LBRR),
+// which the decoder uses when the packet of the frame is lost
+func setInbandFEC(encoder *gopus.Encoder, enabled bool) error {
+	value := 0
+	if enabled {
+		value = 1
+	}
+	return opusEncoderCtl(encoder, opusSetInbandFECRequest, value)
+}
+
+// setExpectedLoss tells the encoder the packet loss percentage to plan its in-band FEC for
+func setExpectedLoss(encoder *gopus.Encoder, percentage int) error {
+	return opusEncoderCtl(encoder, opusSetPacketLossRequest, max(0, min(percentage, opusMaxExpectedLossReport)))
+}
@@ -9,12 +9,22 @@ ip_address="$1"
 op_mode="record"
 frame_size=480
 setup="lab"
-connType="tcp"
+connType="tcp" # tcp, udp or unix (client and server on the same machine)
+wireFormat="native"
+redundancy=0 # Previous frames carried by every packet over udp (0 to 2)
+fec=0        # Packets protected by every XOR parity packet over udp (0 for off, 2 to 32)
+nack=0       # Playout delay in milliseconds retransmissions must meet over udp (0 for off)
+cipher="aes-gcm" # Cipher suite of the session when RSL_PASSPHRASE is set (aes-gcm or chacha20-poly1305)
+e2e=false        # Encrypt the Opus frames end-to-end, the server only relays them. A room is then for two bandmates
+pin=""           # SHA-256 fingerprint the server prints for its certificate, connects over TLS when set (tcp only)
+mtu=1500         # MTU of the path to the server, lower it for VPNs and tunnels (e.g. 1420 for WireGuard)
+stun=""          # STUN server to print the public address of this machine from, e.g. stun.l.google.com:19302
+room=""          # Room of the server to jam in, the bandmates give the same name (empty for the echo). One bandmate is heard at a time
 
 if [ $op_mode == "record" ]; then
-    go run ClientUtils.go client.go $connType "$ip_address" 7777 $op_mode $frame_size "$@" 2>&1 | grep -v -E "ALSA lib|opus|silk|HarmShapeGain|~|Cannot connect to server socket|Cannot connect to server request channel|jack server is not running"
+    go run ClientUtils.go client.go opusControls.go -wire $wireFormat -redundancy $redundancy -fec $fec -nack $nack -cipher $cipher -e2e=$e2e -pin "$pin" -stun "$stun" -mtu $mtu -room "$room" $connType "$ip_address" 7777 $op_mode $frame_size "$@" 2>&1 | grep -v -E "ALSA lib|opus|silk|HarmShapeGain|~|Cannot connect to server socket|Cannot connect to server request channel|jack server is not running"
 elif [ $op_mode == "song" ]; then
-    go run ClientUtils.go client.go $connType "$ip_address" 7777 $op_mode 2>/dev/null | mpg123 -
+    go run ClientUtils.go client.go opusControls.go -wire $wireFormat -cipher $cipher -pin "$pin" $connType "$ip_address" 7777 $op_mode 2>/dev/null | mpg123 -
 fi  
 
 python3 ./PlotGenerator.py ./Stats/StatisticsLog.txt ./Stats/interArrivalLog.txt $frame_size $setup $connType
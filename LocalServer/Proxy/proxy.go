@@ -0,0 +1,236 @@
+// Impairment proxy src code
+package main
+
+import (
+	. "RemoteStudioLive/SharedUtils"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	streamChunkSize = 32 * 1024 // streamChunkSize - The most bytes of a stream read and impaired at once
+	deliveryQueue   = 1024      // deliveryQueue - Stream chunks waiting for their delivery time before the proxy stops reading
+)
+
+// Proxy forwards the traffic between the clients and a server, impairing every direction like a bad network would
+type Proxy struct {
+	serverAddress string
+	uplink        *direction // From the clients to the server
+	downlink      *direction // From the server to the clients
+}
+
+// direction impairs the packets going one way, shared by every flow like a single bottleneck
+type direction struct {
+	mutex    sync.Mutex
+	impairer *Impairer
+}
+
+func (direction *direction) schedule(size int) []time.Time {
+	direction.mutex.Lock()
+	defer direction.mutex.Unlock()
+	return direction.impairer.Schedule(time.Now(), size)
+}
+
+func (direction *direction) scheduleStream(size int) time.Time {
+	direction.mutex.Lock()
+	defer direction.mutex.Unlock()
+	return direction.impairer.ScheduleStream(time.Now(), size)
+}
+
+func (direction *direction) stats() ImpairmentStats {
+	direction.mutex.Lock()
+	defer direction.mutex.Unlock()
+	return direction.impairer.Stats()
+}
+
+// delivery is a chunk of a stream waiting for its time
+type delivery struct {
+	data []byte
+	at   time.Time
+}
+
+func main() {
+	delay := flag.Duration("delay", 0, "One way delay added to every packet")
+	jitter := flag.Duration("jitter", 0, "Variation of the delay, its meaning depends on -distribution")
+	distributionName := flag.String("distribution", "uniform", "Jitter distribution: uniform (delay +- jitter), normal (jitter is the standard deviation) or pareto (jitter is the mean of a heavy tail)")
+	loss := flag.Float64("loss", 0, "Random loss in percent, a lost tcp segment stalls the stream instead")
+	bursts := flag.String("bursts", "", "Gilbert-Elliott bursty loss as p,r[,lossBad[,lossGood]] in percent: p to enter a burst, r to leave it")
+	duplicate := flag.Float64("duplicate", 0, "Duplicated udp packets in percent")
+	reorder := flag.Float64("reorder", 0, "Reordered udp packets in percent, they are held back by -reorder-delay")
+	reorderDelay := flag.Duration("reorder-delay", 10*time.Millisecond, "How long reordered packets are held back")
+	bandwidth := flag.Int("bandwidth", 0, "Bandwidth cap in kbit/s, 0 for none")
+	backlog := flag.Duration("backlog", DefaultImpairmentBacklog, "Queue of the bandwidth cap, udp packets beyond it are dropped")
+	traceFile := flag.String("trace", "", "StatisticsLog of a recorded session whose per packet delay and loss are replayed instead of -delay, -jitter and -loss")
+	seed := flag.Int64("seed", 1, "Seed of the random choices, the same seed impairs the same traffic the same way")
+	flag.Parse()
+	if flag.NArg() < 4 {
+		fmt.Println("Usage: proxy [flags] tcp|udp <listen port> <server ip> <server port>")
+		os.Exit(2)
+	}
+
+	distribution, err := ParseJitterDistribution(*distributionName)
+	CheckError(err)
+	impairment := Impairment{
+		Delay:        *delay,
+		Jitter:       *jitter,
+		Distribution: distribution,
+		Loss:         *loss / 100,
+		Duplicate:    *duplicate / 100,
+		Reorder:      *reorder / 100,
+		ReorderDelay: *reorderDelay,
+		Bandwidth:    *bandwidth * 1000,
+		Backlog:      *backlog,
+	}
+	if *bursts != "" {
+		impairment.Bursts, err = ParseGilbertElliott(*bursts)
+		CheckError(err)
+	}
+
+	uplink, downlink := impairment, impairment
+	if *traceFile != "" {
+		trace, err := LoadNetworkTrace(*traceFile)
+		CheckError(err)
+		fmt.Println("Replaying", *traceFile+":", trace)
+		uplink.Replay, downlink.Replay = trace.Delays(false), trace.Delays(true)
+	}
+
+	proxy := &Proxy{
+		serverAddress: net.JoinHostPort(flag.Arg(2), flag.Arg(3)),
+		uplink:        &direction{impairer: NewImpairer(uplink, *seed)},
+		downlink:      &direction{impairer: NewImpairer(downlink, *seed+1)},
+	}
+	fmt.Println("Proxying", flag.Arg(0), ":"+flag.Arg(1), "to", proxy.serverAddress, "with", uplink, "up and", downlink, "down")
+	go proxy.printStatsOnExit()
+
+	switch flag.Arg(0) {
+	case "tcp":
+		proxy.startTCP(flag.Arg(1))
+	case "udp":
+		proxy.startUDP(flag.Arg(1))
+	default:
+		fmt.Println("Wrong arguments for proxy initialization")
+	}
+}
+
+// printStatsOnExit prints what the proxy did to the traffic when it is interrupted
+func (proxy *Proxy) printStatsOnExit() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	fmt.Println("Uplink:  ", proxy.uplink.stats())
+	fmt.Println("Downlink:", proxy.downlink.stats())
+	os.Exit(0)
+}
+
+func (proxy *Proxy) startUDP(port string) {
+	ln, err := net.ListenPacket("udp", ":"+port)
+	CheckError(err)
+	defer ln.Close()
+	serverAddress, err := net.ResolveUDPAddr("udp", proxy.serverAddress)
+	CheckError(err)
+
+	// Every client gets its own socket to the server, so the answers can be told apart
+	flows := make(map[string]*net.UDPConn)
+	buffer := make([]byte, BufferSize)
+	for {
+		bytesRead, address, err := ln.ReadFrom(buffer)
+		CheckError(err)
+		upstream, ok := flows[address.String()]
+		if !ok {
+			upstream, err = net.DialUDP("udp", nil, serverAddress)
+			CheckError(err)
+			flows[address.String()] = upstream
+			fmt.Println("New flow from", address)
+			go proxy.forwardDownlink(ln, address, upstream)
+		}
+		data := append([]byte(nil), buffer[:bytesRead]...)
+		for _, at := range proxy.uplink.schedule(bytesRead) {
+			time.AfterFunc(time.Until(at), func() { upstream.Write(data) })
+		}
+	}
+}
+
+// forwardDownlink impairs the packets the server sends to a client
+func (proxy *Proxy) forwardDownlink(ln net.PacketConn, client net.Addr, upstream *net.UDPConn) {
+	buffer := make([]byte, BufferSize)
+	for {
+		bytesRead, err := upstream.Read(buffer)
+		if err != nil {
+			fmt.Println("Flow from", client, "ended", err)
+			return
+		}
+		data := append([]byte(nil), buffer[:bytesRead]...)
+		for _, at := range proxy.downlink.schedule(bytesRead) {
+			time.AfterFunc(time.Until(at), func() { ln.WriteTo(data, client) })
+		}
+	}
+}
+
+func (proxy *Proxy) startTCP(port string) {
+	ln, err := net.Listen("tcp", ":"+port)
+	CheckError(err)
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		CheckError(err)
+		go proxy.handleConnection(conn)
+	}
+}
+
+// handleConnection connects a client to the server and impairs both directions until both are closed
+func (proxy *Proxy) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	upstream, err := net.Dial("tcp", proxy.serverAddress)
+	if err != nil {
+		fmt.Println(conn.RemoteAddr(), "Could not reach the server", err)
+		return
+	}
+	defer upstream.Close()
+	fmt.Println("New connection from", conn.RemoteAddr())
+
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(2)
+	go forwardStream(upstream, conn, proxy.uplink, &waitGroup)
+	go forwardStream(conn, upstream, proxy.downlink, &waitGroup)
+	waitGroup.Wait()
+	fmt.Println(conn.RemoteAddr(), "Disconnected")
+}
+
+// forwardStream copies a stream, every chunk held until its delivery time, and closes the writing side at the end
+func forwardStream(dst, src net.Conn, direction *direction, waitGroup *sync.WaitGroup) {
+	defer waitGroup.Done()
+	deliveries := make(chan delivery, deliveryQueue)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for chunk := range deliveries {
+			time.Sleep(time.Until(chunk.at))
+			if _, err := dst.Write(chunk.data); err != nil {
+				src.Close() // Nothing more can be delivered
+			}
+		}
+		if tcpConn, ok := dst.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+	}()
+
+	buffer := make([]byte, streamChunkSize)
+	for {
+		bytesRead, err := src.Read(buffer)
+		if bytesRead > 0 {
+			deliveries <- delivery{data: append([]byte(nil), buffer[:bytesRead]...), at: direction.scheduleStream(bytesRead)}
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(deliveries)
+	<-done
+}
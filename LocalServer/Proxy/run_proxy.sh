@@ -0,0 +1,13 @@
+#!/bin/bash
+# Sits between the client and the server on one machine: point the client at port 7778 of this machine
+connType="udp"
+server_ip="127.0.0.1"
+delay="20ms"          # One way delay, added in each direction
+jitter="5ms"          # Variation of the delay
+distribution="normal" # uniform, normal or pareto
+loss=1                # Random loss in percent
+bursts=""             # Gilbert-Elliott bursty loss p,r[,lossBad[,lossGood]] in percent, e.g. "1,30"
+bandwidth=0           # kbit/s, 0 for no cap
+trace=""              # A StatisticsLog to replay the delay and loss of, e.g. "../Client/Stats/StatisticsLog 480.txt"
+
+go run proxy.go -delay $delay -jitter $jitter -distribution $distribution -loss $loss -bursts "$bursts" -bandwidth $bandwidth -trace "$trace" $connType 7778 "$server_ip" 7777
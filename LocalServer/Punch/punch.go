@@ -0,0 +1,110 @@
+// Hole punching test src code
+package main
+
+import (
+	. "RemoteStudioLive/SharedUtils"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	pingInterval = 100 * time.Millisecond // pingInterval - Between the probes sent to the peer
+	pingLinger   = time.Second            // pingLinger - How long the peer's probes are still answered after the last one sent
+)
+
+func main() {
+	token := flag.String("token", "jam", "Token the two peers meet with at the server")
+	natName := flag.String("nat", "", "Put this peer behind a simulated NAT: full-cone, restricted, port-restricted or symmetric (none by default)")
+	pings := flag.Int("pings", 20, "Probes sent to the peer once it is reached, to measure the round trip")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		fmt.Println("Usage: punch [flags] <server ip> <server port>")
+		os.Exit(2)
+	}
+
+	var conn net.PacketConn
+	var nat *NATSimulator
+	if *natName != "" {
+		behavior, err := ParseNATBehavior(*natName)
+		CheckError(err)
+		nat = NewNATSimulator(behavior)
+		conn = nat.ListenPacket()
+		fmt.Println("Behind a simulated", behavior, "NAT as", conn.LocalAddr())
+	} else {
+		var err error
+		conn, err = net.ListenPacket("udp", ":0")
+		CheckError(err)
+	}
+	server, err := net.ResolveUDPAddr("udp", net.JoinHostPort(flag.Arg(0), flag.Arg(1)))
+	CheckError(err)
+
+	fmt.Println("Waiting for the peer at rendezvous", *token, "on", server)
+	start := time.Now()
+	peerConn, path, err := Rendezvous(conn, server, *token)
+	CheckError(err)
+	fmt.Println("Reached the peer", path, "at", peerConn.RemoteAddr(), "in", time.Since(start).Round(time.Millisecond))
+	if nat != nil {
+		fmt.Println("The NAT kept out", nat.Dropped(), "datagrams")
+	}
+
+	link := NewLink(peerConn, WireNative)
+	defer link.Close()
+	link.EnableKeepalive(DefaultIdleTimeout)
+	go pingRoutine(link, *pings)
+	measureRoundTrips(link, *pings)
+}
+
+// pingRoutine sends the probes, then closes the link once the peer had time to finish its own
+func pingRoutine(link *Link, pings int) {
+	for probesCounter := 0; probesCounter < pings; probesCounter++ {
+		if err := link.Send(ClockProbe(probesCounter)); err != nil {
+			fmt.Println("Failed sending", err)
+			break
+		}
+		time.Sleep(pingInterval)
+	}
+	time.Sleep(pingLinger)
+	link.Close()
+}
+
+// measureRoundTrips answers the probes of the peer and prints the round trips of the answers to its own
+func measureRoundTrips(link *Link, pings int) {
+	var replies int
+	var total time.Duration
+	for {
+		var packet Packet
+		err := link.Receive(&packet)
+		if errors.Is(err, ErrBadHeader) {
+			continue
+		}
+		if err != nil {
+			if errors.Is(err, ErrIdleTimeout) {
+				fmt.Println("Lost the peer:", err)
+			}
+			break
+		}
+		if packet.PacketType != PacketClockProbe {
+			continue
+		}
+		if packet.ServerTransmit == 0 {
+			// A probe of the peer, answered the way the server answers the clients
+			packet.ServerReceive = uint64(time.Now().UnixMicro())
+			packet.ServerTransmit = uint64(time.Now().UnixMicro())
+			link.Send(&packet)
+			continue
+		}
+		roundTrip := time.Duration(time.Now().UnixMicro()-int64(packet.InitTime)-int64(packet.ServerTransmit-packet.ServerReceive)) * time.Microsecond
+		fmt.Println("Probe", packet.SerialNumber, "round trip", roundTrip)
+		replies++
+		total += roundTrip
+	}
+	if replies > 0 {
+		fmt.Println(replies, "of", pings, "probes answered, mean round trip", (total / time.Duration(replies)).Round(time.Microsecond))
+	} else {
+		fmt.Println("None of the", pings, "probes was answered")
+	}
+}
@@ -0,0 +1,8 @@
+#!/bin/bash
+# Run on both peers with the same token: they meet at the server (run with udp) and punch holes to each other
+server_ip="127.0.0.1"
+token="jam"   # Any token both peers agree on
+nat=""        # Simulated NAT to try punching on one machine: full-cone, restricted, port-restricted or symmetric
+pings=20      # Probes sent to the peer once it is reached
+
+go run punch.go -token "$token" -nat "$nat" -pings $pings "$server_ip" 7777
@@ -1,4 +1,8 @@
 #!/bin/bash
-server_ip=$(ifconfig | grep 'inet [0-9]\+\.[0-9]\+\.[0-9]\+\.[0-9]\+' | awk '{print $2}' | head -n 1)
-connType="tcp"
-go run server.go $connType "$server_ip" 7777 song
\ No newline at end of file
+server_ip="0.0.0.0" # Listens on every interface
+stun_server=""      # STUN server to print the public address to share with the clients behind a NAT, e.g. stun.l.google.com:19302
+connType="tcp" # tcp, udp or unix (client and server on the same machine)
+wireFormat="native"
+# Sessions must be encrypted when RSL_PASSPHRASE is set
+# Add -self-signed, or -cert and -key, to serve tcp over TLS
+go run server.go -wire $wireFormat -stun "$stun_server" $connType "$server_ip" 7777 song
\ No newline at end of file
@@ -4,93 +4,245 @@ package main
 import (
 	. "RemoteStudioLive/SharedUtils"
 	"bufio"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"strings"
+	"time"
 )
 
 // Server type
 type Server struct {
-	connSpecs ConnSpecs
+	connSpecs     ConnSpecs
+	wireFormat    WireFormat
+	passphraseKey []byte        // Sessions must be encrypted when the server has a passphrase
+	tlsConfig     *tls.Config   // TCP connections are wrapped in TLS when set
+	idleTimeout   time.Duration // Sessions whose client stays silent this long are torn down
+	rendezvous    *RendezvousPoint
+	rooms         *Rooms // The clients that joined a room hear each other instead of their echo
+	mtu           int    // udp echoes are kept within it
 }
 
 func main() {
+	wireFormatName := flag.String("wire", "native", "Wire format of the echoed audio packets (native or rtp)")
+	passphrase := flag.String("passphrase", os.Getenv(PassphraseEnv), "Passphrase the sessions are encrypted with, none to allow unencrypted sessions (default $"+PassphraseEnv+")")
+	certFile := flag.String("cert", "", "PEM certificate of the server, tcp connections use TLS when it is given")
+	keyFile := flag.String("key", "", "PEM private key of the -cert certificate")
+	selfSigned := flag.Bool("self-signed", false, "Use TLS with a generated self-signed certificate for lab use, written to -cert and -key when they are given")
+	stunServer := flag.String("stun", "", "STUN server (host:port) to learn the public address to share with the clients behind a NAT, e.g. stun.l.google.com:19302")
+	mtu := flag.Int("mtu", DefaultMTU, "MTU of the paths to the clients, udp packets that it would fragment are not echoed")
+	idleTimeout := flag.Duration("idle-timeout", DefaultIdleTimeout, "Tear a session down when its client sends nothing, not even a heartbeat, for this long (0 to wait forever)")
+	flag.Parse()
+	wireFormat, err := ParseWireFormat(*wireFormatName)
+	CheckError(err)
 
-	server := &Server{}
-	specs := InitConnSpecs(os.Args[1], os.Args[2], os.Args[3], os.Args[4])
+	server := &Server{wireFormat: wireFormat, idleTimeout: *idleTimeout, rendezvous: NewRendezvousPoint(), rooms: NewRooms(), mtu: *mtu}
+	if *passphrase != "" {
+		server.passphraseKey = PassphraseKey(*passphrase)
+		fmt.Println("Sessions must be encrypted with the passphrase")
+	}
+	specs := InitConnSpecs(flag.Arg(0), flag.Arg(1), flag.Arg(2), flag.Arg(3))
 	server.connSpecs = *specs
+	var publicIP string
+	if *stunServer != "" {
+		publicIP = discoverPublicIP(*stunServer, specs.Port)
+	}
+	if (*selfSigned || *certFile != "") && specs.Type != "tcp" {
+		fmt.Println("TLS is only used over tcp")
+	} else if *selfSigned || *certFile != "" {
+		var certificate tls.Certificate
+		if *selfSigned {
+			certificate, err = SelfSignedCertificate(specs.IP, "localhost", publicIP)
+			CheckError(err)
+			if *certFile != "" && *keyFile != "" {
+				CheckError(WriteCertificate(certificate, *certFile, *keyFile))
+			}
+		} else {
+			certificate, err = tls.LoadX509KeyPair(*certFile, *keyFile)
+			CheckError(err)
+		}
+		server.tlsConfig = ServerTLSConfig(certificate)
+		fmt.Println("TLS certificate fingerprint, to pin on the clients:", CertificateFingerprint(certificate.Certificate[0]))
+	}
 	server.start()
 }
 
-func (server *Server) start() {
-	switch server.connSpecs.Type {
-	case "tcp":
-		server.startTCP()
-
-	case "udp":
-		server.startUDP()
+// discoverPublicIP asks a STUN server for the public address of the machine and prints it for the clients,
+// empty when the server does not answer
+func discoverPublicIP(stunServer, port string) string {
+	conn, err := net.ListenPacket("udp", ":0")
+	CheckError(err)
+	defer conn.Close()
+	address, err := QuerySTUN(conn, stunServer)
+	if err != nil {
+		fmt.Println("Could not learn the public address:", err)
+		return ""
+	}
+	fmt.Println("Public address to share with the clients:", net.JoinHostPort(address.IP.String(), port),
+		"(behind a NAT, forward the port to this machine)")
+	return address.IP.String()
+}
 
-	default:
+func (server *Server) start() {
+	transport, err := NewTransport(server.connSpecs.Type)
+	if err != nil {
 		fmt.Println("Wrong arguments for server initialization")
+		return
+	}
+	if tcp, ok := transport.(*TCPTransport); ok {
+		tcp.TLSConfig = server.tlsConfig
+	}
+	if udp, ok := transport.(*UDPTransport); ok {
+		udp.AnswerSTUN = true // Clients learn their public address from the server they play with
 	}
+	server.serve(transport)
 }
 
-func (server *Server) startTCP() {
-	ln, err := net.Listen(server.connSpecs.Type, ":"+server.connSpecs.Port)
+// serve accepts the clients of the transport, every one is served by its own goroutine
+func (server *Server) serve(transport Transport) {
+	ln, err := transport.Listen(transport.Address("", server.connSpecs.Port))
 	CheckError(err)
 	defer ln.Close()
-	fmt.Println("Listening tcp on " + server.connSpecs.IP + ":" + server.connSpecs.Port)
+	fmt.Println("Listening " + transport.Name() + " on " + server.connSpecs.IP + ":" + server.connSpecs.Port)
 
-	// Listen for an incoming connection.
+	// Listen for an incoming connection, over udp the first datagram from an address
 	for {
 		conn, err := ln.Accept()
 		CheckError(err)
 		fmt.Println("Connected to:", conn.RemoteAddr().String())
 
 		// Handle incoming messages
-		go handleConnection(conn, server.connSpecs.OpMode)
+		go server.handleConnection(conn)
 	}
 }
 
-func (server *Server) startUDP() {
-	ln, err := net.ListenPacket("udp", ":"+server.connSpecs.Port)
-	CheckError(err)
-	defer ln.Close()
-	fmt.Println("Listening udp on " + server.connSpecs.IP + ":" + server.connSpecs.Port)
-
+// serveRendezvous introduces the client to the peer that gives the same token, so they punch holes to each other,
+// and relays the datagrams of the client to the peer verbatim once it asks for it
+func (server *Server) serveRendezvous(conn Conn, request *Packet) {
+	if !conn.Datagram() {
+		fmt.Println(conn.RemoteAddr(), "Asked for a rendezvous over a stream, only udp peers can punch holes")
+		return
+	}
+	defer server.rendezvous.Leave(conn)
+	var peer Conn
+	relaying := false
+	buffer := make([]byte, BufferSize)
+	packet := request
 	for {
-		buffer := make([]byte, bufio.MaxScanTokenSize)
-		bytesRead, address, err := ln.ReadFrom(buffer)
-		CheckError(err)
-		//fmt.Println("Received packet from: ", address)
-		go func(b []byte, a net.Addr) {
-			_, err = ln.WriteTo(buffer[:bytesRead], address) // Send chunk back to the client
-			CheckError(err)
-		}(buffer, address)
+		if packet != nil {
+			token, err := packet.RendezvousToken()
+			switch {
+			case err != nil:
+				fmt.Println(conn.RemoteAddr(), "Sent a bad rendezvous token")
+			case packet.PacketType == PacketRendezvous:
+				if met := server.rendezvous.Meet(token, conn); met != nil && met != peer {
+					peer = met
+					fmt.Println(conn.RemoteAddr(), "Met", peer.RemoteAddr(), "at rendezvous", token)
+				}
+				if peer != nil {
+					err = PeerAddressPacket(peer.RemoteAddr()).Send(conn)
+				}
+			case packet.PacketType == PacketRelay && peer != nil:
+				if !relaying {
+					fmt.Println(conn.RemoteAddr(), "Relaying to", peer.RemoteAddr(), "the punched holes did not open")
+				}
+				relaying = true
+				err = RelayPacket(token).Send(conn)
+			}
+			if err != nil && !errors.Is(err, ErrBadToken) {
+				fmt.Println(conn.RemoteAddr(), "Failed sending", err)
+				return
+			}
+			packet = nil
+		}
+
+		if server.idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(server.idleTimeout))
+		}
+		bytesRead, err := conn.Read(buffer)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			fmt.Println(conn.RemoteAddr(), "Left the rendezvous: silent for the idle timeout of", server.idleTimeout)
+			return
+		}
+		if err != nil {
+			fmt.Println(conn.RemoteAddr(), "Left the rendezvous")
+			return
+		}
+		var received Packet
+		if received.UnmarshalDatagram(buffer[:bytesRead]) == nil &&
+			(received.PacketType == PacketRendezvous || received.PacketType == PacketRelay) {
+			packet = &received
+		} else if relaying {
+			peer.Write(buffer[:bytesRead])
+		}
+	}
+}
+
+// answerNack sends again the echoed packets a NACK of the client asks for, those that can still be played.
+// The ones the server never received are asked from the client by forwarding it the rest of the NACK
+func answerNack(link *Link, history *SendHistory, nack *Packet) error {
+	// The NACK takes half a round trip to arrive and the retransmission another half
+	packets, forward, err := history.Retransmissions(nack, link.RTCP().Feedback().RTT)
+	if err != nil {
+		return nil // Malformed, dropped like other bad packets
+	}
+	for _, packet := range packets {
+		packet.ServerTransmit = uint64(time.Now().UnixMicro())
+		if err := link.Send(packet); err != nil {
+			return err
+		}
+	}
+	if forward != nil {
+		return link.Send(forward)
+	}
+	return nil
+}
+
+// acceptSession answers a Hello packet with an Accept packet holding the negotiated parameters, or with a Reject packet.
+// The cipher of an encrypted session is returned to be set once the Accept packet is sent, nil for the others
+func (server *Server) acceptSession(hello *Packet, address net.Addr) (*Packet, SessionParams, *SessionCipher, bool) {
+	requested, err := hello.SessionParams()
+	var params SessionParams
+	if err == nil {
+		params, err = NegotiateSession(requested)
+	}
+	if err == nil && params.Cipher == CipherNone && server.passphraseKey != nil {
+		err = errors.New("the server only accepts encrypted sessions")
 	}
+	if err == nil && params.Cipher != CipherNone && server.passphraseKey == nil {
+		err = errors.New("the server has no passphrase for encrypted sessions")
+	}
+	var cipher *SessionCipher
+	if err == nil && params.Cipher != CipherNone {
+		cipher, err = NewSessionCipher(params.Cipher, server.passphraseKey, params.Salt, true)
+	}
+	if err != nil {
+		fmt.Println("Rejected session from", address, err)
+		return RejectPacket(err.Error()), params, nil, false
+	}
+	if params != requested {
+		fmt.Println("Adapted session from", address, "asked", requested, "got", params)
+	} else {
+		fmt.Println("Accepted session from", address, params)
+	}
+	return AcceptPacket(params), params, cipher, true
 }
 
-func handleConnection(conn net.Conn, opMode string) {
+func (server *Server) handleConnection(conn Conn) {
 	// Handle incoming messages
 	defer conn.Close()
-	reader := bufio.NewReader(conn)
-	switch strings.TrimSpace(opMode) {
-	case "song":
-		buffer := make([]byte, bufio.MaxScanTokenSize)
-		for {
-			// Read chunk
-			bytesRead, err := reader.Read(buffer)
-			if err != nil {
-				fmt.Println(conn.RemoteAddr(), "Disconnected")
-				break
-			}
-			// Send chunk back to the client
-			_, writeErr := conn.Write(buffer[:bytesRead])
-			CheckError(writeErr)
-		}
+	if tlsConn, ok := conn.(*TLSConn); ok && !handshakeTLS(tlsConn) {
+		return
+	}
+	switch {
+	case conn.Datagram(), strings.TrimSpace(server.connSpecs.OpMode) == "song":
+		server.serveSession(conn)
 	default:
+		reader := bufio.NewReader(conn)
 		for {
 			message, err := reader.ReadString('\n')
 			if message == "exit\n" || err == io.EOF {
@@ -104,3 +256,168 @@ func handleConnection(conn net.Conn, opMode string) {
 		}
 	}
 }
+
+// serveSession echoes the audio of a client once it opened a session, until it closes it or disconnects.
+// Once the client joined a room its audio is forwarded to the others of the room instead
+func (server *Server) serveSession(conn Conn) {
+	link := NewLink(conn, server.wireFormat)
+	defer link.Close() // Stops the heartbeats, over udp the client is forgotten
+	var participant *Participant
+	defer func() {
+		if participant != nil {
+			server.rooms.Leave(participant)
+			fmt.Println(conn.RemoteAddr(), "Left room", participant.Room)
+		}
+	}()
+	link.SetMTU(server.mtu)
+	rtcp := link.EnableRTCP()
+	if server.idleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(server.idleTimeout)) // The Hello is waited for as long, the heartbeats start once it is accepted
+	}
+	history := NewSendHistory(NackHistorySize) // The echoed packets, to answer the NACKs of the client
+	var session *SessionParams
+	for {
+		// Read chunk
+		var packet Packet
+		err := link.Receive(&packet)
+		received := time.Now()
+		if errors.Is(err, ErrBadHeader) {
+			continue
+		}
+		if err == nil && session == nil && packet.PacketType == PacketRendezvous {
+			server.serveRendezvous(conn, &packet)
+			return
+		}
+		if err == nil && session == nil && packet.PacketType != PacketHello {
+			fmt.Println(conn.RemoteAddr(), "Did not open the session with a Hello packet")
+			return
+		}
+		if errors.Is(err, ErrIdleTimeout) {
+			fmt.Println(conn.RemoteAddr(), "Tore down the session:", err)
+			return
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			fmt.Println(conn.RemoteAddr(), "Sent no Hello for the idle timeout of", server.idleTimeout)
+			return
+		}
+		if err != nil {
+			fmt.Println(conn.RemoteAddr(), "Disconnected")
+			return
+		}
+
+		switch packet.PacketType {
+		case PacketHello:
+			if session != nil {
+				err = link.Send(answerHelloAgain(&packet, *session))
+				break
+			}
+			reply, params, cipher, accepted := server.acceptSession(&packet, conn.RemoteAddr())
+			if err = link.Send(reply); err == nil && !accepted {
+				return
+			}
+			if err == nil {
+				link.SetCipher(cipher) // Before the heartbeats start, none of them is sent in the clear
+				link.EnableKeepalive(server.idleTimeout)
+				session = &params
+			}
+
+		case PacketRTCP:
+			fmt.Println(conn.RemoteAddr(), rtcp.Feedback())
+
+		case PacketNack:
+			err = answerNack(link, history, &packet)
+
+		case PacketJoin:
+			participant, err = server.joinRoom(link, participant, session.E2EKey, &packet)
+
+		case PacketLeave:
+			if participant != nil {
+				server.rooms.Leave(participant)
+				fmt.Println(conn.RemoteAddr(), "Left room", participant.Room)
+				err = link.Send(LeavePacket(link.NextSerial(), participant.Room, participant.StreamID))
+				participant = nil
+			}
+
+		default:
+			// Send chunk back to the client, stamped with the server clock, or to the others of its room
+			packet.ServerReceive = uint64(received.UnixMicro())
+			packet.ServerTransmit = uint64(time.Now().UnixMicro())
+			if participant != nil && (packet.IsMedia() || packet.PacketType == PacketParity) {
+				server.rooms.Forward(participant, &packet)
+				continue
+			}
+			if packet.IsMedia() {
+				history.Add(&packet)
+			}
+			if err = link.Send(&packet); errors.Is(err, ErrExceedsMTU) {
+				fmt.Println(conn.RemoteAddr(), "Did not echo packet", packet.SerialNumber, err)
+				err = nil
+			}
+		}
+		if err != nil {
+			fmt.Println(conn.RemoteAddr(), "Failed sending", err)
+			return
+		}
+		if packet.PacketType == PacketCloseChannel {
+			fmt.Println(conn.RemoteAddr(), "Closed the session")
+			return
+		}
+	}
+}
+
+// answerHelloAgain answers a Hello of an open session, sent again when the Accept was lost. Other parameters are
+// rejected: the cipher is kept, a new one would reuse its nonces, and the heartbeats and the rooms send with it
+func answerHelloAgain(hello *Packet, session SessionParams) *Packet {
+	requested, err := hello.SessionParams()
+	if err == nil {
+		requested, err = NegotiateSession(requested)
+	}
+	if err != nil || requested != session {
+		return RejectPacket("the session is already open with other parameters")
+	}
+	return AcceptPacket(session)
+}
+
+// joinRoom puts the client in the room a Join packet names, out of the room it was in, and answers with the Join packet
+// stamped with its stream ID, or a Reject packet when the room does not take it. The client is then told of the others.
+// A Join packet for the room the client is in was sent again because the answer or the others were lost
+func (server *Server) joinRoom(link *Link, participant *Participant, e2eKey [E2EKeySize]byte, join *Packet) (*Participant, error) {
+	address := link.Conn().RemoteAddr()
+	room, err := join.RoomName()
+	if err != nil {
+		fmt.Println(address, "Asked to join a room with a bad name")
+		return participant, nil
+	}
+	if participant == nil || participant.Room != room {
+		if participant != nil {
+			server.rooms.Leave(participant)
+			fmt.Println(address, "Left room", participant.Room)
+		}
+		if participant, err = server.rooms.Join(room, link, e2eKey); err != nil {
+			fmt.Println(address, "Could not join room", room, err)
+			reject := RejectPacket(err.Error())
+			reject.InitTime = join.InitTime
+			return nil, link.Send(reject)
+		}
+		fmt.Println(address, "Joined room", room, "as stream", participant.StreamID, "with", len(server.rooms.Members(room))-1, "others")
+	}
+	answer := JoinPacket(link.NextSerial(), room) // With a serial of the link, a copy of the Join would look like a replay to the cipher of the client
+	answer.InitTime = join.InitTime
+	answer.StreamID = participant.StreamID
+	answer.ServerReceive, answer.ServerTransmit = uint64(time.Now().UnixMicro()), uint64(time.Now().UnixMicro())
+	if err = link.Send(answer); err != nil {
+		return participant, err
+	}
+	server.rooms.Introduce(participant) // Also when the Join was sent again, the Join packets of the others may have been lost
+	return participant, nil
+}
+
+// handshakeTLS completes the TLS handshake of a new connection and logs how long it took
+func handshakeTLS(conn *TLSConn) bool {
+	if err := conn.CompleteHandshake(); err != nil {
+		fmt.Println(conn.RemoteAddr(), "TLS handshake failed", err)
+		return false
+	}
+	fmt.Println(conn.RemoteAddr(), "TLS handshake took", conn.HandshakeTime)
+	return true
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	. "RemoteStudioLive/SharedUtils"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+const testIdleTimeout = time.Second // The server heartbeats every quarter of it
+
+// startServer serves the clients of a new in-memory transport with the server and returns the transport
+func startServer(t *testing.T, server *Server) *MemoryTransport {
+	transport := NewMemoryTransport(0)
+	ln, err := transport.Listen("studio:7777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go serveListener(server, ln)
+	return transport
+}
+
+// startUDPServer serves the clients of the udp loopback with the server and returns its address
+func startUDPServer(t *testing.T, server *Server) net.Addr {
+	ln, err := (&UDPTransport{}).Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go serveListener(server, ln)
+	return ln.Addr()
+}
+
+func serveListener(server *Server, ln Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go server.handleConnection(conn)
+	}
+}
+
+func newTestServer(passphraseKey []byte) *Server {
+	return &Server{
+		wireFormat:    WireNative,
+		passphraseKey: passphraseKey,
+		idleTimeout:   testIdleTimeout,
+		rendezvous:    NewRendezvousPoint(),
+		rooms:         NewRooms(),
+		mtu:           DefaultMTU,
+	}
+}
+
+// testParams are the parameters of an encrypted session with a new salt
+func testParams(t *testing.T) SessionParams {
+	salt, err := NewSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return SessionParams{Version: ProtocolVersion, Codec: CodecOpus, Channels: 2, SampleRate: 48000,
+		FrameDuration: 10 * time.Millisecond, Cipher: CipherAESGCM, Salt: salt}
+}
+
+// receiveWithin returns the next packet that is not a heartbeat, failing on any error but the deadline
+func receiveWithin(t *testing.T, link *Link, timeout time.Duration) (Packet, bool) {
+	t.Helper()
+	link.Conn().SetReadDeadline(time.Now().Add(timeout))
+	defer link.Conn().SetReadDeadline(time.Time{})
+	var packet Packet
+	err := link.Receive(&packet)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return packet, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet, true
+}
+
+// openSession dials the server and opens an encrypted session with the parameters
+func openSession(t *testing.T, transport *MemoryTransport, passphraseKey []byte, params SessionParams) *Link {
+	t.Helper()
+	conn, err := transport.Dial("studio:7777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := NewLink(conn, WireNative)
+	t.Cleanup(func() { link.Close() })
+	if err := link.Send(HelloPacket(params)); err != nil {
+		t.Fatal(err)
+	}
+	if accept, ok := receiveWithin(t, link, time.Second); !ok || accept.PacketType != PacketAccept {
+		t.Fatalf("got packet type %d instead of an Accept", accept.PacketType)
+	}
+	cipher, err := NewSessionCipher(params.Cipher, passphraseKey, params.Salt, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link.SetCipher(cipher) // No keepalive: it would move the deadlines of receiveWithin
+	return link
+}
+
+func TestHelloAgainWhileHeartbeating(t *testing.T) {
+	passphraseKey := PassphraseKey("server test")
+	transport := startServer(t, newTestServer(passphraseKey))
+	params := testParams(t)
+	link := openSession(t, transport, passphraseKey, params)
+
+	// The heartbeats of the server are sealed from the first one, a heartbeat in the clear fails to open
+	if packet, ok := receiveWithin(t, link, testIdleTimeout/2); ok {
+		t.Fatalf("got packet type %d, only heartbeats were expected", packet.PacketType)
+	}
+
+	for _, test := range []struct {
+		name   string
+		params SessionParams
+		want   uint32
+	}{
+		{"other parameters", testParams(t), PacketReject},
+		{"the same parameters", params, PacketAccept},
+	} {
+		if err := link.Send(HelloPacket(test.params)); err != nil {
+			t.Fatal(err)
+		}
+		if reply, ok := receiveWithin(t, link, time.Second); !ok || reply.PacketType != test.want {
+			t.Errorf("Hello with %s: got packet type %d, want %d", test.name, reply.PacketType, test.want)
+		}
+	}
+
+	// The session goes on with its cipher
+	record := InitPacket(PacketRecord, 1, time.Now().UnixMicro(), 0, 3)
+	record.SetData([]byte{1, 2, 3})
+	if err := link.Send(record); err != nil {
+		t.Fatal(err)
+	}
+	if echo, ok := receiveWithin(t, link, time.Second); !ok || echo.PacketType != PacketRecord || echo.SerialNumber != 1 {
+		t.Errorf("got packet type %d serial %d instead of the echo", echo.PacketType, echo.SerialNumber)
+	}
+}
+
+// roomClient is an encrypted client whose received packets are queued by a goroutine
+type roomClient struct {
+	link    *Link
+	packets chan Packet
+}
+
+// dialRoomClient opens an encrypted session with the server, announcing the end-to-end key, and queues what it receives
+func dialRoomClient(t *testing.T, transport *MemoryTransport, format WireFormat, passphraseKey []byte, e2eKey [E2EKeySize]byte) *roomClient {
+	conn, err := transport.Dial("studio:7777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &roomClient{link: NewLink(conn, format), packets: make(chan Packet, 256)}
+	t.Cleanup(func() { client.link.Close() })
+	requested := testParams(t)
+	requested.E2EKey = e2eKey
+	if err := client.link.Send(HelloPacket(requested)); err != nil {
+		t.Fatal(err)
+	}
+	if accept, ok := receiveWithin(t, client.link, time.Second); !ok || accept.PacketType != PacketAccept {
+		t.Fatalf("got packet type %d instead of an Accept", accept.PacketType)
+	}
+	cipher, err := NewSessionCipher(requested.Cipher, passphraseKey, requested.Salt, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.link.SetCipher(cipher)
+	go func() {
+		defer close(client.packets)
+		for {
+			var packet Packet
+			err := client.link.Receive(&packet)
+			if errors.Is(err, ErrBadHeader) {
+				continue // Replays are dropped
+			}
+			if err != nil {
+				return
+			}
+			client.packets <- packet
+		}
+	}()
+	return client
+}
+
+// newRoomServer creates a server without keepalive, the room clients do not send heartbeats
+func newRoomServer(passphraseKey []byte, format WireFormat) *Server {
+	server := newTestServer(passphraseKey)
+	server.wireFormat, server.idleTimeout = format, 0
+	return server
+}
+
+// next returns the next packet the client received
+func (client *roomClient) next(t *testing.T) Packet {
+	t.Helper()
+	select {
+	case packet, ok := <-client.packets:
+		if !ok {
+			t.Fatal("the link of the client closed")
+		}
+		return packet
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a packet")
+	}
+	return Packet{}
+}
+
+// join sends a Join packet and returns the answer, a Join or a Reject packet. The packets before it are skipped
+func (client *roomClient) join(t *testing.T, room string) Packet {
+	t.Helper()
+	join := JoinPacket(client.link.NextSerial(), room)
+	if err := client.link.Send(join); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		answer := client.next(t)
+		if (answer.PacketType == PacketJoin || answer.PacketType == PacketReject) && answer.InitTime == join.InitTime {
+			return answer
+		}
+	}
+}
+
+// joined sends a Join packet and returns the stream ID of the client
+func (client *roomClient) joined(t *testing.T, room string) uint32 {
+	t.Helper()
+	answer := client.join(t, room)
+	if answer.PacketType != PacketJoin {
+		t.Fatalf("could not join %s: %s", room, answer.Data[:answer.DataSize])
+	}
+	return answer.StreamID
+}
+
+// expectAnnouncement checks that the next packet of the client announces the stream, and returns it
+func (client *roomClient) expectAnnouncement(t *testing.T, packetType uint32, streamID uint32) Packet {
+	t.Helper()
+	packet := client.next(t)
+	if packet.PacketType != packetType || packet.StreamID != streamID {
+		t.Fatalf("got packet type %d of stream %d, want packet type %d of stream %d", packet.PacketType, packet.StreamID, packetType, streamID)
+	}
+	return packet
+}
+
+// expectIntroductions checks that the next packets of the client announce the streams, in any order
+func (client *roomClient) expectIntroductions(t *testing.T, streamIDs []uint32) {
+	t.Helper()
+	pending := make(map[uint32]bool)
+	for _, streamID := range streamIDs {
+		pending[streamID] = true
+	}
+	for range streamIDs {
+		packet := client.next(t)
+		if packet.PacketType != PacketJoin || !pending[packet.StreamID] {
+			t.Fatalf("got packet type %d of stream %d, want the Join packet of one of %v", packet.PacketType, packet.StreamID, streamIDs)
+		}
+		delete(pending, packet.StreamID)
+	}
+}
+
+func TestEncryptedRoom(t *testing.T) {
+	passphraseKey := PassphraseKey("server test")
+	for _, format := range []WireFormat{WireNative, WireRTP} {
+		t.Run(format.String(), func(t *testing.T) {
+			server := newRoomServer(passphraseKey, format)
+			transport := startServer(t, server)
+
+			// Three participants, so every link carries the serials of two streams that overlap
+			var clients []*roomClient
+			var streamIDs []uint32
+			for i := 0; i < 3; i++ {
+				client := dialRoomClient(t, transport, format, passphraseKey, [E2EKeySize]byte{})
+				clients = append(clients, client)
+				streamIDs = append(streamIDs, client.joined(t, "jam"))
+				client.expectIntroductions(t, streamIDs[:i]) // Told of the others after the answer
+			}
+			clients[0].expectAnnouncement(t, PacketJoin, streamIDs[1])
+			clients[0].expectAnnouncement(t, PacketJoin, streamIDs[2])
+			clients[1].expectAnnouncement(t, PacketJoin, streamIDs[2])
+			if resent := clients[0].joined(t, "jam"); resent != streamIDs[0] {
+				t.Errorf("a Join sent again got stream %d, want %d", resent, streamIDs[0])
+			}
+			clients[0].expectIntroductions(t, streamIDs[1:])
+
+			// The streams are more than half the 16 bit RTP sequence apart, a single sequence would extend them wrong
+			const frames = 10
+			bases := []int{0, 40000, 50000}
+			for serial := 0; serial < frames; serial++ {
+				for i, client := range clients {
+					packet := InitPacket(PacketRecord, bases[i]+serial, time.Now().UnixMicro(), 0, 2)
+					packet.SetData([]byte{byte(i), byte(serial)})
+					if err := client.link.Send(packet); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			for i, client := range clients {
+				expected := make(map[uint32]uint32) // The next serial of every stream
+				for j, streamID := range streamIDs {
+					expected[streamID] = uint32(bases[j])
+				}
+				for received := 0; received < frames*(len(clients)-1); received++ {
+					packet := client.next(t)
+					if packet.PacketType != PacketRecord || packet.StreamID == streamIDs[i] {
+						t.Fatalf("client %d: got packet type %d of stream %d", i, packet.PacketType, packet.StreamID)
+					}
+					if packet.SerialNumber != expected[packet.StreamID] {
+						t.Fatalf("client %d: got serial %d of stream %d, want %d", i, packet.SerialNumber, packet.StreamID, expected[packet.StreamID])
+					}
+					expected[packet.StreamID]++
+				}
+			}
+
+			if err := clients[2].link.Send(LeavePacket(clients[2].link.NextSerial(), "jam", 0)); err != nil {
+				t.Fatal(err)
+			}
+			clients[2].expectAnnouncement(t, PacketLeave, streamIDs[2])
+			clients[0].expectAnnouncement(t, PacketLeave, streamIDs[2])
+			clients[1].expectAnnouncement(t, PacketLeave, streamIDs[2])
+			if members := server.rooms.Members("jam"); len(members) != 2 {
+				t.Errorf("got %d members after a leave, want 2", len(members))
+			}
+		})
+	}
+}
+
+func TestEndToEndRoom(t *testing.T) {
+	passphraseKey := PassphraseKey("server test")
+	transport := startServer(t, newRoomServer(passphraseKey, WireNative))
+	var keyPairs []*E2EKeyPair
+	var clients []*roomClient
+	for i := 0; i < 3; i++ {
+		keyPair, err := NewE2EKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyPairs = append(keyPairs, keyPair)
+		clients = append(clients, dialRoomClient(t, transport, WireNative, passphraseKey, keyPair.Public))
+	}
+
+	// The participants learn the key of each other, from the announcement and from the introduction
+	first := clients[0].joined(t, "duo")
+	second := clients[1].joined(t, "duo")
+	announcement := clients[1].expectAnnouncement(t, PacketJoin, first)
+	if key := announcement.RoomE2EKey(); key != keyPairs[0].Public {
+		t.Errorf("the second participant got the key %x, want %x", key, keyPairs[0].Public)
+	}
+	announcement = clients[0].expectAnnouncement(t, PacketJoin, second)
+	if key := announcement.RoomE2EKey(); key != keyPairs[1].Public {
+		t.Errorf("the first participant got the key %x, want %x", key, keyPairs[1].Public)
+	}
+
+	// A frame sealed by one opens with the session the other derives from the key it got
+	sealer, err := NewE2ESession(keyPairs[0], keyPairs[1].Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opener, err := NewE2ESession(keyPairs[1], keyPairs[0].Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := sealer.Seal(7, []byte("opus frame"))
+	packet := InitPacket(PacketRecord, 7, time.Now().UnixMicro(), 0, len(sealed))
+	packet.SetData(sealed)
+	if err := clients[0].link.Send(packet); err != nil {
+		t.Fatal(err)
+	}
+	forwarded := clients[1].next(t)
+	if frame, err := opener.Open(forwarded.SerialNumber, forwarded.Data[:forwarded.DataSize]); err != nil || string(frame) != "opus frame" {
+		t.Errorf("got %q (%v) from the forwarded frame", frame, err)
+	}
+
+	if answer := clients[2].join(t, "duo"); answer.PacketType != PacketReject {
+		t.Errorf("a third participant got packet type %d, want a Reject", answer.PacketType)
+	}
+	plain := dialRoomClient(t, transport, WireNative, passphraseKey, [E2EKeySize]byte{})
+	if answer := plain.join(t, "duo"); answer.PacketType != PacketReject {
+		t.Errorf("a participant without end-to-end encryption got packet type %d, want a Reject", answer.PacketType)
+	}
+	if answer := clients[2].join(t, "trio"); answer.PacketType != PacketJoin {
+		t.Errorf("joining another room got packet type %d, want a Join", answer.PacketType)
+	}
+}
+
+func TestRendezvousThroughNATs(t *testing.T) {
+	tests := []struct {
+		behavior NATBehavior
+		want     PeerPath
+	}{
+		{NATFullCone, PathDirect},
+		{NATRestrictedCone, PathDirect},
+		{NATPortRestrictedCone, PathDirect},
+		{NATSymmetric, PathRelayed},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.behavior.String(), func(t *testing.T) {
+			t.Parallel()
+			server := newTestServer(nil)
+			server.idleTimeout = DefaultIdleTimeout // Longer than the punching, the server keeps the peers for the relay
+			address := startUDPServer(t, server)
+
+			// Each peer is behind a NAT of its own with the behavior
+			type rendezvous struct {
+				conn Conn
+				path PeerPath
+				err  error
+			}
+			results := make(chan rendezvous, 2)
+			for i := 0; i < 2; i++ {
+				socket := NewNATSimulator(test.behavior).ListenPacket()
+				go func() {
+					conn, path, err := Rendezvous(socket, address, "jam")
+					results <- rendezvous{conn, path, err}
+				}()
+			}
+			var peers []Conn
+			for i := 0; i < 2; i++ {
+				result := <-results
+				if result.err != nil {
+					t.Fatal(result.err)
+				}
+				t.Cleanup(func() { result.conn.Close() })
+				if result.path != test.want {
+					t.Errorf("got path %v, want %v", result.path, test.want)
+				}
+				peers = append(peers, result.conn)
+			}
+
+			// The datagrams of the application get through the path both ways
+			for i, sender := range peers {
+				receiver := peers[1-i]
+				if err := Heartbeat(i).Send(sender); err != nil {
+					t.Fatal(err)
+				}
+				receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+				var packet Packet
+				if err := packet.Receive(receiver); err != nil || packet.SerialNumber != uint32(i) {
+					t.Errorf("peer %d got serial %d (%v), want %d", 1-i, packet.SerialNumber, err, i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package sharedutils
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	ClockProbeInterval  = time.Second      // ClockProbeInterval - How often the client probes the clock of the server
+	clockFilterSize     = 8                // clockFilterSize - The exchanges the minimum delay filter picks from (as in NTP)
+	clockRegressionSize = 64               // clockRegressionSize - The filtered samples the drift is fitted on
+	clockDriftSpan      = 30 * time.Second // clockDriftSpan - The drift is estimated only from samples spread over at least this long
+)
+
+// ClockSample is the result of one four timestamp exchange (RFC 5905):
+// the client sends at t1, the peer receives at t2 and answers at t3, the client receives at t4
+type ClockSample struct {
+	Offset time.Duration // The clock of the peer minus the local clock, ((t2-t1)+(t3-t4))/2
+	Delay  time.Duration // The round trip without the time spent in the peer, (t4-t1)-(t3-t2)
+	At     time.Time     // Local time of the exchange, the middle of t1 and t4
+}
+
+// ClockEstimator estimates the offset and drift of the clock of a peer from probe exchanges.
+// Exchanges delayed by queueing are filtered out by keeping the one with the minimum delay
+// among the last few, the drift is the slope of a least squares fit of the filtered offsets
+type ClockEstimator struct {
+	mutex    sync.Mutex
+	recent   []ClockSample // The last clockFilterSize exchanges
+	filtered []ClockSample // The last clockRegressionSize samples picked by the filter
+
+	// The fit, offset(t) = offset + drift * (t - reference)
+	reference time.Time
+	offset    float64 // Microseconds
+	drift     float64 // Microseconds per second, parts per million
+}
+
+// NewClockEstimator creates an estimator with no samples, whose offset is zero until the first exchange
+func NewClockEstimator() *ClockEstimator {
+	return &ClockEstimator{}
+}
+
+// ClockProbe creates a probe packet, the peer answers it with its receive and transmit times
+func ClockProbe(serialNumber int) *Packet {
+	return InitPacket(PacketClockProbe, serialNumber, time.Now().UnixMicro(), 0, 0)
+}
+
+// AddProbeReply adds the exchange of a probe answered by the peer and received at arrival
+func (estimator *ClockEstimator) AddProbeReply(reply *Packet, arrival time.Time) ClockSample {
+	return estimator.AddExchange(int64(reply.InitTime), int64(reply.ServerReceive), int64(reply.ServerTransmit), arrival.UnixMicro())
+}
+
+// AddExchange adds a four timestamp exchange, in microseconds, and updates the estimate
+func (estimator *ClockEstimator) AddExchange(t1, t2, t3, t4 int64) ClockSample {
+	sample := ClockSample{
+		Offset: time.Duration((t2-t1)+(t3-t4)) * time.Microsecond / 2,
+		Delay:  max(0, time.Duration((t4-t1)-(t3-t2))*time.Microsecond),
+		At:     time.UnixMicro(t1 + (t4-t1)/2),
+	}
+
+	estimator.mutex.Lock()
+	defer estimator.mutex.Unlock()
+	estimator.recent = append(estimator.recent, sample)
+	if len(estimator.recent) > clockFilterSize {
+		estimator.recent = estimator.recent[1:]
+	}
+
+	// A sample is used once, when it becomes the minimum delay sample of the window
+	best := estimator.recent[0]
+	for _, recent := range estimator.recent[1:] {
+		if recent.Delay < best.Delay {
+			best = recent
+		}
+	}
+	if last := len(estimator.filtered) - 1; last >= 0 && !best.At.After(estimator.filtered[last].At) {
+		return sample
+	}
+	estimator.filtered = append(estimator.filtered, best)
+	if len(estimator.filtered) > clockRegressionSize {
+		estimator.filtered = estimator.filtered[1:]
+	}
+	estimator.fit()
+	return sample
+}
+
+// fit updates the offset and drift with a least squares line through the filtered samples
+func (estimator *ClockEstimator) fit() {
+	samples := estimator.filtered
+	estimator.reference = samples[0].At
+	var meanX, meanY float64
+	for _, sample := range samples {
+		meanX += sample.At.Sub(estimator.reference).Seconds()
+		meanY += float64(sample.Offset.Microseconds())
+	}
+	meanX /= float64(len(samples))
+	meanY /= float64(len(samples))
+
+	var covariance, variance float64
+	for _, sample := range samples {
+		dx := sample.At.Sub(estimator.reference).Seconds() - meanX
+		covariance += dx * (float64(sample.Offset.Microseconds()) - meanY)
+		variance += dx * dx
+	}
+	estimator.drift = 0
+	if samples[len(samples)-1].At.Sub(samples[0].At) >= clockDriftSpan && variance > 0 {
+		estimator.drift = covariance / variance
+	}
+	estimator.offset = meanY - estimator.drift*meanX
+}
+
+// Offset returns the estimated clock of the peer minus the local clock at the given local time
+func (estimator *ClockEstimator) Offset(at time.Time) time.Duration {
+	estimator.mutex.Lock()
+	defer estimator.mutex.Unlock()
+	if len(estimator.filtered) == 0 {
+		return 0
+	}
+	micros := estimator.offset + estimator.drift*at.Sub(estimator.reference).Seconds()
+	return time.Duration(micros) * time.Microsecond
+}
+
+// Drift returns the estimated rate at which the clock of the peer gains on the local clock, in parts per million
+func (estimator *ClockEstimator) Drift() float64 {
+	estimator.mutex.Lock()
+	defer estimator.mutex.Unlock()
+	return estimator.drift
+}
+
+// ToLocal converts a time of the peer clock, in microseconds, to the local clock
+func (estimator *ClockEstimator) ToLocal(peerMicros int64) int64 {
+	return peerMicros - estimator.Offset(time.UnixMicro(peerMicros)).Microseconds()
+}
+
+func (estimator *ClockEstimator) String() string {
+	estimator.mutex.Lock()
+	samples := len(estimator.filtered)
+	estimator.mutex.Unlock()
+	return fmt.Sprintf("Clock | Offset: %6d microseconds | Drift: %7.3f ppm | Samples: %d",
+		estimator.Offset(time.Now()).Microseconds(), estimator.Drift(), samples)
+}
@@ -0,0 +1,73 @@
+package sharedutils
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// probeExchanges simulates probes, one per second, to a peer whose clock is ahead by offset and gains drift
+// parts per million. Every third exchange is queued on its way back, which skews its offset
+func probeExchanges(estimator *ClockEstimator, base int64, count int, offset, drift float64) {
+	const oneWay, processing, queueing = 1000, 100, 8000
+	peer := func(local int64) int64 {
+		return local + int64(math.Round(offset+drift*float64(local-base)/1e6))
+	}
+	for i := 0; i < count; i++ {
+		t1 := base + int64(i)*time.Second.Microseconds()
+		t2 := peer(t1 + oneWay)
+		t3 := t2 + processing
+		t4 := t1 + 2*oneWay + processing
+		if i%3 == 2 {
+			t4 += queueing
+		}
+		estimator.AddExchange(t1, t2, t3, t4)
+	}
+}
+
+func TestClockSample(t *testing.T) {
+	estimator := NewClockEstimator()
+	if offset := estimator.Offset(time.Now()); offset != 0 {
+		t.Errorf("offset %v before any exchange, want 0", offset)
+	}
+	sample := estimator.AddExchange(1000, 7000, 7100, 3100)
+	if sample.Offset != 5000*time.Microsecond || sample.Delay != 2000*time.Microsecond || sample.At != time.UnixMicro(2050) {
+		t.Errorf("got %+v, want offset 5ms, delay 2ms, at 2050 microseconds", sample)
+	}
+}
+
+func TestClockEstimator(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMicro()
+	tests := []struct {
+		name   string
+		probes int
+		drift  float64
+		want   float64
+	}{
+		{"without drift", 90, 0, 0},
+		{"gaining", 90, 20, 20},
+		{"losing", 90, -50, -50},
+		{"too short for the drift", 20, 20, 0},
+	}
+	for _, test := range tests {
+		estimator := NewClockEstimator()
+		probeExchanges(estimator, base, test.probes, 5000, test.drift)
+		if drift := estimator.Drift(); math.Abs(drift-test.want) > 0.5 {
+			t.Errorf("%s: drift %.3f ppm, want %.3f", test.name, drift, test.want)
+		}
+
+		// Without a drift estimate the offset is the mean of the samples, off by at most the drift over the probes
+		at := base + int64(test.probes-1)*time.Second.Microseconds()
+		want := 5000 + test.drift*float64(at-base)/1e6
+		tolerance := 50.0
+		if test.want == 0 {
+			tolerance += math.Abs(test.drift) * float64(test.probes)
+		}
+		if offset := estimator.Offset(time.UnixMicro(at)); math.Abs(float64(offset.Microseconds())-want) > tolerance {
+			t.Errorf("%s: offset %v at the last probe, want %.0f microseconds", test.name, offset, want)
+		}
+		if local := estimator.ToLocal(at + int64(want)); math.Abs(float64(local-at)) > tolerance {
+			t.Errorf("%s: peer time converted to %d, want %d", test.name, local, at)
+		}
+	}
+}
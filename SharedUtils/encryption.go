@@ -0,0 +1,191 @@
+package sharedutils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// CipherSuite selects the AEAD that seals the data of the packets of a session
+type CipherSuite uint8
+
+const (
+	CipherNone             CipherSuite = iota // CipherNone - Packets are sent in the clear
+	CipherAESGCM                              // CipherAESGCM - AES-256-GCM
+	CipherChaCha20Poly1305                    // CipherChaCha20Poly1305 - ChaCha20-Poly1305 (RFC 8439), faster on CPUs without AES instructions
+)
+
+const (
+	PassphraseEnv    = "RSL_PASSPHRASE"              // PassphraseEnv - The environment variable that holds the passphrase when it is not given as a flag
+	SaltSize         = 16                            // SaltSize - The random salt the client picks for the keys of a session
+	SealOverhead     = sealTagSize + sealNonceSize   // SealOverhead - The bytes sealing adds to the data of a packet
+	sealTagSize      = 16                            // sealTagSize - The authentication tag of both AEADs
+	sealNonceSize    = 8                             // sealNonceSize - The explicit nonce, a count of the packets sealed with the key
+	sessionKeySize   = 32                            // sessionKeySize - AES-256 and ChaCha20 keys
+	argon2Time       = 3                             // argon2Time - Passes of Argon2id, with argon2Memory and argon2Threads the second recommended option of RFC 9106
+	argon2Memory     = 64 * 1024                     // argon2Memory - KiB of memory for Argon2id
+	argon2Threads    = 4                             // argon2Threads - Lanes of Argon2id
+	passphraseSalt   = "RemoteStudioLive passphrase" // passphraseSalt - The passphrase key is the same for every session, the salt of the session makes the keys unique
+	replayWindowSize = NackHistorySize               // replayWindowSize - Serials a replay is recognized within, as many as a NACK can ask to send again
+)
+
+var (
+	// ErrBadSeal is returned for packets of an encrypted session that fail authentication or were not sealed
+	ErrBadSeal = fmt.Errorf("%w: packet failed authentication", ErrBadHeader)
+	// ErrReplayed is returned for packets of an encrypted session whose SerialNumber was already received for their type
+	ErrReplayed = fmt.Errorf("%w: replayed packet", ErrBadHeader)
+)
+
+// ParseCipherSuite parses the name of a cipher suite as given on the command line
+func ParseCipherSuite(name string) (CipherSuite, error) {
+	switch name {
+	case "none":
+		return CipherNone, nil
+	case "aes-gcm":
+		return CipherAESGCM, nil
+	case "chacha20-poly1305":
+		return CipherChaCha20Poly1305, nil
+	}
+	return CipherNone, fmt.Errorf("unknown cipher suite %q (none, aes-gcm or chacha20-poly1305)", name)
+}
+
+func (suite CipherSuite) String() string {
+	switch suite {
+	case CipherNone:
+		return "none"
+	case CipherAESGCM:
+		return "aes-gcm"
+	case CipherChaCha20Poly1305:
+		return "chacha20-poly1305"
+	}
+	return fmt.Sprintf("cipher suite %d", uint8(suite))
+}
+
+// PassphraseKey derives the key of a passphrase with Argon2id. It is slow on purpose, derive it once at startup
+func PassphraseKey(passphrase string) []byte {
+	return argon2.IDKey([]byte(passphrase), []byte(passphraseSalt), argon2Time, argon2Memory, argon2Threads, sessionKeySize)
+}
+
+// NewSalt returns a random salt for the keys of a new session
+func NewSalt() ([SaltSize]byte, error) {
+	var salt [SaltSize]byte
+	_, err := rand.Read(salt[:])
+	return salt, err
+}
+
+// SessionCipher seals the packets one end of a session sends and opens the packets it receives, with a key
+// for each direction derived from the passphrase key and the salt of the session. The header of a packet is
+// authenticated with its data, and a packet is dropped when its SerialNumber was already received for its type
+// and stream: the server forwards the streams of a room with their own serials
+type SessionCipher struct {
+	sealer  cipher.AEAD
+	opener  cipher.AEAD
+	counter uint64                      // The packets sealed so far, the nonce of the next one
+	replay  map[replayKey]*replayWindow // By packet type and stream
+}
+
+// replayKey tells apart the serials of the packets of a type in a stream
+type replayKey struct {
+	packetType uint32
+	streamID   uint32
+}
+
+// NewSessionCipher creates the cipher of the client or the server end of a session
+func NewSessionCipher(suite CipherSuite, passphraseKey []byte, salt [SaltSize]byte, server bool) (*SessionCipher, error) {
+	clientKey, err := sessionKey(passphraseKey, salt, "client to server")
+	if err != nil {
+		return nil, err
+	}
+	serverKey, err := sessionKey(passphraseKey, salt, "server to client")
+	if err != nil {
+		return nil, err
+	}
+	sendKey, receiveKey := clientKey, serverKey
+	if server {
+		sendKey, receiveKey = serverKey, clientKey
+	}
+	sealer, err := newAEAD(suite, sendKey)
+	if err != nil {
+		return nil, err
+	}
+	opener, err := newAEAD(suite, receiveKey)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionCipher{sealer: sealer, opener: opener, replay: make(map[replayKey]*replayWindow)}, nil
+}
+
+// sessionKey derives the key of one direction of a session with HKDF-SHA256
+func sessionKey(passphraseKey []byte, salt [SaltSize]byte, direction string) ([]byte, error) {
+	key := make([]byte, sessionKeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, passphraseKey, salt[:], []byte("remotestudiolive "+direction)), key)
+	return key, err
+}
+
+func newAEAD(suite CipherSuite, key []byte) (cipher.AEAD, error) {
+	switch suite {
+	case CipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+	return nil, fmt.Errorf("sharedutils: no AEAD for %v", suite)
+}
+
+// isSealed reports whether packets of the type are sealed in an encrypted session, the handshake is sent in the clear
+func isSealed(packetType uint32) bool {
+	return packetType != PacketHello && packetType != PacketAccept && packetType != PacketReject
+}
+
+// seal encrypts in place the data of the encoded packet at the end of dst, the last dataSize bytes, and appends
+// the tag and the nonce. The first aadSize bytes of the packet, from start, are authenticated with the data
+func (sessionCipher *SessionCipher) seal(dst []byte, start, dataSize, aadSize int) []byte {
+	sessionCipher.counter++
+	var nonce [12]byte // Both AEADs take 96 bit nonces, the counter fills the last 64 bits
+	binary.BigEndian.PutUint64(nonce[12-sealNonceSize:], sessionCipher.counter)
+
+	dst = slices.Grow(dst, SealOverhead)
+	dataStart := len(dst) - dataSize
+	sealed := sessionCipher.sealer.Seal(dst[dataStart:dataStart], nonce[:], dst[dataStart:], dst[start:start+aadSize])
+	return append(dst[:dataStart+len(sealed)], nonce[12-sealNonceSize:]...)
+}
+
+// open authenticates the sealed data of a packet with the header before it, aad, and decrypts it into the data of the packet.
+// The sealed data may be the data of the packet itself
+func (sessionCipher *SessionCipher) open(packet *Packet, sealed, aad []byte) error {
+	if len(sealed) < SealOverhead {
+		return ErrBadSeal
+	}
+	var nonce [12]byte
+	copy(nonce[12-sealNonceSize:], sealed[len(sealed)-sealNonceSize:])
+	data, err := sessionCipher.opener.Open(packet.Data[:0], nonce[:], sealed[:len(sealed)-sealNonceSize], aad)
+	if err != nil {
+		return ErrBadSeal
+	}
+
+	key := replayKey{packetType: packet.PacketType, streamID: packet.StreamID}
+	window, ok := sessionCipher.replay[key]
+	if !ok {
+		window = new(replayWindow)
+		sessionCipher.replay[key] = window
+	}
+	if !window.check(packet.SerialNumber) {
+		return ErrReplayed
+	}
+	window.mark(packet.SerialNumber)
+	packet.Data, packet.DataSize = data, uint32(len(data))
+	return nil
+}
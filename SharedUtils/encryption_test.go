@@ -0,0 +1,147 @@
+package sharedutils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// cipherCodecs returns the codecs of the client and the server end of a session encrypted with the suite
+func cipherCodecs(t *testing.T, format WireFormat, suite CipherSuite, clientKey, serverKey []byte) (client, server *WireCodec) {
+	t.Helper()
+	salt, err := NewSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server = NewWireCodec(format), NewWireCodec(format)
+	for _, end := range []struct {
+		codec         *WireCodec
+		passphraseKey []byte
+		server        bool
+	}{{client, clientKey, false}, {server, serverKey, true}} {
+		cipher, err := NewSessionCipher(suite, end.passphraseKey, salt, end.server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		end.codec.SetCipher(cipher)
+	}
+	return client, server
+}
+
+// sealedRecord encodes a PacketRecord packet of the serial and stream with the codec
+func sealedRecord(t *testing.T, codec *WireCodec, packetType, serial int, streamID uint32, data []byte) []byte {
+	t.Helper()
+	packet := InitPacket(packetType, serial, time.Now().UnixMicro(), 0, len(data))
+	packet.SetData(data)
+	packet.StreamID = streamID
+	buf, err := codec.AppendPacket(nil, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestSessionCipherRoundTrip(t *testing.T) {
+	passphraseKey := PassphraseKey("encryption test")
+	frame := []byte("an opus frame in the clear")
+	for _, suite := range []CipherSuite{CipherAESGCM, CipherChaCha20Poly1305} {
+		for _, format := range []WireFormat{WireNative, WireRTP} {
+			client, server := cipherCodecs(t, format, suite, passphraseKey, passphraseKey)
+			for _, ends := range []struct {
+				name             string
+				sender, receiver *WireCodec
+			}{{"client to server", client, server}, {"server to client", server, client}} {
+				buf := sealedRecord(t, ends.sender, PacketRecord, 7, 0, frame)
+				if bytes.Contains(buf, frame) {
+					t.Errorf("%v %v %s: the frame is sent in the clear", suite, format, ends.name)
+				}
+				var packet Packet
+				if err := ends.receiver.DecodePacket(buf, &packet); err != nil {
+					t.Fatalf("%v %v %s: %v", suite, format, ends.name, err)
+				}
+				if packet.SerialNumber != 7 || !bytes.Equal(packet.Data[:packet.DataSize], frame) {
+					t.Errorf("%v %v %s: got serial %d and %q", suite, format, ends.name, packet.SerialNumber, packet.Data[:packet.DataSize])
+				}
+			}
+		}
+	}
+}
+
+func TestSessionCipherRejectsForgeries(t *testing.T) {
+	passphraseKey := PassphraseKey("encryption test")
+	otherKey := PassphraseKey("another passphrase")
+	tests := []struct {
+		name      string
+		format    WireFormat
+		serverKey []byte
+		tamper    func(buf []byte)
+	}{
+		{"tampered data", WireNative, passphraseKey, func(buf []byte) { buf[MetadataSize] ^= 1 }},
+		{"tampered header", WireNative, passphraseKey, func(buf []byte) { buf[6] ^= 1 }}, // The serial
+		{"tampered tag", WireNative, passphraseKey, func(buf []byte) { buf[len(buf)-sealNonceSize-1] ^= 1 }},
+		{"tampered nonce", WireNative, passphraseKey, func(buf []byte) { buf[len(buf)-1] ^= 1 }},
+		{"tampered RTP payload", WireRTP, passphraseKey, func(buf []byte) { buf[len(buf)-SealOverhead-1] ^= 1 }},
+		{"tampered RTP timestamp", WireRTP, passphraseKey, func(buf []byte) { buf[7] ^= 1 }},
+		{"wrong key", WireNative, otherKey, func(buf []byte) {}},
+		{"wrong key over RTP", WireRTP, otherKey, func(buf []byte) {}},
+	}
+	for _, test := range tests {
+		for _, suite := range []CipherSuite{CipherAESGCM, CipherChaCha20Poly1305} {
+			client, server := cipherCodecs(t, test.format, suite, passphraseKey, test.serverKey)
+			buf := sealedRecord(t, client, PacketRecord, 7, 0, []byte("an opus frame"))
+			test.tamper(buf)
+			if test.format == WireNative {
+				binary.LittleEndian.PutUint32(buf[checksumOffset:], checksum(buf)) // Tampered past the checksum
+			}
+			var packet Packet
+			if err := server.DecodePacket(buf, &packet); !errors.Is(err, ErrBadSeal) {
+				t.Errorf("%s with %v: got %v, want %v", test.name, suite, err, ErrBadSeal)
+			}
+		}
+	}
+}
+
+func TestSessionCipherRejectsReplays(t *testing.T) {
+	passphraseKey := PassphraseKey("encryption test")
+	client, server := cipherCodecs(t, WireNative, CipherAESGCM, passphraseKey, passphraseKey)
+	receive := func(buf []byte) error {
+		var packet Packet
+		return server.DecodePacket(buf, &packet)
+	}
+	const base = 1000
+	first := sealedRecord(t, client, PacketRecord, base, 1, []byte{1})
+	late := sealedRecord(t, client, PacketRecord, base+1, 1, []byte{2}) // Held back until the window passed it
+	if err := receive(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same serial is new in another stream and for another packet type
+	for _, buf := range [][]byte{
+		sealedRecord(t, client, PacketRecord, base, 2, []byte{3}),
+		sealedRecord(t, client, PacketRedundant, base, 1, []byte{4}),
+	} {
+		if err := receive(buf); err != nil {
+			t.Errorf("the serial of another stream or type: got %v", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		buf  []byte
+		want error
+	}{
+		{"a replayed packet", first, ErrReplayed},
+		{"a new packet of the serial", sealedRecord(t, client, PacketRecord, base, 1, []byte{5}), ErrReplayed},
+		{"a serial the window reaches", sealedRecord(t, client, PacketRecord, base+replayWindowSize+1, 1, []byte{6}), nil},
+		{"a serial older than the window", late, ErrReplayed},
+		{"the first serial of the window", sealedRecord(t, client, PacketRecord, base+2, 1, []byte{7}), nil},
+		{"the other stream behind its own window", sealedRecord(t, client, PacketRecord, base+1, 2, []byte{8}), nil},
+	}
+	for _, test := range tests {
+		if err := receive(test.buf); !errors.Is(err, test.want) || (test.want == nil && err != nil) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
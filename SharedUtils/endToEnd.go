@@ -0,0 +1,136 @@
+package sharedutils
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	E2EKeySize         = curve25519.PointSize // E2EKeySize - The size of the X25519 public key a peer sends in the handshake
+	E2ECipher          = CipherAESGCM         // E2ECipher - The AEAD of the frames encrypted end-to-end, the same for every peer
+	fingerprintSize    = 16                   // fingerprintSize - The bytes of the hash of both keys shown to the users
+	fingerprintGroup   = 2                    // fingerprintGroup - Bytes shown together, as 4 hex digits
+	e2eSessionKeyLabel = "remotestudiolive e2e "
+)
+
+// ErrBadE2EFrame is returned for frames that fail end-to-end authentication
+var ErrBadE2EFrame = errors.New("sharedutils: frame failed end-to-end authentication")
+
+// E2EKeyPair is the X25519 key pair of a peer for one session
+type E2EKeyPair struct {
+	Private [E2EKeySize]byte
+	Public  [E2EKeySize]byte
+}
+
+// NewE2EKeyPair generates a key pair for a new session
+func NewE2EKeyPair() (*E2EKeyPair, error) {
+	var pair E2EKeyPair
+	if _, err := rand.Read(pair.Private[:]); err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(pair.Private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(pair.Public[:], public)
+	return &pair, nil
+}
+
+// E2EFingerprint is the fingerprint of the keys of two peers, the same on both sides.
+// Peers that read the same fingerprint to each other know that no relay replaced their keys
+func E2EFingerprint(own, peer [E2EKeySize]byte) string {
+	first, second := own, peer
+	if bytes.Compare(first[:], second[:]) > 0 {
+		first, second = second, first
+	}
+	hash := sha256.Sum256(append(first[:], second[:]...))
+	groups := make([]string, 0, fingerprintSize/fingerprintGroup)
+	for i := 0; i < fingerprintSize; i += fingerprintGroup {
+		groups = append(groups, fmt.Sprintf("%x", hash[i:i+fingerprintGroup]))
+	}
+	return strings.Join(groups, " ")
+}
+
+// E2ESession encrypts the Opus frames a peer sends for the other peer and decrypts the frames it receives from it,
+// with a key for each direction derived from their X25519 shared secret. The server that relays the frames does not
+// know the keys. The serial of the packet of a frame is authenticated with it
+type E2ESession struct {
+	sealer  cipher.AEAD
+	opener  cipher.AEAD
+	counter uint64 // The frames sealed so far, the nonce of the next one
+}
+
+// NewE2ESession derives the keys of the session between the owner of the key pair and the peer with the given public key.
+// When the server echoes the stream the peer is the owner itself
+func NewE2ESession(own *E2EKeyPair, peer [E2EKeySize]byte) (*E2ESession, error) {
+	shared, err := curve25519.X25519(own.Private[:], peer[:])
+	if err != nil {
+		return nil, err // A low order point, the peer key can not be trusted
+	}
+	sendKey, err := e2eKey(shared, own.Public, peer)
+	if err != nil {
+		return nil, err
+	}
+	receiveKey, err := e2eKey(shared, peer, own.Public)
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := newAEAD(E2ECipher, sendKey)
+	if err != nil {
+		return nil, err
+	}
+	opener, err := newAEAD(E2ECipher, receiveKey)
+	if err != nil {
+		return nil, err
+	}
+	return &E2ESession{sealer: sealer, opener: opener}, nil
+}
+
+// e2eKey derives the key of the frames the sender sends to the receiver with HKDF-SHA256
+func e2eKey(shared []byte, sender, receiver [E2EKeySize]byte) ([]byte, error) {
+	info := append([]byte(e2eSessionKeyLabel), sender[:]...)
+	info = append(info, receiver[:]...)
+	key := make([]byte, sessionKeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, info), key)
+	return key, err
+}
+
+// Seal encrypts a frame for the peer, followed by the tag and the nonce
+func (session *E2ESession) Seal(serial uint32, frame []byte) []byte {
+	session.counter++
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[12-sealNonceSize:], session.counter)
+	var aad [4]byte
+	binary.LittleEndian.PutUint32(aad[:], serial)
+
+	sealed := session.sealer.Seal(make([]byte, 0, len(frame)+SealOverhead), nonce[:], frame, aad[:])
+	return append(sealed, nonce[12-sealNonceSize:]...)
+}
+
+// Open decrypts a frame sealed by the peer into a new buffer, the sealed frame is left as it is
+// since the parity decoder may still need it
+func (session *E2ESession) Open(serial uint32, sealed []byte) ([]byte, error) {
+	if len(sealed) < SealOverhead {
+		return nil, ErrBadE2EFrame
+	}
+	var nonce [12]byte
+	copy(nonce[12-sealNonceSize:], sealed[len(sealed)-sealNonceSize:])
+	var aad [4]byte
+	binary.LittleEndian.PutUint32(aad[:], serial)
+
+	frame, err := session.opener.Open(nil, nonce[:], sealed[:len(sealed)-sealNonceSize], aad[:])
+	if err != nil {
+		return nil, ErrBadE2EFrame
+	}
+	return frame, nil
+}
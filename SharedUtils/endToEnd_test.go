@@ -0,0 +1,97 @@
+package sharedutils
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+)
+
+func newTestKeyPair(t *testing.T) *E2EKeyPair {
+	t.Helper()
+	keyPair, err := NewE2EKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyPair
+}
+
+func newTestE2ESession(t *testing.T, own *E2EKeyPair, peer [E2EKeySize]byte) *E2ESession {
+	t.Helper()
+	session, err := NewE2ESession(own, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func TestE2ESessionBothWays(t *testing.T) {
+	alice, bob := newTestKeyPair(t), newTestKeyPair(t)
+	aliceSession := newTestE2ESession(t, alice, bob.Public)
+	bobSession := newTestE2ESession(t, bob, alice.Public)
+	for _, ends := range []struct {
+		name           string
+		sealer, opener *E2ESession
+	}{{"alice to bob", aliceSession, bobSession}, {"bob to alice", bobSession, aliceSession}} {
+		sealed := ends.sealer.Seal(42, []byte("opus frame"))
+		if frame, err := ends.opener.Open(42, sealed); err != nil || string(frame) != "opus frame" {
+			t.Errorf("%s: got %q (%v)", ends.name, frame, err)
+		}
+	}
+
+	// The echo of the server is sealed and opened by the same peer
+	echo := newTestE2ESession(t, alice, alice.Public)
+	if frame, err := echo.Open(1, echo.Seal(1, []byte("echo"))); err != nil || string(frame) != "echo" {
+		t.Errorf("echo: got %q (%v)", frame, err)
+	}
+
+	fingerprint := E2EFingerprint(alice.Public, bob.Public)
+	if other := E2EFingerprint(bob.Public, alice.Public); other != fingerprint {
+		t.Errorf("the peers read %q and %q", fingerprint, other)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{4}( [0-9a-f]{4}){7}$`).MatchString(fingerprint) {
+		t.Errorf("fingerprint %q is not 8 groups of 4 hex digits", fingerprint)
+	}
+}
+
+func TestE2ESessionRejectsForgeries(t *testing.T) {
+	alice, bob := newTestKeyPair(t), newTestKeyPair(t)
+	sealer := newTestE2ESession(t, alice, bob.Public)
+	opener := newTestE2ESession(t, bob, alice.Public)
+	sealed := sealer.Seal(7, []byte("opus frame"))
+	tests := []struct {
+		name   string
+		serial uint32
+		sealed func() []byte
+	}{
+		{"tampered frame", 7, func() []byte { forged := append([]byte(nil), sealed...); forged[0] ^= 1; return forged }},
+		{"tampered nonce", 7, func() []byte { forged := append([]byte(nil), sealed...); forged[len(forged)-1] ^= 1; return forged }},
+		{"other serial", 8, func() []byte { return sealed }},
+		{"truncated", 7, func() []byte { return sealed[:SealOverhead-1] }},
+	}
+	for _, test := range tests {
+		if _, err := opener.Open(test.serial, test.sealed()); !errors.Is(err, ErrBadE2EFrame) {
+			t.Errorf("%s: got %v, want %v", test.name, err, ErrBadE2EFrame)
+		}
+	}
+	if frame, err := opener.Open(7, sealed); err != nil || string(frame) != "opus frame" {
+		t.Errorf("the sealed frame was changed by the forgeries: got %q (%v)", frame, err)
+	}
+}
+
+func TestE2EFingerprintMismatch(t *testing.T) {
+	// The relay hands alice its own key for bob's: the fingerprints the peers read differ
+	alice, bob, relay := newTestKeyPair(t), newTestKeyPair(t), newTestKeyPair(t)
+	if E2EFingerprint(alice.Public, relay.Public) == E2EFingerprint(bob.Public, alice.Public) {
+		t.Fatal("a replaced key gave the same fingerprint")
+	}
+	// and what alice seals for the relay is rejected by bob, if the relay passes it on
+	toRelay := newTestE2ESession(t, alice, relay.Public)
+	fromAlice := newTestE2ESession(t, bob, alice.Public)
+	if _, err := fromAlice.Open(1, toRelay.Seal(1, []byte("opus frame"))); !errors.Is(err, ErrBadE2EFrame) {
+		t.Errorf("a frame sealed for the relay: got %v, want %v", err, ErrBadE2EFrame)
+	}
+	// A low order point as the key of the peer would make the shared secret known
+	if _, err := NewE2ESession(alice, [E2EKeySize]byte{}); err == nil {
+		t.Error("a zero peer key was accepted")
+	}
+}
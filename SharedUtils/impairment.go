@@ -0,0 +1,260 @@
+package sharedutils
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// JitterDistribution selects how the delay of every packet varies around the base delay
+type JitterDistribution int
+
+const (
+	JitterUniform JitterDistribution = iota // JitterUniform - Uniform within the base delay plus or minus the jitter
+	JitterNormal                            // JitterNormal - Normal around the base delay, the jitter is the standard deviation
+	JitterPareto                            // JitterPareto - Pareto added to the base delay, the jitter is the mean: rare but long delays like Wi-Fi retries
+)
+
+const (
+	paretoShape              = 3                      // paretoShape - Finite mean and variance, still heavy tailed
+	StreamRetransmitPenalty  = 200 * time.Millisecond // StreamRetransmitPenalty - The stall of a lost segment on a stream, the minimum TCP retransmission timeout (RFC 6298)
+	DefaultImpairmentBacklog = 100 * time.Millisecond // DefaultImpairmentBacklog - The queue of a bandwidth capped link, packets beyond it are dropped
+)
+
+// ParseJitterDistribution parses the name of a jitter distribution as given on the command line
+func ParseJitterDistribution(name string) (JitterDistribution, error) {
+	switch name {
+	case "uniform":
+		return JitterUniform, nil
+	case "normal":
+		return JitterNormal, nil
+	case "pareto":
+		return JitterPareto, nil
+	}
+	return JitterUniform, fmt.Errorf("unknown jitter distribution %q (uniform, normal or pareto)", name)
+}
+
+func (distribution JitterDistribution) String() string {
+	switch distribution {
+	case JitterNormal:
+		return "normal"
+	case JitterPareto:
+		return "pareto"
+	}
+	return "uniform"
+}
+
+// GilbertElliott is the two state model of bursty loss: packets are lost with LossGood in the good state and
+// with LossBad in the bad state, the state turns bad with probability P and good again with probability R
+// after every packet. The mean burst lasts 1/R packets
+type GilbertElliott struct {
+	P, R              float64
+	LossGood, LossBad float64
+	bad               bool
+}
+
+// ParseGilbertElliott parses "p,r[,lossBad[,lossGood]]" in percent, losing every packet of the bad state by default
+func ParseGilbertElliott(spec string) (*GilbertElliott, error) {
+	values := []float64{0, 0, 100, 0}
+	var count int
+	for i, field := range strings.Split(spec, ",") {
+		if i >= len(values) {
+			return nil, fmt.Errorf("bad Gilbert-Elliott model %q (p,r[,lossBad[,lossGood]] in percent)", spec)
+		}
+		if _, err := fmt.Sscan(field, &values[i]); err != nil || values[i] < 0 || values[i] > 100 {
+			return nil, fmt.Errorf("bad Gilbert-Elliott model %q (p,r[,lossBad[,lossGood]] in percent)", spec)
+		}
+		count++
+	}
+	if count < 2 {
+		return nil, fmt.Errorf("bad Gilbert-Elliott model %q (p,r[,lossBad[,lossGood]] in percent)", spec)
+	}
+	return &GilbertElliott{P: values[0] / 100, R: values[1] / 100, LossBad: values[2] / 100, LossGood: values[3] / 100}, nil
+}
+
+// lost moves the model by one packet and reports whether the packet is lost
+func (model *GilbertElliott) lost(random *rand.Rand) bool {
+	if model.bad {
+		model.bad = random.Float64() >= model.R
+	} else {
+		model.bad = random.Float64() < model.P
+	}
+	if model.bad {
+		return random.Float64() < model.LossBad
+	}
+	return random.Float64() < model.LossGood
+}
+
+// Impairment describes the network conditions imposed on the packets going one way. Probabilities are in [0, 1]
+type Impairment struct {
+	Delay        time.Duration
+	Jitter       time.Duration
+	Distribution JitterDistribution
+	Loss         float64         // Random loss, independent for every packet
+	Bursts       *GilbertElliott // Bursty loss, on top of the random loss
+	Duplicate    float64         // Packets sent twice
+	Reorder      float64         // Packets held back by ReorderDelay so the next ones overtake them
+	ReorderDelay time.Duration
+	Bandwidth    int             // Bits per second, zero for no cap
+	Backlog      time.Duration   // The queue of the capped link, DefaultImpairmentBacklog when zero
+	Replay       []time.Duration // Recorded delays of the packets in order, replayed in a loop instead of Delay, Jitter and Loss. Negative for lost packets
+}
+
+func (impairment Impairment) String() string {
+	if len(impairment.Replay) > 0 {
+		return fmt.Sprintf("replay of %d recorded packets", len(impairment.Replay))
+	}
+	description := fmt.Sprintf("delay %v jitter %v (%v) loss %.2f%%", impairment.Delay, impairment.Jitter, impairment.Distribution, impairment.Loss*100)
+	if impairment.Bursts != nil {
+		description += fmt.Sprintf(" bursts p %.2f%% r %.2f%%", impairment.Bursts.P*100, impairment.Bursts.R*100)
+	}
+	description += fmt.Sprintf(" duplicate %.2f%% reorder %.2f%%", impairment.Duplicate*100, impairment.Reorder*100)
+	if impairment.Bandwidth > 0 {
+		description += fmt.Sprintf(" bandwidth %d kbit/s", impairment.Bandwidth/1000)
+	}
+	return description
+}
+
+// ImpairmentStats counts what an Impairer did to the packets
+type ImpairmentStats struct {
+	Packets    uint64
+	Lost       uint64 // Random and bursty loss
+	Dropped    uint64 // Beyond the backlog of the bandwidth cap
+	Duplicated uint64
+	Reordered  uint64
+	Stalled    uint64 // Stream segments delayed as if lost and retransmitted
+}
+
+func (stats ImpairmentStats) String() string {
+	return fmt.Sprintf("%d packets | lost %d | dropped by the bandwidth cap %d | duplicated %d | reordered %d | stalled %d",
+		stats.Packets, stats.Lost, stats.Dropped, stats.Duplicated, stats.Reordered, stats.Stalled)
+}
+
+// Impairer applies an Impairment to the packets going one way. It is not safe for concurrent use
+type Impairer struct {
+	impairment Impairment
+	random     *rand.Rand
+	linkFree   time.Time // When the capped link is done sending the packets queued so far
+	lastSend   time.Time // The latest delivery of a stream, it keeps the order of the bytes
+	replayed   int       // Packets that took their fate from the replay
+	stats      ImpairmentStats
+}
+
+// NewImpairer creates an impairer whose random choices are repeated for the same seed
+func NewImpairer(impairment Impairment, seed int64) *Impairer {
+	if impairment.Backlog == 0 {
+		impairment.Backlog = DefaultImpairmentBacklog
+	}
+	if impairment.Bursts != nil {
+		bursts := *impairment.Bursts // The state is per impairer
+		impairment.Bursts = &bursts
+	}
+	return &Impairer{impairment: impairment, random: rand.New(rand.NewSource(seed))}
+}
+
+// Stats returns the counts of the packets impaired so far
+func (impairer *Impairer) Stats() ImpairmentStats {
+	return impairer.stats
+}
+
+// Schedule returns when a datagram of size bytes received now is sent on: never when it is lost,
+// twice when it is duplicated. Datagrams may be sent in another order than they were received
+func (impairer *Impairer) Schedule(now time.Time, size int) []time.Time {
+	impairer.stats.Packets++
+	lost, delay := impairer.draw()
+	if lost {
+		impairer.stats.Lost++
+		return nil
+	}
+	departure, ok := impairer.queue(now, size, true)
+	if !ok {
+		impairer.stats.Dropped++
+		return nil
+	}
+	send := departure.Add(delay)
+	if impairer.impairment.Reorder > 0 && impairer.random.Float64() < impairer.impairment.Reorder {
+		impairer.stats.Reordered++
+		send = send.Add(impairer.impairment.ReorderDelay)
+	}
+	if impairer.impairment.Duplicate > 0 && impairer.random.Float64() < impairer.impairment.Duplicate {
+		impairer.stats.Duplicated++
+		return []time.Time{send, send}
+	}
+	return []time.Time{send}
+}
+
+// ScheduleStream returns when a segment of a stream of size bytes received now is sent on. A stream can not lose,
+// duplicate or reorder its bytes: a lost segment stalls the stream for StreamRetransmitPenalty instead, as TCP
+// would to retransmit it, and segments are never sent before the ones received earlier
+func (impairer *Impairer) ScheduleStream(now time.Time, size int) time.Time {
+	impairer.stats.Packets++
+	lost, delay := impairer.draw()
+	departure, _ := impairer.queue(now, size, false)
+	send := departure.Add(delay)
+	if lost {
+		impairer.stats.Stalled++
+		send = send.Add(StreamRetransmitPenalty)
+	}
+	if send.Before(impairer.lastSend) {
+		send = impairer.lastSend
+	}
+	impairer.lastSend = send
+	return send
+}
+
+// draw picks whether the next packet is lost and its one way delay, from the replay when there is one
+func (impairer *Impairer) draw() (bool, time.Duration) {
+	if replay := impairer.impairment.Replay; len(replay) > 0 {
+		recorded := replay[impairer.replayed%len(replay)]
+		impairer.replayed++
+		return recorded < 0, max(0, recorded)
+	}
+	return impairer.lost(), impairer.delay()
+}
+
+func (impairer *Impairer) lost() bool {
+	lost := impairer.impairment.Loss > 0 && impairer.random.Float64() < impairer.impairment.Loss
+	if impairer.impairment.Bursts != nil && impairer.impairment.Bursts.lost(impairer.random) {
+		lost = true
+	}
+	return lost
+}
+
+// queue returns when the capped link finishes sending a packet, false when it is dropped because the backlog is full.
+// Streams are never dropped, a sender backs off instead
+func (impairer *Impairer) queue(now time.Time, size int, drop bool) (time.Time, bool) {
+	if impairer.impairment.Bandwidth <= 0 {
+		return now, true
+	}
+	start := now
+	if impairer.linkFree.After(now) {
+		start = impairer.linkFree
+	}
+	if drop && start.Sub(now) > impairer.impairment.Backlog {
+		return start, false
+	}
+	transmission := time.Duration(float64(size*8) / float64(impairer.impairment.Bandwidth) * float64(time.Second))
+	impairer.linkFree = start.Add(transmission)
+	return impairer.linkFree, true
+}
+
+// delay draws the one way delay of a packet, never negative
+func (impairer *Impairer) delay() time.Duration {
+	base, jitter := float64(impairer.impairment.Delay), float64(impairer.impairment.Jitter)
+	if jitter == 0 {
+		return impairer.impairment.Delay
+	}
+	var delay float64
+	switch impairer.impairment.Distribution {
+	case JitterNormal:
+		delay = base + impairer.random.NormFloat64()*jitter
+	case JitterPareto:
+		scale := jitter * (paretoShape - 1) / paretoShape // The mean of the Pareto distribution is the jitter
+		delay = base + scale/math.Pow(1-impairer.random.Float64(), 1.0/paretoShape)
+	default:
+		delay = base + (2*impairer.random.Float64()-1)*jitter
+	}
+	return time.Duration(max(0, delay))
+}
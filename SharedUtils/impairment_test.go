@@ -0,0 +1,188 @@
+package sharedutils
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseGilbertElliott(t *testing.T) {
+	tests := []struct {
+		spec string
+		want *GilbertElliott
+	}{
+		{"5,50", &GilbertElliott{P: 0.05, R: 0.5, LossBad: 1}},
+		{"5,50,80", &GilbertElliott{P: 0.05, R: 0.5, LossBad: 0.8}},
+		{"5,50,80,1", &GilbertElliott{P: 0.05, R: 0.5, LossBad: 0.8, LossGood: 0.01}},
+		{"5", nil},
+		{"5,50,80,1,1", nil},
+		{"five,50", nil},
+		{"101,50", nil},
+		{"5,-1", nil},
+	}
+	for _, test := range tests {
+		model, err := ParseGilbertElliott(test.spec)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%q: got %+v, want an error", test.spec, model)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(model, test.want) {
+			t.Errorf("%q: got %+v (%v), want %+v", test.spec, model, err, test.want)
+		}
+	}
+}
+
+func TestGilbertElliottBursts(t *testing.T) {
+	// The bad state lasts 1/R packets on average and holds P/(P+R) of them
+	const packets = 100000
+	model := &GilbertElliott{P: 0.1, R: 0.5, LossBad: 1}
+	random := rand.New(rand.NewSource(1))
+	lost, bursts, inBurst := 0, 0, false
+	for i := 0; i < packets; i++ {
+		isLost := model.lost(random)
+		if isLost {
+			lost++
+			if !inBurst {
+				bursts++
+			}
+		}
+		inBurst = isLost
+	}
+	if rate, want := float64(lost)/packets, model.P/(model.P+model.R); math.Abs(rate-want) > 0.01 {
+		t.Errorf("lost %.3f of the packets, want %.3f", rate, want)
+	}
+	if length, want := float64(lost)/float64(bursts), 1/model.R; math.Abs(length-want) > 0.1 {
+		t.Errorf("bursts of %.2f packets, want %.2f", length, want)
+	}
+
+	// With no chance to leave the bad state, every packet after the first turn is lost
+	stuck := &GilbertElliott{P: 1, R: 0, LossBad: 1}
+	for i := 0; i < 100; i++ {
+		if !stuck.lost(random) {
+			t.Fatalf("packet %d not lost in the bad state", i)
+		}
+	}
+}
+
+// impairedDelays returns the delays an impairer of the impairment gives count packets
+func impairedDelays(impairment Impairment, seed int64, count int) ([]time.Duration, *Impairer) {
+	impairer := NewImpairer(impairment, seed)
+	now := time.Unix(1718000000, 0)
+	var delays []time.Duration
+	for i := 0; i < count; i++ {
+		for _, send := range impairer.Schedule(now, 100) {
+			delays = append(delays, send.Sub(now))
+		}
+	}
+	return delays, impairer
+}
+
+func TestImpairerJitterDistributions(t *testing.T) {
+	const (
+		delay   = 20 * time.Millisecond
+		jitter  = 5 * time.Millisecond
+		packets = 20000
+	)
+	tests := []struct {
+		distribution JitterDistribution
+		min, max     time.Duration
+		mean, stddev time.Duration // Zero stddev is not checked
+	}{
+		{JitterUniform, delay - jitter, delay + jitter, delay, 0},
+		{JitterNormal, 0, time.Hour, delay, jitter},
+		// The Pareto delay starts at its scale, jitter*(shape-1)/shape, and has the jitter as its mean
+		{JitterPareto, delay + jitter*(paretoShape-1)/paretoShape, time.Hour, delay + jitter, 0},
+	}
+	for _, test := range tests {
+		impairment := Impairment{Delay: delay, Jitter: jitter, Distribution: test.distribution}
+		delays, _ := impairedDelays(impairment, 1, packets)
+		if again, _ := impairedDelays(impairment, 1, packets); !reflect.DeepEqual(delays, again) {
+			t.Errorf("%v: the same seed gave other delays", test.distribution)
+		}
+		var sum, squares float64
+		for _, d := range delays {
+			if d < test.min || d > test.max {
+				t.Fatalf("%v: delay %v out of [%v, %v]", test.distribution, d, test.min, test.max)
+			}
+			sum += float64(d)
+		}
+		mean := sum / packets
+		for _, d := range delays {
+			squares += (float64(d) - mean) * (float64(d) - mean)
+		}
+		if math.Abs(mean-float64(test.mean)) > float64(200*time.Microsecond) {
+			t.Errorf("%v: mean delay %v, want %v", test.distribution, time.Duration(mean), test.mean)
+		}
+		if stddev := math.Sqrt(squares / packets); test.stddev != 0 && math.Abs(stddev-float64(test.stddev)) > float64(200*time.Microsecond) {
+			t.Errorf("%v: standard deviation %v, want %v", test.distribution, time.Duration(stddev), test.stddev)
+		}
+	}
+}
+
+func TestImpairerReorderDuplicate(t *testing.T) {
+	const packets = 10000
+	delays, impairer := impairedDelays(Impairment{Delay: 10 * time.Millisecond, Reorder: 0.25, ReorderDelay: 5 * time.Millisecond}, 1, packets)
+	held := 0
+	for _, d := range delays {
+		switch d {
+		case 15 * time.Millisecond:
+			held++
+		case 10 * time.Millisecond:
+		default:
+			t.Fatalf("got delay %v, want 10ms or 15ms", d)
+		}
+	}
+	if stats := impairer.Stats(); stats.Reordered != uint64(held) || math.Abs(float64(held)/packets-0.25) > 0.02 {
+		t.Errorf("held back %d of %d packets, counted %d, want a quarter", held, packets, stats.Reordered)
+	}
+
+	delays, impairer = impairedDelays(Impairment{Delay: 10 * time.Millisecond, Duplicate: 0.1}, 1, packets)
+	if stats := impairer.Stats(); len(delays) != packets+int(stats.Duplicated) || math.Abs(float64(stats.Duplicated)/packets-0.1) > 0.02 {
+		t.Errorf("sent %d datagrams of %d packets with %d duplicated, want a tenth duplicated", len(delays), packets, stats.Duplicated)
+	}
+}
+
+func TestImpairerBandwidthCap(t *testing.T) {
+	// 100 byte packets take 10 ms at 80 kbit/s, the backlog of 100 ms holds 10 of them behind the one being sent
+	impairment := Impairment{Bandwidth: 80000}
+	delays, impairer := impairedDelays(impairment, 1, 20)
+	if len(delays) != 11 {
+		t.Fatalf("sent %d packets, want 11", len(delays))
+	}
+	for i, d := range delays {
+		if want := time.Duration(i+1) * 10 * time.Millisecond; d != want {
+			t.Errorf("packet %d sent after %v, want %v", i, d, want)
+		}
+	}
+	if stats := impairer.Stats(); stats.Dropped != 9 || stats.Lost != 0 {
+		t.Errorf("got %d dropped and %d lost, want 9 dropped", stats.Dropped, stats.Lost)
+	}
+
+	// A stream is never dropped, nor sent out of order, a lost segment stalls it
+	impairer = NewImpairer(Impairment{Bandwidth: 80000, Loss: 0.1, Jitter: 5 * time.Millisecond}, 1)
+	now := time.Unix(1718000000, 0)
+	last := now
+	for i := 0; i < 1000; i++ {
+		send := impairer.ScheduleStream(now, 100)
+		if send.Before(last) {
+			t.Fatalf("segment %d sent at %v, before the one before it at %v", i, send.Sub(now), last.Sub(now))
+		}
+		last = send
+	}
+	if stats := impairer.Stats(); stats.Dropped != 0 || stats.Stalled == 0 || last.Sub(now) < 1000*10*time.Millisecond {
+		t.Errorf("got %+v, done after %v, want stalls and no drops", stats, last.Sub(now))
+	}
+}
+
+func TestImpairerReplay(t *testing.T) {
+	replay := []time.Duration{5 * time.Millisecond, -1, 7 * time.Millisecond}
+	delays, impairer := impairedDelays(Impairment{Replay: replay}, 1, 6)
+	want := []time.Duration{5 * time.Millisecond, 7 * time.Millisecond, 5 * time.Millisecond, 7 * time.Millisecond}
+	if !reflect.DeepEqual(delays, want) || impairer.Stats().Lost != 2 {
+		t.Errorf("got delays %v and %d lost, want %v and 2 lost", delays, impairer.Stats().Lost, want)
+	}
+}
@@ -0,0 +1,82 @@
+package sharedutils
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HeartbeatInterval  = time.Second      // HeartbeatInterval - The longest a link with keepalive stays silent before it sends a heartbeat
+	DefaultIdleTimeout = 10 * time.Second // DefaultIdleTimeout - How long the peer may stay silent before the session is torn down
+)
+
+// ErrIdleTimeout is returned by Link.Receive when the peer sent nothing, not even a heartbeat, for the idle timeout
+var ErrIdleTimeout = errors.New("sharedutils: the peer went silent for the idle timeout")
+
+// Heartbeat creates a PacketHeartbeat, its serial only tells the heartbeats apart
+func Heartbeat(serialNumber int) *Packet {
+	return InitPacket(PacketHeartbeat, serialNumber, time.Now().UnixMicro(), 0, 0)
+}
+
+// keepalive is the state of a link that sends heartbeats and watches the silence of its peer
+type keepalive struct {
+	idleTimeout time.Duration
+	lastSend    atomic.Int64 // Unix nanoseconds of the last packet sent
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+// EnableKeepalive makes the link send a heartbeat whenever it sent nothing for HeartbeatInterval, or a quarter of
+// the idle timeout when that is shorter, and Receive fail with ErrIdleTimeout when the peer stays silent for the
+// idle timeout. A zero timeout leaves keepalive off. Enable it once the handshake is done, before the link is
+// shared between goroutines, and Close the link to stop the heartbeats
+func (link *Link) EnableKeepalive(idleTimeout time.Duration) {
+	if idleTimeout <= 0 {
+		return
+	}
+	keepalive := &keepalive{idleTimeout: idleTimeout, stop: make(chan struct{})}
+	keepalive.lastSend.Store(time.Now().UnixNano())
+	link.keepalive = keepalive
+	go link.heartbeatRoutine(keepalive, min(HeartbeatInterval, idleTimeout/4))
+}
+
+// DisableKeepalive stops the heartbeats and the idle timeout, for a connection the link hands over to other use.
+// Call it from the goroutine that receives
+func (link *Link) DisableKeepalive() {
+	if link.keepalive == nil {
+		return
+	}
+	link.keepalive.stopOnce.Do(func() { close(link.keepalive.stop) })
+}
+
+// active reports whether the keepalive was not disabled
+func (keepalive *keepalive) active() bool {
+	select {
+	case <-keepalive.stop:
+		return false
+	default:
+		return true
+	}
+}
+
+// heartbeatRoutine sends the heartbeats until the link is closed or can not send anymore
+func (link *Link) heartbeatRoutine(keepalive *keepalive, interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for heartbeats := 0; ; {
+		select {
+		case <-keepalive.stop:
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, keepalive.lastSend.Load())) < interval {
+				continue
+			}
+			if err := link.Send(Heartbeat(heartbeats)); err != nil {
+				return
+			}
+			heartbeats++
+		}
+	}
+}
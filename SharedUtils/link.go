@@ -0,0 +1,389 @@
+package sharedutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WireFormat selects how audio packets are encoded on the wire
+type WireFormat int
+
+const (
+	WireNative WireFormat = iota // WireNative - Every packet in the native format of Packet
+	WireRTP                      // WireRTP - PacketRecord packets as RTP with an Opus payload, the rest in the native format
+)
+
+// ParseWireFormat parses the name of a wire format as given on the command line
+func ParseWireFormat(name string) (WireFormat, error) {
+	switch name {
+	case "native":
+		return WireNative, nil
+	case "rtp":
+		return WireRTP, nil
+	}
+	return WireNative, fmt.Errorf("unknown wire format %q (native or rtp)", name)
+}
+
+func (format WireFormat) String() string {
+	if format == WireRTP {
+		return "rtp"
+	}
+	return "native"
+}
+
+// WireCodec encodes packets in a wire format and decodes packets in any wire format.
+// It keeps the state of the RTP stream in each direction, and of the encryption once the session has keys
+type WireCodec struct {
+	Format       WireFormat
+	packetizer   *RTPPacketizer            // The stream of the sender itself
+	forwarded    map[uint32]*RTPPacketizer // The streams of the others of a room by StreamID, each under an SSRC of its own
+	depacketizer RTPDepacketizer
+	cipher       *SessionCipher
+}
+
+// NewWireCodec creates a codec that encodes packets in the given format
+func NewWireCodec(format WireFormat) *WireCodec {
+	return &WireCodec{
+		Format:     format,
+		packetizer: NewRTPPacketizer(),
+		forwarded:  make(map[uint32]*RTPPacketizer),
+	}
+}
+
+// SSRC is the RTP source of the stream the codec sends
+func (codec *WireCodec) SSRC() uint32 {
+	return codec.packetizer.SSRC
+}
+
+// packetizerOf returns the packetizer of the stream of the packet
+func (codec *WireCodec) packetizerOf(packet *Packet) *RTPPacketizer {
+	if packet.StreamID == 0 {
+		return codec.packetizer
+	}
+	packetizer, ok := codec.forwarded[packet.StreamID]
+	if !ok {
+		packetizer = NewRTPPacketizer()
+		codec.forwarded[packet.StreamID] = packetizer
+	}
+	return packetizer
+}
+
+// SetCipher makes the codec seal the packets it encodes and accept only sealed packets, but for the handshake
+func (codec *WireCodec) SetCipher(cipher *SessionCipher) {
+	codec.cipher = cipher
+}
+
+// MaxDataSize is the largest data of a packet the codec can encode
+func (codec *WireCodec) MaxDataSize() int {
+	if codec.cipher != nil {
+		return DataFrameSize - SealOverhead
+	}
+	return DataFrameSize
+}
+
+// AppendPacket appends the packet encoded as a single datagram to dst and returns the extended buffer.
+// In the RTP format PacketRTCP packets are sent as bare RTCP, multiplexed with the RTP stream (RFC 5761),
+// unless the session is encrypted: they are sealed in the native format then
+func (codec *WireCodec) AppendPacket(dst []byte, packet *Packet) ([]byte, error) {
+	if codec.cipher != nil && isSealed(packet.PacketType) {
+		return codec.appendSealed(dst, packet)
+	}
+	if codec.isRTPMedia(packet) {
+		return codec.packetizerOf(packet).AppendPacket(dst, packet)
+	}
+	if codec.Format == WireRTP && packet.PacketType == PacketRTCP {
+		if err := packet.checkFields(); err != nil {
+			return dst, err
+		}
+		return append(dst, packet.Data[:packet.DataSize]...), nil
+	}
+	return packet.AppendDatagram(dst)
+}
+
+// isRTPMedia reports whether the packet is sent as RTP
+func (codec *WireCodec) isRTPMedia(packet *Packet) bool {
+	return codec.Format == WireRTP && (packet.PacketType == PacketRecord || packet.PacketType == PacketRedundant)
+}
+
+// appendSealed appends the packet with its data sealed. RTP packets authenticate their header and extension,
+// native packets their header up to the checksum, which is computed over the sealed data
+func (codec *WireCodec) appendSealed(dst []byte, packet *Packet) ([]byte, error) {
+	if int(packet.DataSize) > codec.MaxDataSize() {
+		return dst, ErrBadLength
+	}
+	start := len(dst)
+	if codec.isRTPMedia(packet) {
+		dst, err := codec.packetizerOf(packet).AppendPacket(dst, packet)
+		if err != nil {
+			return dst, err
+		}
+		return codec.cipher.seal(dst, start, int(packet.DataSize), len(dst)-start-int(packet.DataSize)), nil
+	}
+
+	dst, err := packet.AppendDatagram(dst)
+	if err != nil {
+		return dst, err
+	}
+	binary.LittleEndian.PutUint16(dst[start+4:], uint16(int(packet.DataSize)+SealOverhead))
+	dst = codec.cipher.seal(dst, start, int(packet.DataSize), checksumOffset)
+	binary.LittleEndian.PutUint32(dst[start+checksumOffset:], checksum(dst[start:]))
+	return dst, nil
+}
+
+// DecodePacket decodes a single datagram, RTP, RTCP or native, into the packet and copies its data.
+// Bare RTCP is decoded as a PacketRTCP packet. Malformed packets are counted (see PacketsRejected),
+// as are the packets of an encrypted session that fail authentication or are replayed
+func (codec *WireCodec) DecodePacket(buf []byte, packet *Packet) error {
+	var err error
+	if isRTP(buf) && isRTCP(buf) {
+		err = decodeRTCP(buf, packet)
+		if err == nil && codec.cipher != nil {
+			err = ErrBadSeal
+		}
+	} else if isRTP(buf) {
+		err = codec.depacketizer.Depacketize(buf, packet)
+		if err == nil && codec.cipher != nil {
+			err = codec.cipher.open(packet, packet.Data[:packet.DataSize], buf[:len(buf)-int(packet.DataSize)])
+		}
+	} else if codec.cipher != nil {
+		err = codec.decodeSealed(buf, packet)
+	} else {
+		err = packet.decodeCopy(buf)
+	}
+	if errors.Is(err, ErrBadHeader) {
+		rejectPacket(err)
+	}
+	return err
+}
+
+// decodeSealed decodes a native packet of an encrypted session, opening its data unless it is part of the handshake
+func (codec *WireCodec) decodeSealed(buf []byte, packet *Packet) error {
+	if err := packet.decodeHeader(buf); err != nil {
+		return err
+	}
+	if !isSealed(packet.PacketType) {
+		packet.Data = append(packet.Data[:0], buf[MetadataSize:]...)
+		return nil
+	}
+	return codec.cipher.open(packet, buf[MetadataSize:], buf[:checksumOffset])
+}
+
+// decodeRTCP wraps a bare RTCP packet into a PacketRTCP packet, copying it
+func decodeRTCP(buf []byte, packet *Packet) error {
+	if len(buf) > DataFrameSize {
+		return ErrBadLength
+	}
+	*packet = Packet{
+		PacketType: PacketRTCP,
+		InitTime:   uint64(time.Now().UnixMicro()),
+		DataSize:   uint32(len(buf)),
+		Data:       append(packet.Data[:0], buf...),
+	}
+	return nil
+}
+
+// SendTo encodes the packet as a single datagram and writes it to address through a listening socket
+func (codec *WireCodec) SendTo(conn net.PacketConn, address net.Addr, packet *Packet) error {
+	pooled := bufferPool.Get().(*[LengthPrefix + BufferSize]byte)
+	defer bufferPool.Put(pooled)
+
+	buf, err := codec.AppendPacket(pooled[:0], packet)
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(buf, address)
+	return err
+}
+
+// Link sends and receives packets over a connection in a wire format.
+// On stream connections every packet is preceded by its length (RFC 4571 framing, for RTP as well)
+type Link struct {
+	conn        net.Conn
+	codec       *WireCodec
+	datagram    bool
+	writeLock   sync.Mutex
+	rtcp        *RTCPSession
+	keepalive   *keepalive
+	mtu         int // Zero when no MTU was set
+	maxDatagram int // The largest datagram the MTU carries unfragmented, zero for no limit
+	serials     atomic.Uint32
+}
+
+// NewLink creates a link over an established connection
+func NewLink(conn net.Conn, format WireFormat) *Link {
+	return &Link{
+		conn:     conn,
+		codec:    NewWireCodec(format),
+		datagram: isDatagram(conn),
+	}
+}
+
+// NextSerial returns the serial of the next control packet the link sends that has no counter of its own, such as
+// the Join and Leave packets. The serials increase, so an encrypted peer does not take them for replays
+func (link *Link) NextSerial() int {
+	return int(link.serials.Add(1))
+}
+
+// Conn returns the underlying connection
+func (link *Link) Conn() net.Conn {
+	return link.conn
+}
+
+// EnableRTCP makes the link keep RTCP statistics of the packets it sends and receives.
+// A report is sent along with the media every RTCPInterval, and the reports of the peer update the feedback
+func (link *Link) EnableRTCP() *RTCPSession {
+	hostname, _ := os.Hostname()
+	link.rtcp = NewRTCPSession(link.codec.SSRC(), "remotestudiolive@"+hostname)
+	return link.rtcp
+}
+
+// SetCipher encrypts the link once the handshake is done, see WireCodec.SetCipher. Packets being sent meanwhile
+// are sealed with the old cipher or the new one, never half of each
+func (link *Link) SetCipher(cipher *SessionCipher) {
+	link.writeLock.Lock()
+	defer link.writeLock.Unlock()
+	link.codec.SetCipher(cipher)
+}
+
+// MaxDataSize is the largest data of a packet the link can send, within the MTU when one is set.
+// An MTU whose datagrams carry BufferSize bytes or more does not change it
+func (link *Link) MaxDataSize() int {
+	if link.maxDatagram > 0 && link.maxDatagram < BufferSize {
+		return link.codec.MaxDataSize() - (BufferSize - link.maxDatagram)
+	}
+	return link.codec.MaxDataSize()
+}
+
+// RTCP returns the RTCP statistics of the link, nil unless EnableRTCP was called
+func (link *Link) RTCP() *RTCPSession {
+	return link.rtcp
+}
+
+// Close stops the heartbeats of the link and closes the connection
+func (link *Link) Close() error {
+	link.DisableKeepalive()
+	return link.conn.Close()
+}
+
+// Send encodes the packet in the wire format of the link and writes it. It is safe for concurrent use
+func (link *Link) Send(packet *Packet) error {
+	link.writeLock.Lock()
+	defer link.writeLock.Unlock()
+
+	err := link.write(packet)
+	if err == nil && link.keepalive != nil {
+		link.keepalive.lastSend.Store(time.Now().UnixNano())
+	}
+	if err != nil || link.rtcp == nil || !packet.IsMedia() || packet.StreamID != 0 {
+		return err // RTCP reports on the stream of the link itself, not on the streams of a room it forwards
+	}
+	link.rtcp.OnSend(packet)
+	if now := time.Now(); link.rtcp.ReportDue(now) {
+		return link.write(link.rtcp.BuildReport(now))
+	}
+	return nil
+}
+
+// IsMedia reports whether the packet is part of the audio stream counted by RTCP
+func (packet *Packet) IsMedia() bool {
+	return packet.PacketType == PacketRecord || packet.PacketType == PacketRedundant || packet.PacketType == PacketRequestSong
+}
+
+func (link *Link) write(packet *Packet) error {
+	pooled := bufferPool.Get().(*[LengthPrefix + BufferSize]byte)
+	defer bufferPool.Put(pooled)
+
+	if link.datagram {
+		buf, err := link.codec.AppendPacket(pooled[:0], packet)
+		if err == nil {
+			err = link.checkMTU(buf)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = link.conn.Write(buf)
+		return err
+	}
+
+	buf, err := link.codec.AppendPacket(pooled[:LengthPrefix], packet)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(buf[0:], uint16(len(buf)-LengthPrefix))
+	_, err = link.conn.Write(buf)
+	return err
+}
+
+// Receive reads one packet from the link. It returns the same errors as Packet.Receive,
+// malformed packets are counted (see PacketsRejected). With RTCP enabled, PacketRTCP packets
+// are processed before they are returned and media packets update the reception statistics.
+// PacketHeartbeat packets are never returned, with keepalive enabled the peer staying silent
+// for the idle timeout returns ErrIdleTimeout
+func (link *Link) Receive(packet *Packet) error {
+	for {
+		if err := link.receive(packet); err != nil || packet.PacketType != PacketHeartbeat {
+			return err
+		}
+	}
+}
+
+func (link *Link) receive(packet *Packet) error {
+	pooled := bufferPool.Get().(*[LengthPrefix + BufferSize]byte)
+	defer bufferPool.Put(pooled)
+
+	keepalive := link.keepalive != nil && link.keepalive.active()
+	if keepalive {
+		if err := link.conn.SetReadDeadline(time.Now().Add(link.keepalive.idleTimeout)); err != nil {
+			return err
+		}
+	}
+	buf, err := link.readFrame(pooled[:BufferSize])
+	if keepalive && errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w of %v", ErrIdleTimeout, link.keepalive.idleTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	if err = link.codec.DecodePacket(buf, packet); err != nil || link.rtcp == nil {
+		return err
+	}
+	if packet.PacketType == PacketRTCP {
+		if _, err = link.rtcp.HandleRTCP(packet.Data[:packet.DataSize], time.Now()); err != nil {
+			rejectPacket(err)
+		}
+		return err
+	} else if packet.IsMedia() && packet.StreamID == 0 {
+		link.rtcp.OnReceive(packet, time.Now())
+	}
+	return nil
+}
+
+// readFrame reads one datagram, or one length prefixed frame from a stream, into buf
+func (link *Link) readFrame(buf []byte) ([]byte, error) {
+	if link.datagram {
+		packetLen, err := link.conn.Read(buf)
+		return buf[:packetLen], err
+	}
+
+	if err := readFull(link.conn, buf[:LengthPrefix]); err != nil {
+		return nil, err
+	}
+	packetLen := int(binary.BigEndian.Uint16(buf[:LengthPrefix]))
+	if packetLen == 0 || packetLen > len(buf) {
+		return nil, ErrBadFrameLength
+	}
+	if err := readFull(link.conn, buf[:packetLen]); err != nil {
+		if err == io.EOF {
+			return nil, ErrShortRead
+		}
+		return nil, err
+	}
+	return buf[:packetLen], nil
+}
@@ -0,0 +1,299 @@
+package sharedutils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	memoryQueue = 1024 // memoryQueue - Packets in flight in each direction of an in-memory connection before writes block
+)
+
+// ErrNoListener is returned when an in-memory connection is dialed to an address nobody listens on
+var ErrNoListener = errors.New("sharedutils: no in-memory listener at the address")
+
+// queuedMessage is a packet waiting in a messageQueue
+type queuedMessage struct {
+	data      []byte
+	from      net.Addr
+	deliverAt time.Time
+}
+
+// messageQueue is the receiving end of the datagram connections the transports emulate. Messages are read in order,
+// none before its delivery time. A single goroutine reads it, like a socket
+type messageQueue struct {
+	messages  chan queuedMessage
+	pending   *queuedMessage // Taken from messages but not delivered yet when a read timed out
+	closed    chan struct{}  // The reading end was closed
+	finished  chan struct{}  // The writing end was closed, reads return io.EOF once the messages are read
+	closeOnce sync.Once
+	endOnce   sync.Once
+
+	mutex           sync.Mutex
+	deadline        time.Time
+	deadlineChanged chan struct{} // Closed when the deadline is changed, so a blocked read picks it up
+}
+
+func newMessageQueue(size int) *messageQueue {
+	return &messageQueue{
+		messages:        make(chan queuedMessage, size),
+		closed:          make(chan struct{}),
+		finished:        make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+// push queues a message sent from an address, waiting for room when block is set and dropping it otherwise.
+// It returns io.ErrClosedPipe when the reading end is closed
+func (queue *messageQueue) push(data []byte, from net.Addr, deliverAt time.Time, block bool) error {
+	message := queuedMessage{data: data, from: from, deliverAt: deliverAt}
+	if !block {
+		select {
+		case <-queue.closed:
+			return io.ErrClosedPipe
+		case queue.messages <- message:
+		default:
+		}
+		return nil
+	}
+	select {
+	case <-queue.closed:
+		return io.ErrClosedPipe
+	case queue.messages <- message:
+		return nil
+	}
+}
+
+// read copies the next message into b, truncating it when b is too short like a datagram socket
+func (queue *messageQueue) read(b []byte) (int, error) {
+	n, _, err := queue.readFrom(b)
+	return n, err
+}
+
+// readFrom is read returning the address the message was sent from as well
+func (queue *messageQueue) readFrom(b []byte) (int, net.Addr, error) {
+	for {
+		queue.mutex.Lock()
+		deadline, changed := queue.deadline, queue.deadlineChanged
+		queue.mutex.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		n, from, retry, err := queue.receive(b, changed, timeout)
+		if timer != nil {
+			timer.Stop()
+		}
+		if !retry {
+			return n, from, err
+		}
+	}
+}
+
+// receive waits for the next message and its delivery time, it retries when the deadline changed
+func (queue *messageQueue) receive(b []byte, changed <-chan struct{}, timeout <-chan time.Time) (n int, from net.Addr, retry bool, err error) {
+	if queue.pending == nil {
+		select {
+		case message := <-queue.messages:
+			queue.pending = &message
+		case <-queue.finished:
+			select {
+			case message := <-queue.messages:
+				queue.pending = &message
+			default:
+				return 0, nil, false, io.EOF
+			}
+		case <-queue.closed:
+			return 0, nil, false, net.ErrClosed
+		case <-changed:
+			return 0, nil, true, nil
+		case <-timeout:
+			return 0, nil, false, os.ErrDeadlineExceeded
+		}
+	}
+
+	if wait := time.Until(queue.pending.deliverAt); wait > 0 {
+		delivery := time.NewTimer(wait)
+		select {
+		case <-delivery.C:
+		case <-queue.closed:
+			err = net.ErrClosed
+		case <-changed:
+			retry = true
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		}
+		delivery.Stop()
+		if err != nil || retry {
+			return 0, nil, retry, err
+		}
+	}
+	n, from = copy(b, queue.pending.data), queue.pending.from
+	queue.pending = nil
+	return n, from, false, nil
+}
+
+func (queue *messageQueue) setDeadline(deadline time.Time) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.deadline = deadline
+	close(queue.deadlineChanged)
+	queue.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// close closes the reading end, the messages left are dropped
+func (queue *messageQueue) close() {
+	queue.closeOnce.Do(func() { close(queue.closed) })
+}
+
+// finish closes the writing end
+func (queue *messageQueue) finish() {
+	queue.endOnce.Do(func() { close(queue.finished) })
+}
+
+// memoryAddr is the address of an in-memory connection
+type memoryAddr string
+
+func (addr memoryAddr) Network() string { return "memory" }
+func (addr memoryAddr) String() string  { return string(addr) }
+
+// MemoryTransport connects a client and a server in the same process without sockets, every packet arriving
+// after the delay. Its connections keep the boundaries of the packets and never lose or reorder them
+type MemoryTransport struct {
+	Delay     time.Duration
+	mutex     sync.Mutex
+	listeners map[string]*memoryListener
+	dialed    int // Connections made, to name their client ends
+}
+
+// NewMemoryTransport creates an in-memory transport whose packets take the delay to arrive.
+// Tests run the client and the server over it, sharing the one transport
+func NewMemoryTransport(delay time.Duration) *MemoryTransport {
+	return &MemoryTransport{Delay: delay, listeners: make(map[string]*memoryListener)}
+}
+
+func (transport *MemoryTransport) Name() string {
+	return "memory"
+}
+
+func (transport *MemoryTransport) Address(host, port string) string {
+	return net.JoinHostPort(host, port)
+}
+
+func (transport *MemoryTransport) Dial(address string) (Conn, error) {
+	transport.mutex.Lock()
+	ln, ok := transport.listeners[address]
+	transport.dialed++
+	local := memoryAddr(fmt.Sprintf("client-%d", transport.dialed))
+	transport.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoListener, address)
+	}
+
+	toServer, toClient := newMessageQueue(memoryQueue), newMessageQueue(memoryQueue)
+	client := &memoryConn{receive: toClient, send: toServer, delay: transport.Delay, local: local, remote: memoryAddr(address)}
+	server := &memoryConn{receive: toServer, send: toClient, delay: transport.Delay, local: memoryAddr(address), remote: local}
+	select {
+	case ln.accepts <- server:
+		return client, nil
+	case <-ln.closed:
+		return nil, fmt.Errorf("%w: %s", ErrNoListener, address)
+	}
+}
+
+func (transport *MemoryTransport) Listen(address string) (Listener, error) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if _, ok := transport.listeners[address]; ok {
+		return nil, fmt.Errorf("sharedutils: in-memory address %s already in use", address)
+	}
+	ln := &memoryListener{transport: transport, address: address, accepts: make(chan *memoryConn), closed: make(chan struct{})}
+	transport.listeners[address] = ln
+	return ln, nil
+}
+
+// memoryListener accepts the in-memory connections dialed to its address
+type memoryListener struct {
+	transport *MemoryTransport
+	address   string
+	accepts   chan *memoryConn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (ln *memoryListener) Accept() (Conn, error) {
+	select {
+	case conn := <-ln.accepts:
+		return conn, nil
+	case <-ln.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *memoryListener) Close() error {
+	ln.closeOnce.Do(func() {
+		close(ln.closed)
+		ln.transport.mutex.Lock()
+		delete(ln.transport.listeners, ln.address)
+		ln.transport.mutex.Unlock()
+	})
+	return nil
+}
+
+func (ln *memoryListener) Addr() net.Addr {
+	return memoryAddr(ln.address)
+}
+
+// memoryConn is one end of an in-memory connection
+type memoryConn struct {
+	receive, send *messageQueue
+	delay         time.Duration
+	local, remote memoryAddr
+}
+
+func (conn *memoryConn) Read(b []byte) (int, error) {
+	return conn.receive.read(b)
+}
+
+// Write queues a copy of the packet for the other end, it waits while too many packets are in flight
+func (conn *memoryConn) Write(b []byte) (int, error) {
+	select {
+	case <-conn.receive.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	if err := conn.send.push(append([]byte(nil), b...), conn.local, time.Now().Add(conn.delay), true); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes this end, the other end reads io.EOF once it has read the packets in flight
+func (conn *memoryConn) Close() error {
+	conn.receive.close()
+	conn.send.finish()
+	return nil
+}
+
+func (conn *memoryConn) Datagram() bool                    { return true }
+func (conn *memoryConn) LocalAddr() net.Addr               { return conn.local }
+func (conn *memoryConn) RemoteAddr() net.Addr              { return conn.remote }
+func (conn *memoryConn) SetDeadline(t time.Time) error     { return conn.SetReadDeadline(t) }
+func (conn *memoryConn) SetReadDeadline(t time.Time) error { return conn.receive.setDeadline(t) }
+
+// SetWriteDeadline is not supported, writes only wait when the other end stopped reading
+func (conn *memoryConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,206 @@
+package sharedutils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+const memoryTestDelay = 5 * time.Millisecond
+
+// echoServer accepts one client of the listener, opens its session and echoes its packets until it closes the session
+func echoServer(t *testing.T, ln Listener, format WireFormat, passphraseKey []byte) {
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	link := NewLink(conn, format)
+	defer link.Close()
+	for {
+		var packet Packet
+		if err := link.Receive(&packet); err != nil {
+			t.Error("server:", err)
+			return
+		}
+		switch packet.PacketType {
+		case PacketHello:
+			requested, err := packet.SessionParams()
+			if err != nil {
+				t.Error("server:", err)
+				return
+			}
+			params, err := NegotiateSession(requested)
+			if err != nil {
+				t.Error("server:", err)
+				return
+			}
+			if err := link.Send(AcceptPacket(params)); err != nil {
+				t.Error("server:", err)
+				return
+			}
+			if params.Cipher != CipherNone {
+				cipher, err := NewSessionCipher(params.Cipher, passphraseKey, params.Salt, true)
+				if err != nil {
+					t.Error("server:", err)
+					return
+				}
+				link.SetCipher(cipher)
+			}
+		case PacketCloseChannel:
+			link.Send(&packet)
+			return
+		default:
+			packet.ServerReceive, packet.ServerTransmit = uint64(time.Now().UnixMicro()), uint64(time.Now().UnixMicro())
+			if err := link.Send(&packet); err != nil {
+				t.Error("server:", err)
+				return
+			}
+		}
+	}
+}
+
+func TestMemoryTransportSession(t *testing.T) {
+	passphraseKey := PassphraseKey("memory transport test")
+	tests := []struct {
+		name   string
+		format WireFormat
+		cipher CipherSuite
+	}{
+		{"native", WireNative, CipherNone},
+		{"rtp", WireRTP, CipherNone},
+		{"native encrypted", WireNative, CipherAESGCM},
+		{"rtp encrypted", WireRTP, CipherChaCha20Poly1305},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := NewMemoryTransport(memoryTestDelay)
+			address := transport.Address("studio", "7777")
+			ln, err := transport.Listen(address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			served := make(chan struct{})
+			go func() {
+				defer close(served)
+				echoServer(t, ln, test.format, passphraseKey)
+			}()
+
+			conn, err := transport.Dial(address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			link := NewLink(conn, test.format)
+			defer link.Close()
+			requested := SessionParams{Version: ProtocolVersion, Codec: CodecOpus, Channels: 2, SampleRate: 44100,
+				FrameDuration: 10 * time.Millisecond, Cipher: test.cipher}
+			if test.cipher != CipherNone {
+				if requested.Salt, err = NewSalt(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			start := time.Now()
+			if err := link.Send(HelloPacket(requested)); err != nil {
+				t.Fatal(err)
+			}
+			var accept Packet
+			if err := link.Receive(&accept); err != nil {
+				t.Fatal(err)
+			}
+			if roundTrip := time.Since(start); roundTrip < 2*memoryTestDelay {
+				t.Errorf("handshake took %v, less than twice the delay of %v", roundTrip, memoryTestDelay)
+			}
+			params, err := accept.SessionParams()
+			if accept.PacketType != PacketAccept || err != nil {
+				t.Fatalf("got packet type %d (%v) instead of an Accept", accept.PacketType, err)
+			}
+			if params.SampleRate != 48000 || params.Cipher != test.cipher {
+				t.Errorf("server agreed to %v", params)
+			}
+			if test.cipher != CipherNone {
+				cipher, err := NewSessionCipher(params.Cipher, passphraseKey, params.Salt, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				link.SetCipher(cipher)
+			}
+
+			const frames = 20
+			for serial := 0; serial < frames; serial++ {
+				packet := InitPacket(PacketRecord, serial, time.Now().UnixMicro(), 0, 3)
+				packet.SetData([]byte{byte(serial), 1, 2})
+				if err := link.Send(packet); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := link.Send(&Packet{PacketType: PacketCloseChannel}); err != nil {
+				t.Fatal(err)
+			}
+			for serial := 0; serial < frames; serial++ {
+				var echo Packet
+				if err := link.Receive(&echo); err != nil {
+					t.Fatalf("echo %d: %v", serial, err)
+				}
+				if echo.PacketType != PacketRecord || echo.SerialNumber != uint32(serial) ||
+					!bytes.Equal(echo.Data[:echo.DataSize], []byte{byte(serial), 1, 2}) || echo.ServerReceive == 0 {
+					t.Fatalf("echo %d: got %+v", serial, echo)
+				}
+			}
+			var closed Packet
+			if err := link.Receive(&closed); err != nil || closed.PacketType != PacketCloseChannel {
+				t.Fatalf("got packet type %d (%v) instead of the closing packet", closed.PacketType, err)
+			}
+			<-served
+			if err := link.Receive(&closed); !errors.Is(err, io.EOF) {
+				t.Errorf("after the server closed: got %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestMemoryTransportDial(t *testing.T) {
+	transport := NewMemoryTransport(0)
+	if _, err := transport.Dial("nobody:7777"); !errors.Is(err, ErrNoListener) {
+		t.Errorf("dialing nobody: got %v, want %v", err, ErrNoListener)
+	}
+	ln, err := transport.Listen("studio:7777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.Listen("studio:7777"); err == nil {
+		t.Error("listened twice on the same address")
+	}
+	ln.Close()
+	if _, err := transport.Dial("studio:7777"); !errors.Is(err, ErrNoListener) {
+		t.Errorf("dialing a closed listener: got %v, want %v", err, ErrNoListener)
+	}
+}
+
+func TestMemoryTransportReadDeadline(t *testing.T) {
+	transport := NewMemoryTransport(0)
+	ln, err := transport.Listen("studio:7777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			defer conn.Close()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	conn, err := transport.Dial("studio:7777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	link := NewLink(conn, WireNative)
+	link.EnableKeepalive(20 * time.Millisecond)
+	var packet Packet
+	if err := link.Receive(&packet); !errors.Is(err, ErrIdleTimeout) {
+		t.Errorf("silent server: got %v, want %v", err, ErrIdleTimeout)
+	}
+}
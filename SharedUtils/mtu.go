@@ -0,0 +1,146 @@
+package sharedutils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultMTU       = 1500                   // DefaultMTU - The MTU of Ethernet, most paths carry it
+	MinMTU           = 576                    // MinMTU - The smallest datagram every IPv4 host reassembles (RFC 791), assumed to get through
+	ipv4UDPOverhead  = 28                     // ipv4UDPOverhead - IPv4 and UDP headers
+	ipv6UDPOverhead  = 48                     // ipv6UDPOverhead - IPv6 and UDP headers
+	mtuProbeTimeout  = 300 * time.Millisecond // mtuProbeTimeout - How long the echo of a probe is waited for
+	mtuProbeAttempts = 2                      // mtuProbeAttempts - Probes of a size sent before the size is taken as too large, a probe may be lost
+)
+
+var (
+	// ErrExceedsMTU is returned by Link.Send for datagrams that would be fragmented on the path
+	ErrExceedsMTU = errors.New("sharedutils: packet larger than the path MTU")
+	// ErrMTUProbeUnsupported is returned when the path MTU can not be probed on the connection or the system
+	ErrMTUProbeUnsupported = errors.New("sharedutils: path MTU probing is not supported")
+)
+
+// MaxDatagram returns the largest UDP payload that is not fragmented on a path of the MTU to the address
+func MaxDatagram(mtu int, address net.Addr) int {
+	if isIPv6(address) {
+		return mtu - ipv6UDPOverhead
+	}
+	return mtu - ipv4UDPOverhead
+}
+
+func isIPv6(address net.Addr) bool {
+	udpAddress, ok := address.(*net.UDPAddr)
+	return ok && udpAddress.IP.To4() == nil
+}
+
+// SetMTU makes the datagrams of the link fit in a path of the MTU: MaxDataSize shrinks accordingly and Send refuses
+// larger packets with ErrExceedsMTU instead of letting IP fragment them. Streams are segmented by TCP and not limited.
+// No packet is larger than BufferSize, which fits the DefaultMTU, so only smaller MTUs such as MinMTU limit the link
+func (link *Link) SetMTU(mtu int) {
+	link.mtu, link.maxDatagram = mtu, 0
+	if link.datagram && mtu > 0 {
+		link.maxDatagram = MaxDatagram(mtu, link.conn.RemoteAddr())
+	}
+}
+
+// MTU returns the MTU the link was set to, zero when none was
+func (link *Link) MTU() int {
+	return link.mtu
+}
+
+// checkMTU refuses an encoded datagram that does not fit the MTU of the link
+func (link *Link) checkMTU(buf []byte) error {
+	if link.maxDatagram > 0 && len(buf) > link.maxDatagram {
+		return fmt.Errorf("%w: %d bytes where an MTU of %d carries %d", ErrExceedsMTU, len(buf), link.mtu, link.maxDatagram)
+	}
+	return nil
+}
+
+// MTUProbe creates a probe padded to size bytes of data
+func MTUProbe(serialNumber, size int) *Packet {
+	packet := InitPacket(PacketMTUProbe, serialNumber, time.Now().UnixMicro(), 0, size)
+	packet.SetData(make([]byte, size))
+	return packet
+}
+
+// ProbePathMTU finds the largest MTU up to maxMTU the path to the server carries, with the server echoing probes
+// that the kernel must not fragment. The largest packet of the link bounds the probes, so a larger MTU is reported
+// as that bound. The socket keeps refusing to fragment afterwards and the link is set to the MTU found. Only
+// connected UDP sockets on Linux can be probed. Nothing else may read the link meanwhile
+func ProbePathMTU(link *Link, maxMTU int) (int, error) {
+	datagram, ok := link.conn.(datagramConn)
+	if !ok {
+		return 0, ErrMTUProbeUnsupported
+	}
+	socket, ok := datagram.Conn.(syscall.Conn)
+	if !ok {
+		return 0, ErrMTUProbeUnsupported
+	}
+	ipv6 := isIPv6(link.conn.RemoteAddr())
+	if err := setDontFragment(socket, ipv6); err != nil {
+		return 0, err
+	}
+	defer link.conn.SetReadDeadline(time.Time{})
+
+	overhead := ipv4UDPOverhead
+	if ipv6 {
+		overhead = ipv6UDPOverhead
+	}
+	high := min(maxMTU, BufferSize+overhead)
+	if kernelMTU, err := kernelPathMTU(socket, ipv6); err == nil && kernelMTU >= MinMTU {
+		high = min(high, kernelMTU) // The MTU of the interface, or what ICMP told the kernel about the path
+	}
+	low := min(MinMTU, high)
+	for round := 0; low < high; round++ {
+		candidate := (low + high + 1) / 2
+		if low == MinMTU && round == 0 {
+			candidate = high // Most paths carry it, one probe is enough
+		}
+		echoed, err := link.probeMTU(round, candidate)
+		if err != nil {
+			return 0, err
+		}
+		if echoed {
+			low = candidate
+		} else {
+			high = candidate - 1
+		}
+	}
+	link.SetMTU(low)
+	return low, nil
+}
+
+// probeMTU sends probes filling the candidate MTU and reports whether one was echoed. Every attempt has a serial
+// of its own, the replay protection of an encrypted session would drop a probe sent again with the same one
+func (link *Link) probeMTU(round, candidate int) (bool, error) {
+	link.SetMTU(candidate)
+	for attempt := 0; attempt < mtuProbeAttempts; attempt++ {
+		err := link.Send(MTUProbe(round*mtuProbeAttempts+attempt, link.MaxDataSize()))
+		if errors.Is(err, syscall.EMSGSIZE) {
+			return false, nil // Larger than the kernel knows the path carries
+		}
+		if err != nil {
+			return false, err
+		}
+		if err := link.conn.SetReadDeadline(time.Now().Add(mtuProbeTimeout)); err != nil {
+			return false, err
+		}
+		for {
+			var echo Packet
+			err := link.Receive(&echo)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if errors.Is(err, ErrBadHeader) || (err == nil && (echo.PacketType != PacketMTUProbe || int(echo.SerialNumber)/mtuProbeAttempts != round)) {
+				continue // Echoes of the probes of earlier rounds and the rest of the traffic
+			}
+			return err == nil, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,41 @@
+//go:build linux
+
+package sharedutils
+
+import "syscall"
+
+// setDontFragment makes the kernel send the datagrams of the socket with the DF bit, or unfragmented over IPv6,
+// and fail with EMSGSIZE the ones larger than the path MTU it knows
+func setDontFragment(conn syscall.Conn, ipv6 bool) error {
+	level, option, value := syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO
+	if ipv6 {
+		level, option, value = syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) { sockErr = syscall.SetsockoptInt(int(fd), level, option, value) }); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// kernelPathMTU returns the path MTU the kernel knows for the connected socket
+func kernelPathMTU(conn syscall.Conn, ipv6 bool) (int, error) {
+	level, option := syscall.IPPROTO_IP, syscall.IP_MTU
+	if ipv6 {
+		level, option = syscall.IPPROTO_IPV6, syscall.IPV6_MTU
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var mtu int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) { mtu, sockErr = syscall.GetsockoptInt(int(fd), level, option) }); err != nil {
+		return 0, err
+	}
+	return mtu, sockErr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package sharedutils
+
+import "syscall"
+
+func setDontFragment(conn syscall.Conn, ipv6 bool) error {
+	return ErrMTUProbeUnsupported
+}
+
+func kernelPathMTU(conn syscall.Conn, ipv6 bool) (int, error) {
+	return 0, ErrMTUProbeUnsupported
+}
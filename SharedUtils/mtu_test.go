@@ -0,0 +1,88 @@
+package sharedutils
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// udpLinkPair returns the links of a client and a server over the udp loopback
+func udpLinkPair(t *testing.T, format WireFormat) (client, server *Link) {
+	transport := &UDPTransport{}
+	ln, err := transport.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	conn, err := transport.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = NewLink(conn, format)
+	t.Cleanup(func() { client.Close() })
+	if err := client.Send(Heartbeat(0)); err != nil { // The listener accepts the client once a datagram arrives
+		t.Fatal(err)
+	}
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = NewLink(accepted, format)
+	t.Cleanup(func() { server.Close() }) // Receive skips the heartbeat
+	return client, server
+}
+
+func TestSetMTU(t *testing.T) {
+	for _, format := range []WireFormat{WireNative, WireRTP} {
+		t.Run(format.String(), func(t *testing.T) {
+			client, server := udpLinkPair(t, format)
+			unlimited := client.MaxDataSize()
+			client.SetMTU(DefaultMTU)
+			if client.MaxDataSize() != unlimited {
+				t.Errorf("MTU of %d: got a MaxDataSize of %d, want the %d of BufferSize", DefaultMTU, client.MaxDataSize(), unlimited)
+			}
+
+			client.SetMTU(MinMTU)
+			maxDataSize := client.MaxDataSize()
+			if want := unlimited - (BufferSize - (MinMTU - ipv4UDPOverhead)); maxDataSize != want {
+				t.Fatalf("MTU of %d: got a MaxDataSize of %d, want %d", MinMTU, maxDataSize, want)
+			}
+			full := InitPacket(PacketRecord, 1, time.Now().UnixMicro(), 0, maxDataSize)
+			full.SetData(make([]byte, maxDataSize))
+			if err := client.Send(full); err != nil {
+				t.Fatalf("packet of MaxDataSize: %v", err)
+			}
+			var received Packet
+			if err := server.Receive(&received); err != nil || int(received.DataSize) != maxDataSize {
+				t.Fatalf("got %d bytes of data (%v), want %d", received.DataSize, err, maxDataSize)
+			}
+
+			// Native packets have the largest header, RTP media of one more byte still fits
+			if err := client.Send(MTUProbe(2, maxDataSize+1)); !errors.Is(err, ErrExceedsMTU) {
+				t.Errorf("packet over MaxDataSize: got %v, want %v", err, ErrExceedsMTU)
+			}
+
+			// The encoders kept to MaxDataSize make packets that fit
+			redundancy := NewRedundancyEncoder(MaxRedundancy)
+			redundancy.SetMaxSize(maxDataSize)
+			parity, err := NewParityEncoder(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parity.SetMaxSize(maxDataSize)
+			for serial := 10; serial < 14; serial++ {
+				frame := InitPacket(PacketRecord, serial, time.Now().UnixMicro(), 0, 300)
+				frame.SetData(make([]byte, 300))
+				packets := []*Packet{redundancy.Encode(frame)}
+				if protection := parity.Add(frame); protection != nil {
+					packets = append(packets, protection)
+				}
+				for _, packet := range packets {
+					if err := client.Send(packet); err != nil {
+						t.Errorf("packet type %d of %d bytes: %v", packet.PacketType, packet.DataSize, err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package sharedutils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	NackHistorySize = 512 // NackHistorySize - The packets a sender keeps to answer NACKs, about 10 seconds of 20 ms frames
+	MaxNackSerials  = 64  // MaxNackSerials - The most serials one NACK asks for, older ones of a longer gap are given up
+	nackEntrySize   = 4
+)
+
+// NackPacket builds a PacketNack asking for the serials, serialNumber counts the NACKs of the sender. The InitTime is
+// when it is sent and the ProcessingTime the playout delay of the receiver, in microseconds, so the sender can tell
+// whether a retransmission is still played
+func NackPacket(serialNumber int, serials []uint32, playoutDelay time.Duration) *Packet {
+	data := make([]byte, 0, len(serials)*nackEntrySize)
+	for _, serial := range serials {
+		data = binary.LittleEndian.AppendUint32(data, serial)
+	}
+	packet := InitPacket(PacketNack, serialNumber, time.Now().UnixMicro(), playoutDelay.Microseconds(), len(data))
+	packet.SetData(data)
+	return packet
+}
+
+// NackSerials returns the serials a PacketNack asks for
+func (packet *Packet) NackSerials() ([]uint32, error) {
+	if packet.DataSize == 0 || packet.DataSize%nackEntrySize != 0 || packet.DataSize > MaxNackSerials*nackEntrySize {
+		return nil, fmt.Errorf("%w: bad NACK packet", ErrBadHeader)
+	}
+	serials := make([]uint32, packet.DataSize/nackEntrySize)
+	for i := range serials {
+		serials[i] = binary.LittleEndian.Uint32(packet.Data[i*nackEntrySize:])
+	}
+	return serials, nil
+}
+
+// historySlot is a packet kept by a SendHistory, with a copy of its data
+type historySlot struct {
+	packet Packet
+	stored bool
+}
+
+// SendHistory keeps copies of the last media packets sent so the ones a NACK asks for can be sent again.
+// It is safe for concurrent use
+type SendHistory struct {
+	mutex         sync.Mutex
+	slots         []historySlot // Indexed by serial modulo the size
+	retransmitted uint64
+	expired       uint64
+	forwarded     int // NACKs forwarded, the serial of the next one
+}
+
+// NewSendHistory creates a history of the last size packets
+func NewSendHistory(size int) *SendHistory {
+	return &SendHistory{slots: make([]historySlot, max(1, size))}
+}
+
+// Add keeps a copy of a packet as it is sent, in place of the packet size serials before it
+func (history *SendHistory) Add(packet *Packet) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	slot := &history.slots[packet.SerialNumber%uint32(len(history.slots))]
+	data := append(slot.packet.Data[:0], packet.Data[:packet.DataSize]...)
+	slot.packet, slot.stored = *packet, true
+	slot.packet.Data = data
+}
+
+// Retransmissions returns copies of the packets a NACK asks for that still arrive before their playout deadline,
+// the InitTime of the packet plus the playout delay of the NACK. transit is the time from the NACK being sent
+// to a retransmission arriving at the receiver. The serials that are not kept are returned in a NACK with the times
+// of the original one, to be forwarded to the sender of those packets, nil when every serial was kept
+func (history *SendHistory) Retransmissions(nack *Packet, transit time.Duration) ([]*Packet, *Packet, error) {
+	serials, err := nack.NackSerials()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	arrival := nack.InitTime + uint64(max(0, transit.Microseconds()))
+	var packets []*Packet
+	var missing []uint32
+	for _, serial := range serials {
+		slot := &history.slots[serial%uint32(len(history.slots))]
+		if !slot.stored || slot.packet.SerialNumber != serial {
+			missing = append(missing, serial)
+			continue
+		}
+		if slot.packet.InitTime+nack.ProcessingTime < arrival {
+			history.expired++ // It would arrive after its playout
+			continue
+		}
+		packet := slot.packet
+		packet.Data = append([]byte(nil), slot.packet.Data...)
+		packets = append(packets, &packet)
+		history.retransmitted++
+	}
+
+	if len(missing) == 0 {
+		return packets, nil, nil
+	}
+	forward := NackPacket(history.forwarded, missing, 0)
+	history.forwarded++
+	forward.InitTime, forward.ProcessingTime = nack.InitTime, nack.ProcessingTime
+	return packets, forward, nil
+}
+
+// Counts returns the number of packets sent again so far, and of the ones asked for too late to be played
+func (history *SendHistory) Counts() (retransmitted, expired uint64) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	return history.retransmitted, history.expired
+}
+
+// NackTracker finds the serials missing from a received stream so the receiver asks for each of them once,
+// and drops the duplicates a retransmission causes when the original packet was only late
+type NackTracker struct {
+	delivered serialWindow
+	requested serialWindow
+	started   bool
+	highest   uint32
+	missing   []uint32 // Not asked for yet
+	nacks     int      // NACKs built, the serial of the next one
+}
+
+// Receive takes the serial of a received packet. It is false for duplicates, and requested is true when
+// the serial was asked for in a NACK
+func (tracker *NackTracker) Receive(serial uint32) (fresh, requested bool) {
+	if !tracker.delivered.check(serial) {
+		return false, false
+	}
+	tracker.delivered.mark(serial)
+	requested = !tracker.requested.check(serial)
+
+	if !tracker.started {
+		tracker.started, tracker.highest = true, serial
+		return true, requested
+	}
+	if gap := int32(serial - tracker.highest); gap > 0 {
+		first := serial - uint32(min(gap-1, MaxNackSerials))
+		for missing := first; missing != serial; missing++ {
+			tracker.missing = append(tracker.missing, missing)
+		}
+		tracker.highest = serial
+	}
+	return true, requested
+}
+
+// Nack returns a NACK for the serials found missing since the last call that did not arrive meanwhile,
+// at most MaxNackSerials of them, or nil when there are none
+func (tracker *NackTracker) Nack(playoutDelay time.Duration) *Packet {
+	var due []uint32
+	for _, serial := range tracker.missing[max(0, len(tracker.missing)-MaxNackSerials):] {
+		if tracker.delivered.check(serial) && tracker.requested.check(serial) {
+			tracker.requested.mark(serial)
+			due = append(due, serial)
+		}
+	}
+	tracker.missing = tracker.missing[:0]
+	if len(due) == 0 {
+		return nil
+	}
+	tracker.nacks++
+	return NackPacket(tracker.nacks-1, due, playoutDelay)
+}
@@ -0,0 +1,179 @@
+package sharedutils
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	natQueue = 256 // natQueue - Datagrams let in for a host behind a simulated NAT that it did not read yet
+)
+
+// NATBehavior is how a simulated NAT maps the ports of the hosts behind it and which datagrams it lets in (RFC 4787)
+type NATBehavior int
+
+const (
+	NATFullCone           NATBehavior = iota // NATFullCone - One public port per host, anybody may send to it
+	NATRestrictedCone                        // NATRestrictedCone - One public port per host, the addresses the host sent to may send to it
+	NATPortRestrictedCone                    // NATPortRestrictedCone - One public port per host, the address and port the host sent to may send to it
+	NATSymmetric                             // NATSymmetric - A public port per destination, only the destination may send to it. Punching through it fails
+)
+
+// ParseNATBehavior parses the name of a NAT behavior as given on the command line
+func ParseNATBehavior(name string) (NATBehavior, error) {
+	switch name {
+	case "full-cone":
+		return NATFullCone, nil
+	case "restricted":
+		return NATRestrictedCone, nil
+	case "port-restricted":
+		return NATPortRestrictedCone, nil
+	case "symmetric":
+		return NATSymmetric, nil
+	}
+	return NATFullCone, fmt.Errorf("unknown NAT behavior %q (full-cone, restricted, port-restricted or symmetric)", name)
+}
+
+func (behavior NATBehavior) String() string {
+	switch behavior {
+	case NATRestrictedCone:
+		return "restricted"
+	case NATPortRestrictedCone:
+		return "port-restricted"
+	case NATSymmetric:
+		return "symmetric"
+	}
+	return "full-cone"
+}
+
+// NATSimulator puts sockets behind a simulated NAT on the loopback interface, to try hole punching on one machine.
+// Every mapping is a UDP socket of its own, so the peers and the server see the public port of the mapping.
+// Mappings never expire. Every address on loopback is the same host, a restricted cone lets in what a full cone does
+type NATSimulator struct {
+	Behavior NATBehavior
+	hosts    atomic.Int32  // Sockets put behind the NAT, to give them private addresses
+	dropped  atomic.Uint64 // Datagrams the filters kept out
+}
+
+// NewNATSimulator creates a simulated NAT of the behavior
+func NewNATSimulator(behavior NATBehavior) *NATSimulator {
+	return &NATSimulator{Behavior: behavior}
+}
+
+// Dropped returns the count of the datagrams the NAT did not let in
+func (nat *NATSimulator) Dropped() uint64 {
+	return nat.dropped.Load()
+}
+
+// ListenPacket creates a socket behind the NAT
+func (nat *NATSimulator) ListenPacket() net.PacketConn {
+	host := nat.hosts.Add(1)
+	return &natConn{
+		nat:      nat,
+		local:    &net.UDPAddr{IP: net.IPv4(192, 168, 0, byte(1+host%254)), Port: 40000 + int(host)},
+		queue:    newMessageQueue(natQueue),
+		mappings: make(map[string]*natMapping),
+	}
+}
+
+// natMapping is a public port of the NAT and the addresses that may send to it
+type natMapping struct {
+	conn    *net.UDPConn
+	allowed map[string]bool // Hosts or host:ports the inside sent to, depending on the behavior
+}
+
+// natConn is a socket behind a simulated NAT
+type natConn struct {
+	nat      *NATSimulator
+	local    *net.UDPAddr
+	queue    *messageQueue
+	mutex    sync.Mutex
+	mappings map[string]*natMapping // By destination for a symmetric NAT, a single one otherwise
+}
+
+// filterKey is what an outside address is allowed by
+func (conn *natConn) filterKey(address *net.UDPAddr) string {
+	switch conn.nat.Behavior {
+	case NATFullCone:
+		return ""
+	case NATRestrictedCone:
+		return address.IP.String()
+	}
+	return address.String()
+}
+
+// mapping returns the mapping a datagram to the destination leaves through, created on the first one
+func (conn *natConn) mapping(destination *net.UDPAddr) (*natMapping, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	key := ""
+	if conn.nat.Behavior == NATSymmetric {
+		key = destination.String()
+	}
+	mapping, ok := conn.mappings[key]
+	if !ok {
+		udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return nil, err
+		}
+		mapping = &natMapping{conn: udpConn, allowed: make(map[string]bool)}
+		conn.mappings[key] = mapping
+		go conn.inboundRoutine(mapping)
+	}
+	mapping.allowed[conn.filterKey(destination)] = true
+	return mapping, nil
+}
+
+// inboundRoutine lets in the datagrams that arrive at the public port of a mapping and pass its filter
+func (conn *natConn) inboundRoutine(mapping *natMapping) {
+	buffer := make([]byte, BufferSize)
+	for {
+		bytesRead, address, err := mapping.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		conn.mutex.Lock()
+		allowed := mapping.allowed[conn.filterKey(address)]
+		conn.mutex.Unlock()
+		if !allowed {
+			conn.nat.dropped.Add(1)
+			continue
+		}
+		conn.queue.push(append([]byte(nil), buffer[:bytesRead]...), address, time.Time{}, false)
+	}
+}
+
+func (conn *natConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return conn.queue.readFrom(b)
+}
+
+func (conn *natConn) WriteTo(b []byte, address net.Addr) (int, error) {
+	destination, err := net.ResolveUDPAddr("udp", address.String())
+	if err != nil {
+		return 0, err
+	}
+	mapping, err := conn.mapping(destination)
+	if err != nil {
+		return 0, err
+	}
+	return mapping.conn.WriteToUDP(b, destination)
+}
+
+// Close closes the socket and removes its mappings from the NAT
+func (conn *natConn) Close() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	for _, mapping := range conn.mappings {
+		mapping.conn.Close()
+	}
+	conn.queue.close()
+	return nil
+}
+
+func (conn *natConn) LocalAddr() net.Addr                { return conn.local }
+func (conn *natConn) SetDeadline(t time.Time) error      { return conn.SetReadDeadline(t) }
+func (conn *natConn) SetReadDeadline(t time.Time) error  { return conn.queue.setDeadline(t) }
+func (conn *natConn) SetWriteDeadline(t time.Time) error { return nil }
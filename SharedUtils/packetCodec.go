@@ -0,0 +1,299 @@
+package sharedutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"sync"
+)
+
+var (
+	// ErrBadHeader is wrapped by every error returned for a malformed packet
+	ErrBadHeader = errors.New("sharedutils: bad packet header")
+	// ErrBadMagic is returned for packets that do not start with MagicNumber
+	ErrBadMagic = fmt.Errorf("%w: bad magic number", ErrBadHeader)
+	// ErrBadLength is returned for packets whose size does not match the DataSize in their header
+	ErrBadLength = fmt.Errorf("%w: bad packet length", ErrBadHeader)
+	// ErrBadChecksum is returned for packets whose CRC32 does not match the header and data
+	ErrBadChecksum = fmt.Errorf("%w: bad checksum", ErrBadHeader)
+	// ErrShortRead is returned when a stream ends in the middle of a packet
+	ErrShortRead = errors.New("sharedutils: short read")
+	// ErrBadFrameLength is returned when the length prefix on a stream is out of range,
+	// the stream can not be resynchronized after it
+	ErrBadFrameLength = errors.New("sharedutils: bad frame length")
+	// ErrBadField is returned when encoding a packet whose type, processing time or stream ID
+	// does not fit in its field of the header, it would be decoded as another value
+	ErrBadField = errors.New("sharedutils: packet field too large for the header")
+)
+
+// VersionError is returned for packets sent by a build that speaks another protocol version
+type VersionError struct {
+	Version uint8
+}
+
+func (err *VersionError) Error() string {
+	return fmt.Sprintf("sharedutils: peer speaks protocol version %d, this build speaks version %d", err.Version, ProtocolVersion)
+}
+
+// Is makes a VersionError match ErrBadHeader
+func (err *VersionError) Is(target error) bool {
+	return target == ErrBadHeader
+}
+
+// bufferPool holds the buffers packets are encoded into and read into, so that the audio path does not allocate
+var bufferPool = sync.Pool{
+	New: func() any { return new([LengthPrefix + BufferSize]byte) },
+}
+
+// rejectedPackets counts the malformed packets that were dropped and remembers why the last one was dropped
+var rejectedPackets struct {
+	sync.Mutex
+	count   uint64
+	lastErr error
+}
+
+// Encode writes the packet to a stream, preceded by its length as a big endian uint16 (as in RFC 4571)
+func (packet *Packet) Encode(w io.Writer) error {
+	if err := packet.checkFields(); err != nil {
+		return err
+	}
+	buf := bufferPool.Get().(*[LengthPrefix + BufferSize]byte)
+	defer bufferPool.Put(buf)
+
+	packetLen := MetadataSize + int(packet.DataSize)
+	binary.BigEndian.PutUint16(buf[0:], uint16(packetLen))
+	packet.encode(buf[LengthPrefix : LengthPrefix+packetLen])
+	_, err := w.Write(buf[:LengthPrefix+packetLen])
+	return err
+}
+
+// Decode reads one length prefixed packet from a stream. Partial reads are retried until the packet is complete.
+// It returns io.EOF if the stream ended between packets, ErrShortRead if it ended in the middle of one,
+// ErrBadFrameLength if the stream is out of sync and an error wrapping ErrBadHeader for a malformed packet
+func (packet *Packet) Decode(r io.Reader) error {
+	pooled := bufferPool.Get().(*[LengthPrefix + BufferSize]byte)
+	defer bufferPool.Put(pooled)
+
+	buf := pooled[:]
+	if err := readFull(r, buf[:LengthPrefix]); err != nil {
+		return err
+	}
+	packetLen := int(binary.BigEndian.Uint16(buf[:LengthPrefix]))
+	if packetLen < MetadataSize || packetLen > BufferSize {
+		return ErrBadFrameLength
+	}
+	if err := readFull(r, buf[:packetLen]); err != nil {
+		if err == io.EOF {
+			return ErrShortRead
+		}
+		return err
+	}
+	return packet.decodeCopy(buf[:packetLen])
+}
+
+// readFull is io.ReadFull, with ErrShortRead for a stream that ended in the middle of buf
+func readFull(r io.Reader, buf []byte) error {
+	_, err := io.ReadFull(r, buf)
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: %w", ErrShortRead, err)
+	}
+	return err
+}
+
+// MarshalDatagram encodes the packet into a single datagram
+func (packet *Packet) MarshalDatagram() ([]byte, error) {
+	return packet.AppendDatagram(nil)
+}
+
+// AppendDatagram appends the packet encoded as a single datagram to dst and returns the extended buffer.
+// It does not allocate when dst has room for MetadataSize+DataSize more bytes
+func (packet *Packet) AppendDatagram(dst []byte) ([]byte, error) {
+	if err := packet.checkFields(); err != nil {
+		return dst, err
+	}
+	start := len(dst)
+	dst = slices.Grow(dst, MetadataSize+int(packet.DataSize))[:start+MetadataSize+int(packet.DataSize)]
+	packet.encode(dst[start:])
+	return dst, nil
+}
+
+// UnmarshalDatagram decodes a single datagram into the packet without copying:
+// the Data of the packet refers to buf, so buf must not be reused while the packet is in use
+func (packet *Packet) UnmarshalDatagram(buf []byte) error {
+	if err := packet.decodeHeader(buf); err != nil {
+		return err
+	}
+	packet.Data = buf[MetadataSize:]
+	return nil
+}
+
+// Receive reads one packet from the link, a datagram on datagram connections and a length prefixed packet on streams.
+// Malformed packets are counted (see PacketsRejected) and returned as an error wrapping ErrBadHeader
+func (packet *Packet) Receive(conn net.Conn) error {
+	var err error
+	if isDatagram(conn) {
+		buf := bufferPool.Get().(*[LengthPrefix + BufferSize]byte)
+		defer bufferPool.Put(buf)
+		packetLen, readErr := conn.Read(buf[:BufferSize])
+		if readErr != nil {
+			return readErr
+		}
+		err = packet.decodeCopy(buf[:packetLen])
+	} else {
+		err = packet.Decode(conn)
+	}
+	if errors.Is(err, ErrBadHeader) {
+		rejectPacket(err)
+	}
+	return err
+}
+
+// Send writes the packet to the link in the framing of the connection
+func (packet *Packet) Send(conn net.Conn) error {
+	if !isDatagram(conn) {
+		return packet.Encode(conn)
+	}
+	pooled := bufferPool.Get().(*[LengthPrefix + BufferSize]byte)
+	defer bufferPool.Put(pooled)
+
+	buf, err := packet.AppendDatagram(pooled[:0])
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(buf)
+	return err
+}
+
+// ReceiveFrom reads one datagram from a listening (unconnected) socket and returns the address of its sender
+func (packet *Packet) ReceiveFrom(conn net.PacketConn) (net.Addr, error) {
+	buf := bufferPool.Get().(*[LengthPrefix + BufferSize]byte)
+	defer bufferPool.Put(buf)
+
+	packetLen, address, err := conn.ReadFrom(buf[:BufferSize])
+	if err != nil {
+		return address, err
+	}
+	if err := packet.decodeCopy(buf[:packetLen]); err != nil {
+		rejectPacket(err)
+		return address, err
+	}
+	return address, nil
+}
+
+// SendTo writes the packet as a single datagram to address through a listening socket
+func (packet *Packet) SendTo(conn net.PacketConn, address net.Addr) error {
+	pooled := bufferPool.Get().(*[LengthPrefix + BufferSize]byte)
+	defer bufferPool.Put(pooled)
+
+	buf, err := packet.AppendDatagram(pooled[:0])
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(buf, address)
+	return err
+}
+
+func rejectPacket(err error) {
+	rejectedPackets.Lock()
+	defer rejectedPackets.Unlock()
+	rejectedPackets.count++
+	rejectedPackets.lastErr = err
+}
+
+// PacketsRejected returns the number of malformed packets dropped while receiving
+// and the reason the last one was dropped (a *VersionError for an incompatible peer)
+func PacketsRejected() (uint64, error) {
+	rejectedPackets.Lock()
+	defer rejectedPackets.Unlock()
+	return rejectedPackets.count, rejectedPackets.lastErr
+}
+
+// encode writes the header and the first DataSize bytes of the data into buf,
+// which must hold exactly MetadataSize+DataSize bytes
+func (packet *Packet) encode(buf []byte) {
+	binary.LittleEndian.PutUint16(buf[0:], MagicNumber)
+	buf[2] = ProtocolVersion
+	buf[3] = uint8(packet.PacketType)
+	binary.LittleEndian.PutUint16(buf[4:], uint16(packet.DataSize))
+	binary.LittleEndian.PutUint32(buf[6:], packet.SerialNumber)
+	binary.LittleEndian.PutUint64(buf[10:], packet.InitTime)
+	binary.LittleEndian.PutUint32(buf[18:], uint32(packet.ProcessingTime))
+	binary.LittleEndian.PutUint64(buf[22:], packet.ServerReceive)
+	binary.LittleEndian.PutUint64(buf[30:], packet.ServerTransmit)
+	binary.LittleEndian.PutUint16(buf[38:], uint16(packet.StreamID))
+	copy(buf[MetadataSize:], packet.Data[:packet.DataSize])
+	binary.LittleEndian.PutUint32(buf[checksumOffset:], checksum(buf))
+}
+
+// checkFields validates DataSize, and the fields the header holds narrower than the packet, before encoding
+func (packet *Packet) checkFields() error {
+	if packet.DataSize > DataFrameSize || int(packet.DataSize) > len(packet.Data) {
+		return ErrBadLength
+	}
+	if packet.PacketType > math.MaxUint8 || packet.ProcessingTime > math.MaxUint32 || packet.StreamID > MaxStreamID {
+		return fmt.Errorf("%w: type %d, processing time %d, stream %d", ErrBadField, packet.PacketType, packet.ProcessingTime, packet.StreamID)
+	}
+	return nil
+}
+
+// decodeCopy decodes a single encoded packet and copies its data into the packet,
+// reusing the Data of the packet when it is large enough
+func (packet *Packet) decodeCopy(buf []byte) error {
+	if err := packet.decodeHeader(buf); err != nil {
+		return err
+	}
+	packet.Data = append(packet.Data[:0], buf[MetadataSize:]...)
+	return nil
+}
+
+// decodeHeader parses and validates a single encoded packet, leaving the data of the packet to the caller
+func (packet *Packet) decodeHeader(buf []byte) error {
+	if len(buf) < MetadataSize {
+		return ErrBadLength
+	}
+	if binary.LittleEndian.Uint16(buf[0:2]) != MagicNumber {
+		return ErrBadMagic
+	}
+	if buf[2] != ProtocolVersion {
+		return &VersionError{Version: buf[2]}
+	}
+	dataSize := int(binary.LittleEndian.Uint16(buf[4:6]))
+	if dataSize > DataFrameSize || len(buf) != MetadataSize+dataSize {
+		return ErrBadLength
+	}
+	if binary.LittleEndian.Uint32(buf[checksumOffset:]) != checksum(buf) {
+		return ErrBadChecksum
+	}
+	packet.PacketType = uint32(buf[3])
+	packet.SerialNumber = binary.LittleEndian.Uint32(buf[6:10])
+	packet.InitTime = binary.LittleEndian.Uint64(buf[10:18])
+	packet.ProcessingTime = uint64(binary.LittleEndian.Uint32(buf[18:22]))
+	packet.ServerReceive = binary.LittleEndian.Uint64(buf[22:30])
+	packet.ServerTransmit = binary.LittleEndian.Uint64(buf[30:38])
+	packet.StreamID = uint32(binary.LittleEndian.Uint16(buf[38:40]))
+	packet.DataSize = uint32(dataSize)
+	return nil
+}
+
+// checksum is the CRC32 of an encoded packet, the header (without the checksum field) followed by the data
+func checksum(buf []byte) uint32 {
+	crc := crc32.ChecksumIEEE(buf[:checksumOffset])
+	return crc32.Update(crc, crc32.IEEETable, buf[MetadataSize:])
+}
+
+// isDatagram reports whether the connection keeps message boundaries (UDP) or is a byte stream (TCP)
+func isDatagram(conn net.Conn) bool {
+	if conn, ok := conn.(Conn); ok {
+		return conn.Datagram()
+	}
+	switch conn.LocalAddr().Network() {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,252 @@
+package sharedutils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"testing"
+	"testing/iotest"
+)
+
+// opusFramePacket is a PacketRecord the size of an Opus frame at 2.5 ms
+func opusFramePacket() *Packet {
+	packet := InitPacket(PacketRecord, 1, 1718000000000000, 120, 100)
+	packet.SetData(make([]byte, 100))
+	return packet
+}
+
+func BenchmarkEncode(b *testing.B) {
+	packet := opusFramePacket()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := packet.Encode(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	var stream bytes.Buffer
+	if err := opusFramePacket().Encode(&stream); err != nil {
+		b.Fatal(err)
+	}
+	reader := bytes.NewReader(stream.Bytes())
+	var packet Packet
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		reader.Reset(stream.Bytes())
+		if err := packet.Decode(reader); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendDatagram(b *testing.B) {
+	packet := opusFramePacket()
+	buf := make([]byte, 0, BufferSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := packet.AppendDatagram(buf[:0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalDatagram(b *testing.B) {
+	datagram, err := opusFramePacket().MarshalDatagram()
+	if err != nil {
+		b.Fatal(err)
+	}
+	var packet Packet
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := packet.UnmarshalDatagram(datagram); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// codecPackets are the packets the round trip tests encode, from an empty one to the largest one
+func codecPackets() []*Packet {
+	empty := InitPacket(PacketCloseChannel, 0, 0, 0, 0)
+	stamped := opusFramePacket()
+	stamped.ServerReceive, stamped.ServerTransmit, stamped.StreamID = 1718000000000100, 1718000000000200, 7
+	largest := InitPacket(PacketRequestSong, 1<<31, 1718000000000000, 1<<31, DataFrameSize)
+	largest.SetData(bytes.Repeat([]byte{0xa5}, DataFrameSize))
+	return []*Packet{empty, opusFramePacket(), stamped, largest}
+}
+
+// samePacket reports whether two packets have the same header and data
+func samePacket(a, b *Packet) bool {
+	return a.PacketType == b.PacketType && a.SerialNumber == b.SerialNumber && a.InitTime == b.InitTime &&
+		a.ProcessingTime == b.ProcessingTime && a.ServerReceive == b.ServerReceive && a.ServerTransmit == b.ServerTransmit &&
+		a.StreamID == b.StreamID && a.DataSize == b.DataSize && bytes.Equal(a.Data[:a.DataSize], b.Data[:b.DataSize])
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	readers := []struct {
+		name   string
+		reader func(io.Reader) io.Reader
+	}{
+		{"whole", func(r io.Reader) io.Reader { return r }},
+		{"one byte at a time", iotest.OneByteReader},
+		{"half reads", iotest.HalfReader},
+	}
+	for _, test := range readers {
+		t.Run(test.name, func(t *testing.T) {
+			var stream bytes.Buffer
+			packets := codecPackets()
+			for _, packet := range packets {
+				if err := packet.Encode(&stream); err != nil {
+					t.Fatal(err)
+				}
+			}
+			reader := test.reader(&stream)
+			for i, want := range packets {
+				var got Packet
+				if err := got.Decode(reader); err != nil {
+					t.Fatalf("packet %d: %v", i, err)
+				}
+				if !samePacket(&got, want) {
+					t.Errorf("packet %d: got %+v, want %+v", i, got, *want)
+				}
+			}
+			var packet Packet
+			if err := packet.Decode(reader); err != io.EOF {
+				t.Errorf("after the last packet: got %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := opusFramePacket().Encode(&encoded); err != nil {
+		t.Fatal(err)
+	}
+	// corrupt returns a copy of the encoded packet changed by change
+	corrupt := func(change func([]byte) []byte) []byte {
+		return change(append([]byte(nil), encoded.Bytes()...))
+	}
+	tests := []struct {
+		name    string
+		stream  []byte
+		want    error
+		version uint8 // The version of the VersionError expected, zero for none
+	}{
+		{"ends in the length prefix", encoded.Bytes()[:1], ErrShortRead, 0},
+		{"ends in the header", encoded.Bytes()[:LengthPrefix+10], ErrShortRead, 0},
+		{"ends in the data", encoded.Bytes()[:encoded.Len()-1], ErrShortRead, 0},
+		{"length prefix below the header", corrupt(func(buf []byte) []byte {
+			binary.BigEndian.PutUint16(buf, MetadataSize-1)
+			return buf
+		}), ErrBadFrameLength, 0},
+		{"length prefix above the buffer", corrupt(func(buf []byte) []byte {
+			binary.BigEndian.PutUint16(buf, BufferSize+1)
+			return buf
+		}), ErrBadFrameLength, 0},
+		{"length prefix off the data size", corrupt(func(buf []byte) []byte {
+			binary.BigEndian.PutUint16(buf, uint16(len(buf)-LengthPrefix-1))
+			return buf[:len(buf)-1]
+		}), ErrBadLength, 0},
+		{"bad magic", corrupt(func(buf []byte) []byte {
+			buf[LengthPrefix] ^= 0xff
+			return buf
+		}), ErrBadMagic, 0},
+		{"corrupted data", corrupt(func(buf []byte) []byte {
+			buf[len(buf)-1] ^= 0x01
+			return buf
+		}), ErrBadChecksum, 0},
+		{"corrupted header", corrupt(func(buf []byte) []byte {
+			buf[LengthPrefix+6] ^= 0x01 // The serial
+			return buf
+		}), ErrBadChecksum, 0},
+		{"corrupted checksum", corrupt(func(buf []byte) []byte {
+			buf[LengthPrefix+checksumOffset] ^= 0x01
+			return buf
+		}), ErrBadChecksum, 0},
+		{"older version", corrupt(func(buf []byte) []byte {
+			buf[LengthPrefix+2] = ProtocolVersion - 1
+			return buf
+		}), ErrBadHeader, ProtocolVersion - 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var packet Packet
+			err := packet.Decode(bytes.NewReader(test.stream))
+			if !errors.Is(err, test.want) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+			var versionErr *VersionError
+			if isVersionErr := errors.As(err, &versionErr); isVersionErr != (test.version != 0) {
+				t.Fatalf("got %v, want a VersionError: %v", err, test.version != 0)
+			}
+			if versionErr != nil && versionErr.Version != test.version {
+				t.Errorf("got version %d, want %d", versionErr.Version, test.version)
+			}
+		})
+	}
+}
+
+func TestDatagramRoundTrip(t *testing.T) {
+	for i, want := range codecPackets() {
+		datagram, err := want.MarshalDatagram()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Packet
+		if err := got.UnmarshalDatagram(datagram); err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if !samePacket(&got, want) {
+			t.Errorf("packet %d: got %+v, want %+v", i, got, *want)
+		}
+		if err := got.UnmarshalDatagram(datagram[:len(datagram)-1]); !errors.Is(err, ErrBadLength) {
+			t.Errorf("packet %d truncated: got %v, want %v", i, err, ErrBadLength)
+		}
+	}
+}
+
+func TestEncodeRejectsBadDataSize(t *testing.T) {
+	tooLarge := InitPacket(PacketRecord, 0, 0, 0, DataFrameSize+1)
+	tooLarge.SetData(make([]byte, DataFrameSize+1))
+	shortData := InitPacket(PacketRecord, 0, 0, 0, 10)
+	shortData.SetData(make([]byte, 5))
+	for _, packet := range []*Packet{tooLarge, shortData} {
+		var stream bytes.Buffer
+		if err := packet.Encode(&stream); !errors.Is(err, ErrBadLength) {
+			t.Errorf("DataSize %d with %d bytes: got %v, want %v", packet.DataSize, len(packet.Data), err, ErrBadLength)
+		}
+		if stream.Len() != 0 {
+			t.Errorf("DataSize %d with %d bytes: %d bytes written", packet.DataSize, len(packet.Data), stream.Len())
+		}
+	}
+}
+
+func TestEncodeRejectsOverflowingFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		overflow func(packet *Packet)
+	}{
+		{"packet type", func(packet *Packet) { packet.PacketType = math.MaxUint8 + 1 }},
+		{"processing time", func(packet *Packet) { packet.ProcessingTime = math.MaxUint32 + 1 }},
+		{"stream ID", func(packet *Packet) { packet.StreamID = MaxStreamID + 1 }},
+	}
+	for _, test := range tests {
+		packet := InitPacket(PacketRecord, 1, 2, 3, 4)
+		packet.SetData([]byte{1, 2, 3, 4})
+		test.overflow(packet)
+		var stream bytes.Buffer
+		if err := packet.Encode(&stream); !errors.Is(err, ErrBadField) {
+			t.Errorf("%s: Encode got %v, want %v", test.name, err, ErrBadField)
+		}
+		if stream.Len() != 0 {
+			t.Errorf("%s: %d bytes written", test.name, stream.Len())
+		}
+		if datagram, err := packet.AppendDatagram(nil); !errors.Is(err, ErrBadField) || len(datagram) != 0 {
+			t.Errorf("%s: AppendDatagram got %d bytes and %v, want %v", test.name, len(datagram), err, ErrBadField)
+		}
+	}
+}
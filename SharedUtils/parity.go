@@ -0,0 +1,223 @@
+package sharedutils
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ErrBadParityBlock is returned for parity blocks of less than 2 or more than MaxParityBlock packets
+var ErrBadParityBlock = fmt.Errorf("sharedutils: parity blocks protect 2 to %d packets", MaxParityBlock)
+
+const (
+	MaxParityBlock   = 32  // MaxParityBlock - The most packets one parity packet protects
+	parityHeaderSize = 16  // parityHeaderSize - Block size, XOR of the types, lengths, init times and processing times
+	parityHistory    = 256 // parityHistory - Packets and parity packets further behind are forgotten by the decoder
+)
+
+// ParityEncoder protects blocks of consecutive packets with XOR parity packets.
+// The parity packet of a block has the serial of its first packet and can rebuild any single missing packet of it
+type ParityEncoder struct {
+	size     int
+	maxSize  int // The largest data of a parity packet, blocks whose parity is larger are left without
+	count    int
+	base     uint32
+	tooLarge bool
+	header   [parityHeaderSize]byte
+	payload  [DataFrameSize - parityHeaderSize]byte
+	length   int
+}
+
+// NewParityEncoder creates an encoder that emits a parity packet after every size packets
+func NewParityEncoder(size int) (*ParityEncoder, error) {
+	if size < 2 || size > MaxParityBlock {
+		return nil, fmt.Errorf("%w, not %d", ErrBadParityBlock, size)
+	}
+	return &ParityEncoder{size: size, maxSize: DataFrameSize}, nil
+}
+
+// SetMaxSize limits the data of the parity packets, to the MaxDataSize of a link with an MTU
+func (encoder *ParityEncoder) SetMaxSize(size int) {
+	encoder.maxSize = min(size, DataFrameSize)
+}
+
+// Add adds a packet, as it is sent, to the current block and returns the parity packet when the block is complete, nil otherwise.
+// A block with a packet too large to protect is left without parity
+func (encoder *ParityEncoder) Add(packet *Packet) *Packet {
+	if encoder.count > 0 && packet.SerialNumber != encoder.base+uint32(encoder.count) {
+		encoder.count = 0 // The serials of a block are implied by its first one, start over after a gap
+	}
+	if encoder.count == 0 {
+		encoder.base, encoder.tooLarge, encoder.length = packet.SerialNumber, false, 0
+		encoder.header = [parityHeaderSize]byte{}
+		encoder.payload = [DataFrameSize - parityHeaderSize]byte{}
+	}
+	encoder.count++
+
+	data := packet.Data[:packet.DataSize]
+	if len(data) > len(encoder.payload) || parityHeaderSize+len(data) > encoder.maxSize {
+		encoder.tooLarge = true
+	} else {
+		xorParityHeader(encoder.header[:], packet)
+		xorBytes(encoder.payload[:], data)
+		encoder.length = max(encoder.length, len(data))
+	}
+	if encoder.count < encoder.size {
+		return nil
+	}
+
+	encoder.count = 0
+	if encoder.tooLarge {
+		return nil
+	}
+	encoder.header[0] = uint8(encoder.size)
+	data = make([]byte, parityHeaderSize+encoder.length)
+	copy(data, encoder.header[:])
+	copy(data[parityHeaderSize:], encoder.payload[:encoder.length])
+	parity := InitPacket(PacketParity, int(encoder.base), int64(packet.InitTime), 0, len(data))
+	parity.SetData(data)
+	return parity
+}
+
+// xorParityHeader folds the fields of a packet into the header of a parity packet, the block size in byte 0 is left alone
+func xorParityHeader(header []byte, packet *Packet) {
+	header[1] ^= uint8(packet.PacketType)
+	binary.LittleEndian.PutUint16(header[2:], binary.LittleEndian.Uint16(header[2:])^uint16(packet.DataSize))
+	binary.LittleEndian.PutUint64(header[4:], binary.LittleEndian.Uint64(header[4:])^packet.InitTime)
+	binary.LittleEndian.PutUint32(header[12:], binary.LittleEndian.Uint32(header[12:])^uint32(packet.ProcessingTime))
+}
+
+func xorBytes(dst, src []byte) {
+	for i, b := range src {
+		dst[i] ^= b
+	}
+}
+
+// ParityDecoder rebuilds single missing packets of the blocks protected by parity packets.
+// Every packet of the stream goes through it, so packets that arrive after being rebuilt are dropped as duplicates
+type ParityDecoder struct {
+	delivered serialWindow
+	received  map[uint32]*Packet
+	parities  map[uint32]*Packet // By the serial of the first packet of their block
+	started   bool
+	highest   uint32
+	recovered uint64
+}
+
+// NewParityDecoder creates a decoder with no packets
+func NewParityDecoder() *ParityDecoder {
+	return &ParityDecoder{
+		received: make(map[uint32]*Packet),
+		parities: make(map[uint32]*Packet),
+	}
+}
+
+// Decode takes a received packet or parity packet and returns the packets to deliver, in the same way as
+// RedundancyDecoder.Decode: the first ones of them were rebuilt, as many as the count returned
+func (decoder *ParityDecoder) Decode(packet *Packet) ([]*Packet, int, error) {
+	var frames []*Packet
+	if packet.PacketType == PacketParity {
+		if packet.DataSize < parityHeaderSize || packet.Data[0] < 2 || packet.Data[0] > MaxParityBlock {
+			return nil, 0, fmt.Errorf("%w: bad parity packet", ErrBadHeader)
+		}
+		decoder.parities[packet.SerialNumber] = packet
+		decoder.advance(packet.SerialNumber)
+		if rebuilt := decoder.recover(packet.SerialNumber); rebuilt != nil {
+			frames = append(frames, rebuilt)
+		}
+		return frames, len(frames), nil
+	}
+
+	if !decoder.delivered.check(packet.SerialNumber) {
+		return nil, 0, nil
+	}
+	decoder.delivered.mark(packet.SerialNumber)
+	decoder.received[packet.SerialNumber] = packet
+	decoder.advance(packet.SerialNumber)
+	for base, parity := range decoder.parities {
+		if packet.SerialNumber-base < uint32(parity.Data[0]) {
+			if rebuilt := decoder.recover(base); rebuilt != nil {
+				frames = append(frames, rebuilt)
+			}
+		}
+	}
+	return append(frames, packet), len(frames), nil
+}
+
+// recover rebuilds the packet of a block when it is the only one missing
+func (decoder *ParityDecoder) recover(base uint32) *Packet {
+	parity := decoder.parities[base]
+	data := parity.Data[:parity.DataSize]
+	size := uint32(data[0])
+
+	missing, missingCount := uint32(0), 0
+	for serial := base; serial != base+size; serial++ {
+		if _, ok := decoder.received[serial]; !ok {
+			missing = serial
+			missingCount++
+		}
+	}
+	if missingCount != 1 {
+		if missingCount == 0 {
+			delete(decoder.parities, base)
+		}
+		return nil
+	}
+
+	header := make([]byte, parityHeaderSize)
+	copy(header, data[:parityHeaderSize])
+	payload := append([]byte(nil), data[parityHeaderSize:]...)
+	for serial := base; serial != base+size; serial++ {
+		if packet, ok := decoder.received[serial]; ok {
+			xorParityHeader(header, packet)
+			xorBytes(payload, packet.Data[:packet.DataSize])
+		}
+	}
+	length := int(binary.LittleEndian.Uint16(header[2:]))
+	if length > len(payload) {
+		delete(decoder.parities, base)
+		return nil // The block did not match the parity
+	}
+
+	rebuilt := &Packet{
+		PacketType:     uint32(header[1]),
+		SerialNumber:   missing,
+		InitTime:       binary.LittleEndian.Uint64(header[4:]),
+		ProcessingTime: uint64(binary.LittleEndian.Uint32(header[12:])),
+		ServerReceive:  parity.ServerReceive,
+		ServerTransmit: parity.ServerTransmit,
+		StreamID:       parity.StreamID,
+		DataSize:       uint32(length),
+		Data:           payload[:length],
+	}
+	delete(decoder.parities, base)
+	decoder.received[missing] = rebuilt
+	if !decoder.delivered.check(missing) {
+		return nil // Too late to be played
+	}
+	decoder.delivered.mark(missing)
+	decoder.recovered++
+	return rebuilt
+}
+
+// advance forgets the packets and parity packets too far behind the highest serial
+func (decoder *ParityDecoder) advance(serial uint32) {
+	if decoder.started && int32(serial-decoder.highest) <= 0 {
+		return
+	}
+	decoder.started, decoder.highest = true, serial
+	for old := range decoder.received {
+		if int32(serial-old) > parityHistory {
+			delete(decoder.received, old)
+		}
+	}
+	for old := range decoder.parities {
+		if int32(serial-old) > parityHistory {
+			delete(decoder.parities, old)
+		}
+	}
+}
+
+// Recovered returns the number of packets rebuilt so far
+func (decoder *ParityDecoder) Recovered() uint64 {
+	return decoder.recovered
+}
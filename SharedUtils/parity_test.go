@@ -0,0 +1,96 @@
+package sharedutils
+
+import (
+	"errors"
+	"testing"
+)
+
+// parityBlock returns the packets of a block of the size from serial 10, of different lengths, and their parity packet
+func parityBlock(t *testing.T, size int) ([]*Packet, *Packet) {
+	t.Helper()
+	encoder, err := NewParityEncoder(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packets []*Packet
+	var parity *Packet
+	for i := 0; i < size; i++ {
+		packet := redFrame(10+i, 20+5*i)
+		packet.ProcessingTime = uint64(100 + i)
+		packets = append(packets, packet)
+		if parity = encoder.Add(packet); parity != nil && i < size-1 {
+			t.Fatalf("got a parity packet after %d packets of a block of %d", i+1, size)
+		}
+	}
+	if parity == nil || parity.SerialNumber != 10 {
+		t.Fatalf("got parity packet %v, want one with the serial of the first packet", parity)
+	}
+	return packets, parity
+}
+
+func TestParityRebuildsMissingPacket(t *testing.T) {
+	for _, parityFirst := range []bool{false, true} {
+		packets, parity := parityBlock(t, 4)
+		decoder := NewParityDecoder()
+		var delivered []*Packet
+		decode := func(packet *Packet) {
+			frames, _, err := decoder.Decode(packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			delivered = append(delivered, frames...)
+		}
+		if parityFirst {
+			decode(parity)
+		}
+		for i, packet := range packets {
+			if i != 2 { // Lost
+				decode(packet)
+			}
+		}
+		if !parityFirst {
+			decode(parity)
+		}
+		if decoder.Recovered() != 1 {
+			t.Errorf("parity first %v: %d packets recovered, want 1", parityFirst, decoder.Recovered())
+		}
+		rebuilt := false
+		for _, frame := range delivered {
+			if frame.SerialNumber == packets[2].SerialNumber {
+				rebuilt = samePacket(frame, packets[2])
+			}
+		}
+		if len(delivered) != len(packets) || !rebuilt {
+			t.Errorf("parity first %v: got %d packets, the lost one rebuilt %v", parityFirst, len(delivered), rebuilt)
+		}
+		// The lost packet arriving late is a duplicate
+		if frames, _, err := decoder.Decode(packets[2]); err != nil || len(frames) != 0 {
+			t.Errorf("parity first %v: the late packet got %d frames (%v), want none", parityFirst, len(frames), err)
+		}
+	}
+}
+
+func TestParityGivesUpOnTwoMissingPackets(t *testing.T) {
+	packets, parity := parityBlock(t, 4)
+	decoder := NewParityDecoder()
+	for _, packet := range []*Packet{packets[0], packets[3], parity} {
+		frames, recovered, err := decoder.Decode(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recovered != 0 {
+			t.Fatalf("rebuilt %d packets of a block missing two: %v", recovered, frames)
+		}
+	}
+	if decoder.Recovered() != 0 {
+		t.Errorf("%d packets recovered, want none", decoder.Recovered())
+	}
+}
+
+func TestParityBlockSize(t *testing.T) {
+	for _, size := range []int{0, 1, MaxParityBlock + 1} {
+		if _, err := NewParityEncoder(size); !errors.Is(err, ErrBadParityBlock) {
+			t.Errorf("block of %d: got %v, want %v", size, err, ErrBadParityBlock)
+		}
+	}
+}
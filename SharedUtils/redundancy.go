@@ -0,0 +1,174 @@
+package sharedutils
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	RedPayloadType     = 100 // RedPayloadType - The dynamic RTP payload type (96-127) of redundant audio (RFC 2198), other than Opus
+	MaxRedundancy      = 2   // MaxRedundancy - The most previous frames a packet carries
+	redBlockHeaderSize = 4
+	redMaxOffset       = 1<<14 - 1 // redMaxOffset - The timestamp offset field is 14 bits of RTP ticks
+	redMaxLength       = 1<<10 - 1 // redMaxLength - The block length field is 10 bits
+)
+
+// redundantFrame is a frame kept by the encoder to be sent again in the next packets
+type redundantFrame struct {
+	serial   uint32
+	initTime uint64
+	data     []byte
+}
+
+// RedundancyEncoder turns PacketRecord packets into PacketRedundant packets that also carry
+// the previous frames of the stream, in the payload format of RFC 2198
+type RedundancyEncoder struct {
+	depth   int
+	maxSize int              // The largest data of a packet, previous frames are left out beyond it
+	history []redundantFrame // The last depth frames, oldest first
+}
+
+// NewRedundancyEncoder creates an encoder that repeats each frame in the next depth packets
+func NewRedundancyEncoder(depth int) *RedundancyEncoder {
+	return &RedundancyEncoder{depth: max(0, min(depth, MaxRedundancy)), maxSize: DataFrameSize}
+}
+
+// SetMaxSize limits the data of the packets, to the MaxDataSize of a link with an MTU
+func (encoder *RedundancyEncoder) SetMaxSize(size int) {
+	encoder.maxSize = min(size, DataFrameSize)
+}
+
+// Encode returns a PacketRedundant packet holding the previous frames followed by the frame of the packet.
+// Previous frames that do not fit in a packet, or are not consecutive to it, are left out
+func (encoder *RedundancyEncoder) Encode(packet *Packet) *Packet {
+	primary := packet.Data[:packet.DataSize]
+	blocks := encoder.blocks(packet)
+	size := 1 + len(primary)
+	for len(blocks) > 0 {
+		size = 1 + len(primary)
+		for _, block := range blocks {
+			size += redBlockHeaderSize + len(block.data)
+		}
+		if size <= encoder.maxSize {
+			break
+		}
+		blocks = blocks[1:] // Drop the oldest frame
+	}
+
+	data := make([]byte, 0, size)
+	for _, block := range blocks {
+		offset := RTPTimestamp(packet.InitTime) - RTPTimestamp(block.initTime)
+		data = binary.BigEndian.AppendUint32(data, 1<<31|OpusPayloadType<<24|offset<<10|uint32(len(block.data)))
+	}
+	data = append(data, OpusPayloadType)
+	for _, block := range blocks {
+		data = append(data, block.data...)
+	}
+	data = append(data, primary...)
+
+	encoder.remember(packet)
+	redundant := *packet
+	redundant.PacketType = PacketRedundant
+	redundant.DataSize = uint32(len(data))
+	redundant.Data = data
+	return &redundant
+}
+
+// blocks returns the frames of the history that can be sent with the packet, oldest first
+func (encoder *RedundancyEncoder) blocks(packet *Packet) []redundantFrame {
+	var blocks []redundantFrame
+	for i, frame := range encoder.history {
+		distance := uint32(len(encoder.history) - i)
+		offset := RTPTimestamp(packet.InitTime) - RTPTimestamp(frame.initTime)
+		if frame.serial+distance != packet.SerialNumber || offset > redMaxOffset || len(frame.data) > redMaxLength {
+			blocks = blocks[:0] // The serial of a block is implied by its position, it must be consecutive
+			continue
+		}
+		blocks = append(blocks, frame)
+	}
+	return blocks
+}
+
+func (encoder *RedundancyEncoder) remember(packet *Packet) {
+	if encoder.depth == 0 {
+		return
+	}
+	frame := redundantFrame{
+		serial:   packet.SerialNumber,
+		initTime: packet.InitTime,
+		data:     append([]byte(nil), packet.Data[:packet.DataSize]...),
+	}
+	encoder.history = append(encoder.history, frame)
+	if len(encoder.history) > encoder.depth {
+		encoder.history = encoder.history[1:]
+	}
+}
+
+// RedundancyDecoder turns PacketRedundant packets back into PacketRecord packets,
+// recovering the frames of lost packets from the redundancy carried by later ones
+type RedundancyDecoder struct {
+	delivered serialWindow
+	recovered uint64
+}
+
+// Decode returns the frames of a PacketRedundant packet that were not delivered yet, in serial order,
+// and how many of them were recovered from redundancy. The frames refer to the data of the packet
+func (decoder *RedundancyDecoder) Decode(packet *Packet) ([]*Packet, int, error) {
+	payload := packet.Data[:packet.DataSize]
+	var lengths []int
+	var offsets []uint32
+	for {
+		if len(payload) == 0 {
+			return nil, 0, fmt.Errorf("%w: truncated redundant payload", ErrBadHeader)
+		}
+		if payload[0]&0x80 == 0 {
+			payload = payload[1:]
+			break
+		}
+		if len(payload) < redBlockHeaderSize {
+			return nil, 0, fmt.Errorf("%w: truncated redundant block header", ErrBadHeader)
+		}
+		header := binary.BigEndian.Uint32(payload)
+		offsets = append(offsets, header>>10&redMaxOffset)
+		lengths = append(lengths, int(header&redMaxLength))
+		payload = payload[redBlockHeaderSize:]
+	}
+
+	var frames []*Packet
+	recovered := 0
+	for i, length := range lengths {
+		if length > len(payload) {
+			return nil, 0, fmt.Errorf("%w: truncated redundant block", ErrBadHeader)
+		}
+		serial := packet.SerialNumber - uint32(len(lengths)-i)
+		if decoder.delivered.check(serial) {
+			decoder.delivered.mark(serial)
+			frame := *packet
+			frame.PacketType = PacketRecord
+			frame.SerialNumber = serial
+			frame.InitTime = packet.InitTime - uint64(offsets[i])*rtpMicrosPerMilli/rtpTicksPerMilli
+			frame.ProcessingTime = 0
+			frame.DataSize = uint32(length)
+			frame.Data = payload[:length:length]
+			frames = append(frames, &frame)
+			recovered++
+		}
+		payload = payload[length:]
+	}
+
+	if decoder.delivered.check(packet.SerialNumber) {
+		decoder.delivered.mark(packet.SerialNumber)
+		frame := *packet
+		frame.PacketType = PacketRecord
+		frame.DataSize = uint32(len(payload))
+		frame.Data = payload
+		frames = append(frames, &frame)
+	}
+	decoder.recovered += uint64(recovered)
+	return frames, recovered, nil
+}
+
+// Recovered returns the number of frames recovered from redundancy so far
+func (decoder *RedundancyDecoder) Recovered() uint64 {
+	return decoder.recovered
+}
@@ -0,0 +1,124 @@
+package sharedutils
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+const redFrameInterval = 10000 // Microseconds between the frames of the tests
+
+// redFrame returns the PacketRecord packet of the serial, with data of the size that tells the frames apart
+func redFrame(serial int, size int) *Packet {
+	packet := InitPacket(PacketRecord, serial, int64(1718000000000000+serial*redFrameInterval), 0, size)
+	packet.SetData(bytes.Repeat([]byte{byte(serial)}, size))
+	return packet
+}
+
+func TestRedundancyRoundTrip(t *testing.T) {
+	encoder := NewRedundancyEncoder(MaxRedundancy)
+	var decoder RedundancyDecoder
+	for serial := 1; serial <= 5; serial++ {
+		frame := redFrame(serial, 20)
+		redundant := encoder.Encode(frame)
+		if redundant.PacketType != PacketRedundant {
+			t.Fatalf("serial %d: got packet type %d, want %d", serial, redundant.PacketType, PacketRedundant)
+		}
+		if blocks := min(serial-1, MaxRedundancy); int(redundant.DataSize) != 1+20+blocks*(redBlockHeaderSize+20) {
+			t.Errorf("serial %d: got %d bytes, want %d blocks before the frame", serial, redundant.DataSize, blocks)
+		}
+		frames, recovered, err := decoder.Decode(redundant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frames) != 1 || recovered != 0 || !samePacket(frames[0], frame) {
+			t.Fatalf("serial %d: got %d frames, %d recovered, want the frame alone", serial, len(frames), recovered)
+		}
+	}
+}
+
+func TestRedundancyRecoversLostPackets(t *testing.T) {
+	encoder := NewRedundancyEncoder(MaxRedundancy)
+	var decoder RedundancyDecoder
+	var sent []*Packet
+	for serial := 1; serial <= 4; serial++ {
+		sent = append(sent, redFrame(serial, 10+serial))
+	}
+	var redundant []*Packet
+	for _, frame := range sent {
+		redundant = append(redundant, encoder.Encode(frame))
+	}
+	if _, _, err := decoder.Decode(redundant[0]); err != nil {
+		t.Fatal(err)
+	}
+	// The packets of serials 2 and 3 are lost, the packet of serial 4 carries their frames
+	frames, recovered, err := decoder.Decode(redundant[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 3 || recovered != 2 || decoder.Recovered() != 2 {
+		t.Fatalf("got %d frames, %d recovered, want 3 frames and 2 recovered", len(frames), recovered)
+	}
+	for i, frame := range frames {
+		want := *sent[i+1]
+		if i < 2 {
+			want.ProcessingTime = 0 // The processing time of a previous frame is not carried
+		}
+		if !samePacket(frame, &want) {
+			t.Errorf("frame %d: got serial %d at %d, want serial %d at %d", i, frame.SerialNumber, frame.InitTime, want.SerialNumber, want.InitTime)
+		}
+	}
+	// A late copy of a recovered packet delivers nothing again
+	if frames, _, err := decoder.Decode(redundant[2]); err != nil || len(frames) != 0 {
+		t.Errorf("a late packet got %d frames (%v), want none", len(frames), err)
+	}
+}
+
+func TestRedundancyLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		first   *Packet
+		maxSize int
+		blocks  int
+	}{
+		{"a previous frame", redFrame(1, 100), DataFrameSize, 1},
+		{"a frame longer than the block length field", redFrame(1, redMaxLength+1), DataFrameSize, 0},
+		{"a packet that would exceed the max size", redFrame(1, 100), 1 + 100 + redBlockHeaderSize + 99, 0},
+		{"a frame older than the offset field", InitPacket(PacketRecord, 1, 1718000000000000-redMaxOffset*rtpMicrosPerMilli/rtpTicksPerMilli, 0, 0), DataFrameSize, 0},
+		{"a frame that is not consecutive", redFrame(0, 100), DataFrameSize, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoder := NewRedundancyEncoder(MaxRedundancy)
+			encoder.SetMaxSize(test.maxSize)
+			encoder.Encode(test.first)
+			redundant := encoder.Encode(redFrame(2, 100))
+			if redundant.DataSize > uint32(test.maxSize) {
+				t.Errorf("got %d bytes over the max size of %d", redundant.DataSize, test.maxSize)
+			}
+			var decoder RedundancyDecoder
+			frames, recovered, err := decoder.Decode(redundant)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recovered != test.blocks || len(frames) != test.blocks+1 {
+				t.Errorf("got %d frames, %d recovered, want %d blocks", len(frames), recovered, test.blocks)
+			}
+		})
+	}
+}
+
+func TestRedundancyDecodeErrors(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,                         // No primary header
+		{0x80 | OpusPayloadType, 0}, // Truncated block header
+		{0x80 | OpusPayloadType, 0, 0, 10, OpusPayloadType, 1, 2}, // Block longer than the payload
+	} {
+		packet := InitPacket(PacketRedundant, 1, 0, 0, len(data))
+		packet.SetData(data)
+		var decoder RedundancyDecoder
+		if _, _, err := decoder.Decode(packet); !errors.Is(err, ErrBadHeader) {
+			t.Errorf("decoding %v: got %v, want %v", data, err, ErrBadHeader)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package sharedutils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	MaxRendezvousToken   = 64                     // MaxRendezvousToken - The longest token two peers can meet with, in bytes
+	RendezvousRetry      = 500 * time.Millisecond // RendezvousRetry - Between the requests a client sends the server while its peer is not there
+	RendezvousTimeout    = time.Minute            // RendezvousTimeout - How long a client waits at the server for its peer
+	PunchInterval        = 50 * time.Millisecond  // PunchInterval - Between the punches sent to the peer
+	PunchTimeout         = 3 * time.Second        // PunchTimeout - How long the peers punch before they fall back to relaying through the server
+	punchConfirmations   = 5                      // punchConfirmations - Punches sent once the hole is open, so the peer learns it even when some are lost
+	relayRequestAttempts = 5                      // relayRequestAttempts - Relay requests sent before the server is given up on
+)
+
+var (
+	// ErrRendezvousTimeout is returned when the peer did not come to the rendezvous or the server did not answer
+	ErrRendezvousTimeout = errors.New("sharedutils: the peer did not come to the rendezvous")
+	// ErrBadToken is returned for rendezvous tokens that are empty or longer than MaxRendezvousToken
+	ErrBadToken = errors.New("sharedutils: bad rendezvous token")
+)
+
+// PeerPath is how a client reaches its peer after a rendezvous
+type PeerPath int
+
+const (
+	PathDirect  PeerPath = iota // PathDirect - Through the holes punched in both NATs
+	PathRelayed                 // PathRelayed - Through the server, the NATs would not let the punches through
+)
+
+func (path PeerPath) String() string {
+	if path == PathRelayed {
+		return "relayed through the server"
+	}
+	return "direct"
+}
+
+// RendezvousPacket creates the request a client sends the server to meet the peer that gives the same token
+func RendezvousPacket(token string) *Packet {
+	packet := InitPacket(PacketRendezvous, 0, time.Now().UnixMicro(), 0, len(token))
+	packet.SetData([]byte(token))
+	return packet
+}
+
+// PeerAddressPacket creates the answer of the server to a rendezvous request, the public address of the peer
+func PeerAddressPacket(address net.Addr) *Packet {
+	packet := InitPacket(PacketPeerAddress, 0, time.Now().UnixMicro(), 0, len(address.String()))
+	packet.SetData([]byte(address.String()))
+	return packet
+}
+
+// RelayPacket creates the request of a client to relay its packets to the peer it met with the token
+func RelayPacket(token string) *Packet {
+	packet := InitPacket(PacketRelay, 0, time.Now().UnixMicro(), 0, len(token))
+	packet.SetData([]byte(token))
+	return packet
+}
+
+// punchPacket creates a punch, heard tells the peer its own punches get through
+func punchPacket(serialNumber int, token string, heard bool) *Packet {
+	data := append([]byte{0}, token...)
+	if heard {
+		data[0] = 1
+	}
+	packet := InitPacket(PacketPunch, serialNumber, time.Now().UnixMicro(), 0, len(data))
+	packet.SetData(data)
+	return packet
+}
+
+// RendezvousToken returns the token of a rendezvous or relay request
+func (packet *Packet) RendezvousToken() (string, error) {
+	if packet.DataSize == 0 || packet.DataSize > MaxRendezvousToken {
+		return "", ErrBadToken
+	}
+	return string(packet.Data[:packet.DataSize]), nil
+}
+
+// isRendezvousPacket reports whether the datagram is a packet of the rendezvous itself, not meant for the application
+func isRendezvousPacket(buf []byte) bool {
+	var packet Packet
+	if packet.decodeHeader(buf) != nil {
+		return false
+	}
+	switch packet.PacketType {
+	case PacketRendezvous, PacketPeerAddress, PacketPunch, PacketRelay:
+		return true
+	}
+	return false
+}
+
+// Rendezvous meets the peer that gives the same token at the server and punches a hole through the NATs of both
+// peers: each sends punches to the public address the server saw for the other until it hears that its own got
+// through. A punch coming from another address than the server saw, a NAT that maps every destination to a new
+// port, makes it the address of the peer. When punching fails for PunchTimeout the server relays instead.
+// The returned connection exchanges the datagrams of the application with the peer over the socket, which it owns
+func Rendezvous(conn net.PacketConn, server net.Addr, token string) (Conn, PeerPath, error) {
+	if len(token) == 0 || len(token) > MaxRendezvousToken {
+		return nil, PathDirect, ErrBadToken
+	}
+	peer, err := meetPeer(conn, server, token)
+	if err != nil {
+		return nil, PathDirect, err
+	}
+	if peer, err = punchHole(conn, peer, token); err != nil {
+		return nil, PathDirect, err
+	}
+	if peer != nil {
+		return &peerConn{conn: conn, peer: peer}, PathDirect, nil
+	}
+	if err = requestRelay(conn, server, token); err != nil {
+		return nil, PathRelayed, err
+	}
+	return &peerConn{conn: conn, peer: server}, PathRelayed, nil
+}
+
+// meetPeer asks the server for the address of the peer until the peer is there too
+func meetPeer(conn net.PacketConn, server net.Addr, token string) (net.Addr, error) {
+	deadline := time.Now().Add(RendezvousTimeout)
+	for time.Now().Before(deadline) {
+		if err := RendezvousPacket(token).SendTo(conn, server); err != nil {
+			return nil, err
+		}
+		reply, err := receiveUntil(conn, time.Now().Add(RendezvousRetry), func(reply *Packet, from net.Addr) bool {
+			return from.String() == server.String() && reply.PacketType == PacketPeerAddress
+		})
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return net.ResolveUDPAddr("udp", string(reply.Data[:reply.DataSize]))
+	}
+	return nil, ErrRendezvousTimeout
+}
+
+// punchHole punches until the peer hears the punches, nil when it never does
+func punchHole(conn net.PacketConn, peer net.Addr, token string) (net.Addr, error) {
+	deadline := time.Now().Add(PunchTimeout)
+	heard := false
+	for punches := 0; time.Now().Before(deadline); punches++ {
+		if err := punchPacket(punches, token, heard).SendTo(conn, peer); err != nil {
+			return nil, err
+		}
+		var from net.Addr
+		punch, err := receiveUntil(conn, time.Now().Add(PunchInterval), func(reply *Packet, address net.Addr) bool {
+			from = address
+			return reply.PacketType == PacketPunch && reply.DataSize > 0 && string(reply.Data[1:reply.DataSize]) == token
+		})
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		heard, peer = true, from
+		if punch.Data[0] == 1 {
+			for i := 1; i <= punchConfirmations; i++ {
+				punchPacket(punches+i, token, true).SendTo(conn, peer)
+			}
+			return peer, nil
+		}
+	}
+	return nil, nil
+}
+
+// requestRelay asks the server to relay to the peer until it confirms
+func requestRelay(conn net.PacketConn, server net.Addr, token string) error {
+	for attempt := 0; attempt < relayRequestAttempts; attempt++ {
+		if err := RelayPacket(token).SendTo(conn, server); err != nil {
+			return err
+		}
+		_, err := receiveUntil(conn, time.Now().Add(RendezvousRetry), func(reply *Packet, from net.Addr) bool {
+			return from.String() == server.String() && reply.PacketType == PacketRelay
+		})
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: the server does not relay", ErrRendezvousTimeout)
+}
+
+// receiveUntil reads packets until one is wanted or the deadline passes, the others are dropped
+func receiveUntil(conn net.PacketConn, deadline time.Time, wanted func(*Packet, net.Addr) bool) (*Packet, error) {
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		var packet Packet
+		from, err := packet.ReceiveFrom(conn)
+		if errors.Is(err, ErrBadHeader) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if wanted(&packet, from) {
+			return &packet, nil
+		}
+	}
+}
+
+// peerConn is the connection to a peer met at a rendezvous, directly or through the server.
+// Datagrams from other addresses and the late packets of the rendezvous are dropped
+type peerConn struct {
+	conn net.PacketConn
+	peer net.Addr
+}
+
+func (conn *peerConn) Read(b []byte) (int, error) {
+	for {
+		n, from, err := conn.conn.ReadFrom(b)
+		if err != nil {
+			return n, err
+		}
+		if from.String() == conn.peer.String() && !isRendezvousPacket(b[:n]) {
+			return n, nil
+		}
+	}
+}
+
+func (conn *peerConn) Write(b []byte) (int, error) {
+	return conn.conn.WriteTo(b, conn.peer)
+}
+
+func (conn *peerConn) Close() error                       { return conn.conn.Close() }
+func (conn *peerConn) Datagram() bool                     { return true }
+func (conn *peerConn) LocalAddr() net.Addr                { return conn.conn.LocalAddr() }
+func (conn *peerConn) RemoteAddr() net.Addr               { return conn.peer }
+func (conn *peerConn) SetDeadline(t time.Time) error      { return conn.conn.SetDeadline(t) }
+func (conn *peerConn) SetReadDeadline(t time.Time) error  { return conn.conn.SetReadDeadline(t) }
+func (conn *peerConn) SetWriteDeadline(t time.Time) error { return conn.conn.SetWriteDeadline(t) }
+
+// RendezvousPoint pairs the clients of a server that give the same token. It is safe for concurrent use
+type RendezvousPoint struct {
+	mutex   sync.Mutex
+	waiting map[string]Conn // The first client of every token, until the second one comes
+	peers   map[Conn]Conn
+}
+
+// NewRendezvousPoint creates a rendezvous point nobody waits at
+func NewRendezvousPoint() *RendezvousPoint {
+	return &RendezvousPoint{waiting: make(map[string]Conn), peers: make(map[Conn]Conn)}
+}
+
+// Meet returns the peer of the client, nil while the client waits for the second client of the token.
+// A token is used by two clients at a time, a third one waits for the next peer
+func (point *RendezvousPoint) Meet(token string, conn Conn) Conn {
+	point.mutex.Lock()
+	defer point.mutex.Unlock()
+	if peer, ok := point.peers[conn]; ok {
+		return peer
+	}
+	peer, ok := point.waiting[token]
+	if !ok || peer == conn {
+		point.waiting[token] = conn
+		return nil
+	}
+	delete(point.waiting, token)
+	point.peers[conn], point.peers[peer] = peer, conn
+	return peer
+}
+
+// Leave forgets the client, its peer has to meet a new one
+func (point *RendezvousPoint) Leave(conn Conn) {
+	point.mutex.Lock()
+	defer point.mutex.Unlock()
+	for token, waiting := range point.waiting {
+		if waiting == conn {
+			delete(point.waiting, token)
+		}
+	}
+	if peer, ok := point.peers[conn]; ok {
+		delete(point.peers, peer)
+		delete(point.peers, conn)
+	}
+}
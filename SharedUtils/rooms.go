@@ -0,0 +1,243 @@
+package sharedutils
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	MaxRoomName  = 64              // MaxRoomName - The longest room name, in bytes
+	MaxStreamID  = 1<<16 - 1       // MaxStreamID - Stream IDs are 16 bits on the wire, zero is no room
+	JoinTimeout  = 2 * time.Second // JoinTimeout - How long a client waits for the server to answer a Join packet
+	JoinAttempts = 3               // JoinAttempts - Join packets sent before the server is given up on
+	// MaxEndToEndParticipants - The participants of a room encrypted end-to-end, each holds the key of the other
+	MaxEndToEndParticipants = 2
+)
+
+var (
+	// ErrBadRoomName is returned for room names that are empty or longer than MaxRoomName
+	ErrBadRoomName = errors.New("sharedutils: bad room name")
+	// ErrRoomsFull is returned when every stream ID is taken
+	ErrRoomsFull = errors.New("sharedutils: no stream ID left for another participant")
+	// ErrEndToEndRoom is returned when a client joins a room whose participants do not encrypt end-to-end as it does
+	ErrEndToEndRoom = errors.New("sharedutils: either all or none of the participants of a room encrypt end-to-end")
+	// ErrEndToEndRoomFull is returned when a room encrypted end-to-end already has all its participants
+	ErrEndToEndRoomFull = fmt.Errorf("sharedutils: rooms encrypted end-to-end hold %d participants", MaxEndToEndParticipants)
+)
+
+// JoinPacket creates the request of a client to join the room, the server answers with a Join packet of the same
+// InitTime stamped with the stream ID of the client, or a Reject packet, and announces it to the others
+func JoinPacket(serialNumber int, room string) *Packet {
+	return roomPacket(PacketJoin, serialNumber, room, [E2EKeySize]byte{})
+}
+
+// LeavePacket creates the request of a client to leave its room, or the announcement of the server that a participant left
+func LeavePacket(serialNumber int, room string, streamID uint32) *Packet {
+	packet := roomPacket(PacketLeave, serialNumber, room, [E2EKeySize]byte{})
+	packet.StreamID = streamID
+	return packet
+}
+
+// joinAnnouncement creates the Join packet that tells a participant of another one,
+// with the public key the other encrypts end-to-end with
+func joinAnnouncement(serialNumber int, participant *Participant) *Packet {
+	packet := roomPacket(PacketJoin, serialNumber, participant.Room, participant.E2EKey)
+	packet.StreamID = participant.StreamID
+	return packet
+}
+
+// roomPacket creates a Join or Leave packet. The data holds the length of the room name, the name
+// and the end-to-end key of the participant when it has one
+func roomPacket(packetType, serialNumber int, room string, e2eKey [E2EKeySize]byte) *Packet {
+	data := append([]byte{byte(len(room))}, room...)
+	if e2eKey != [E2EKeySize]byte{} {
+		data = append(data, e2eKey[:]...)
+	}
+	packet := InitPacket(packetType, serialNumber, time.Now().UnixMicro(), 0, len(data))
+	packet.SetData(data)
+	return packet
+}
+
+// RoomName returns the room of a Join or Leave packet
+func (packet *Packet) RoomName() (string, error) {
+	data := packet.Data[:packet.DataSize]
+	if len(data) == 0 || data[0] == 0 || data[0] > MaxRoomName || len(data) < 1+int(data[0]) {
+		return "", ErrBadRoomName
+	}
+	return string(data[1 : 1+data[0]]), nil
+}
+
+// RoomE2EKey returns the public key a Join packet announces the participant with, zero when it does not encrypt end-to-end
+func (packet *Packet) RoomE2EKey() [E2EKeySize]byte {
+	var key [E2EKeySize]byte
+	data := packet.Data[:packet.DataSize]
+	if len(data) > 0 && len(data) == 1+int(data[0])+E2EKeySize {
+		copy(key[:], data[1+data[0]:])
+	}
+	return key
+}
+
+// Participant is a client in a room, the server forwards it the streams of the others over its link
+type Participant struct {
+	Room     string
+	StreamID uint32
+	E2EKey   [E2EKeySize]byte // The public key of the client, zero when it does not encrypt end-to-end
+	link     *Link
+}
+
+// EndToEnd reports whether the participant encrypts its frames end-to-end
+func (participant *Participant) EndToEnd() bool {
+	return participant.E2EKey != [E2EKeySize]byte{}
+}
+
+// Rooms tracks which clients of a server are in which room, over any transport. It is safe for concurrent use
+type Rooms struct {
+	mutex        sync.Mutex
+	rooms        map[string]map[uint32]*Participant
+	lastStreamID uint32
+}
+
+// NewRooms creates a server with no rooms
+func NewRooms() *Rooms {
+	return &Rooms{rooms: make(map[string]map[uint32]*Participant)}
+}
+
+// Join puts the client of the link in the room, created by its first participant, under a new stream ID.
+// The others of the room are told with the Join packet of the client, which carries its end-to-end key.
+// A room is encrypted end-to-end by all of its participants or none, and holds MaxEndToEndParticipants when it is
+func (rooms *Rooms) Join(room string, link *Link, e2eKey [E2EKeySize]byte) (*Participant, error) {
+	if room == "" || len(room) > MaxRoomName {
+		return nil, ErrBadRoomName
+	}
+	participant := &Participant{Room: room, E2EKey: e2eKey, link: link}
+	rooms.mutex.Lock()
+	for _, member := range rooms.rooms[room] {
+		if member.EndToEnd() != participant.EndToEnd() {
+			rooms.mutex.Unlock()
+			return nil, ErrEndToEndRoom
+		}
+	}
+	if participant.EndToEnd() && len(rooms.rooms[room]) >= MaxEndToEndParticipants {
+		rooms.mutex.Unlock()
+		return nil, ErrEndToEndRoomFull
+	}
+	streamID, err := rooms.nextStreamID()
+	if err != nil {
+		rooms.mutex.Unlock()
+		return nil, err
+	}
+	participant.StreamID = streamID
+	if rooms.rooms[room] == nil {
+		rooms.rooms[room] = make(map[uint32]*Participant)
+	}
+	rooms.rooms[room][streamID] = participant
+	others := rooms.others(participant)
+	rooms.mutex.Unlock()
+
+	announce(others, func(serialNumber int) *Packet {
+		return joinAnnouncement(serialNumber, participant)
+	})
+	return participant, nil
+}
+
+// Introduce tells the participant of the others of its room with their Join packets, once it got the answer to its
+// own: a participant that encrypts end-to-end learns the key of the other
+func (rooms *Rooms) Introduce(participant *Participant) {
+	rooms.mutex.Lock()
+	others := rooms.others(participant)
+	rooms.mutex.Unlock()
+	for _, other := range others {
+		participant.link.Send(joinAnnouncement(participant.link.NextSerial(), other))
+	}
+}
+
+// nextStreamID returns the stream ID after the last one given that no participant has
+func (rooms *Rooms) nextStreamID() (uint32, error) {
+	for i := 0; i < MaxStreamID; i++ {
+		rooms.lastStreamID = rooms.lastStreamID%MaxStreamID + 1
+		if !rooms.taken(rooms.lastStreamID) {
+			return rooms.lastStreamID, nil
+		}
+	}
+	return 0, ErrRoomsFull
+}
+
+func (rooms *Rooms) taken(streamID uint32) bool {
+	for _, participants := range rooms.rooms {
+		if _, ok := participants[streamID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Leave takes the participant out of its room, the others are told with a Leave packet. An empty room is forgotten
+func (rooms *Rooms) Leave(participant *Participant) {
+	rooms.mutex.Lock()
+	participants := rooms.rooms[participant.Room]
+	if participants[participant.StreamID] != participant {
+		rooms.mutex.Unlock()
+		return // Left already
+	}
+	delete(participants, participant.StreamID)
+	if len(participants) == 0 {
+		delete(rooms.rooms, participant.Room)
+	}
+	others := rooms.others(participant)
+	rooms.mutex.Unlock()
+	announce(others, func(serialNumber int) *Packet {
+		return LeavePacket(serialNumber, participant.Room, participant.StreamID)
+	})
+}
+
+// Members returns the stream IDs in the room
+func (rooms *Rooms) Members(room string) []uint32 {
+	rooms.mutex.Lock()
+	defer rooms.mutex.Unlock()
+	var streamIDs []uint32
+	for streamID := range rooms.rooms[room] {
+		streamIDs = append(streamIDs, streamID)
+	}
+	return streamIDs
+}
+
+// Forward sends a packet of the participant to the others of its room, stamped with its stream ID.
+// It returns how many participants it reached, a participant whose link fails is left to its own session to drop
+func (rooms *Rooms) Forward(participant *Participant, packet *Packet) int {
+	packet.StreamID = participant.StreamID
+	rooms.mutex.Lock()
+	others := rooms.others(participant)
+	rooms.mutex.Unlock()
+	return broadcast(others, packet)
+}
+
+// others returns the participants of the room of the participant but itself. The lock must be held
+func (rooms *Rooms) others(from *Participant) []*Participant {
+	var others []*Participant
+	for streamID, participant := range rooms.rooms[from.Room] {
+		if streamID != from.StreamID {
+			others = append(others, participant)
+		}
+	}
+	return others
+}
+
+// announce sends the participants a control packet made with the next serial of each of their links, outside the lock
+func announce(participants []*Participant, packet func(serialNumber int) *Packet) {
+	for _, participant := range participants {
+		participant.link.Send(packet(participant.link.NextSerial()))
+	}
+}
+
+// broadcast sends the packet to the participants outside the lock, a slow tcp participant does not hold up the rooms
+func broadcast(participants []*Participant, packet *Packet) int {
+	reached := 0
+	for _, participant := range participants {
+		if participant.link.Send(packet) == nil {
+			reached++
+		}
+	}
+	return reached
+}
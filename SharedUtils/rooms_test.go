@@ -0,0 +1,182 @@
+package sharedutils
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// roomLinks returns the links of the server to clients over an in-memory transport, and the links of the clients
+func roomLinks(t *testing.T, count int) (servers, clients []*Link) {
+	transport := NewMemoryTransport(0)
+	ln, err := transport.Listen("studio:7777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	for i := 0; i < count; i++ {
+		accepted := make(chan Conn, 1)
+		go func() { // Dial returns once the listener accepts
+			conn, _ := ln.Accept()
+			accepted <- conn
+		}()
+		conn, err := transport.Dial("studio:7777")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, server := NewLink(conn, WireNative), NewLink(<-accepted, WireNative)
+		t.Cleanup(func() { client.Close(); server.Close() })
+		servers, clients = append(servers, server), append(clients, client)
+	}
+	return servers, clients
+}
+
+// expectRoomPacket checks that the next packet of the link is of the type and the stream, and returns it
+func expectRoomPacket(t *testing.T, link *Link, packetType uint32, streamID uint32) Packet {
+	t.Helper()
+	link.Conn().SetReadDeadline(time.Now().Add(time.Second))
+	var packet Packet
+	if err := link.Receive(&packet); err != nil {
+		t.Fatal(err)
+	}
+	if packet.PacketType != packetType || packet.StreamID != streamID {
+		t.Fatalf("got packet type %d of stream %d, want packet type %d of stream %d", packet.PacketType, packet.StreamID, packetType, streamID)
+	}
+	return packet
+}
+
+func TestRoomsJoinForwardLeave(t *testing.T) {
+	servers, clients := roomLinks(t, 3)
+	rooms := NewRooms()
+	var participants []*Participant
+	for i, link := range servers {
+		participant, err := rooms.Join("jam", link, [E2EKeySize]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, other := range clients[:i] { // The others are told of the new participant
+			expectRoomPacket(t, other, PacketJoin, participant.StreamID)
+		}
+		participants = append(participants, participant)
+	}
+	if participants[0].StreamID == participants[1].StreamID || participants[1].StreamID == participants[2].StreamID {
+		t.Fatalf("participants share a stream ID: %d, %d, %d", participants[0].StreamID, participants[1].StreamID, participants[2].StreamID)
+	}
+	rooms.Introduce(participants[2])
+	introduced := map[uint32]bool{}
+	for range participants[:2] {
+		link := clients[2]
+		link.Conn().SetReadDeadline(time.Now().Add(time.Second))
+		var packet Packet
+		if err := link.Receive(&packet); err != nil || packet.PacketType != PacketJoin {
+			t.Fatalf("got packet type %d (%v) instead of an introduction", packet.PacketType, err)
+		}
+		introduced[packet.StreamID] = true
+	}
+	if !introduced[participants[0].StreamID] || !introduced[participants[1].StreamID] {
+		t.Errorf("introduced to streams %v, want %d and %d", introduced, participants[0].StreamID, participants[1].StreamID)
+	}
+
+	// A packet reaches the others stamped with the stream of its sender
+	record := InitPacket(PacketRecord, 1, time.Now().UnixMicro(), 0, 2)
+	record.SetData([]byte{1, 2})
+	if reached := rooms.Forward(participants[0], record); reached != 2 {
+		t.Errorf("forwarded to %d participants, want 2", reached)
+	}
+	for _, link := range clients[1:] {
+		expectRoomPacket(t, link, PacketRecord, participants[0].StreamID)
+	}
+
+	rooms.Leave(participants[2])
+	rooms.Leave(participants[2]) // Left already, nobody is told again
+	for _, link := range clients[:2] {
+		expectRoomPacket(t, link, PacketLeave, participants[2].StreamID)
+	}
+	if members := rooms.Members("jam"); len(members) != 2 {
+		t.Errorf("got %d members after a leave, want 2", len(members))
+	}
+	if reached := rooms.Forward(participants[1], record); reached != 1 {
+		t.Errorf("forwarded to %d participants after a leave, want 1", reached)
+	}
+	expectRoomPacket(t, clients[0], PacketRecord, participants[1].StreamID)
+	rooms.Leave(participants[0])
+	rooms.Leave(participants[1])
+	if members := rooms.Members("jam"); len(members) != 0 {
+		t.Errorf("got %d members in an empty room", len(members))
+	}
+}
+
+func TestRoomsJoinErrors(t *testing.T) {
+	servers, _ := roomLinks(t, 4)
+	rooms := NewRooms()
+	e2eKey := [E2EKeySize]byte{1}
+	if _, err := rooms.Join("", servers[0], e2eKey); !errors.Is(err, ErrBadRoomName) {
+		t.Errorf("empty room name: got %v, want %v", err, ErrBadRoomName)
+	}
+	for _, link := range servers[:MaxEndToEndParticipants] {
+		if _, err := rooms.Join("duo", link, e2eKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := rooms.Join("duo", servers[2], e2eKey); !errors.Is(err, ErrEndToEndRoomFull) {
+		t.Errorf("joining a full end-to-end room: got %v, want %v", err, ErrEndToEndRoomFull)
+	}
+	if _, err := rooms.Join("duo", servers[3], [E2EKeySize]byte{}); !errors.Is(err, ErrEndToEndRoom) {
+		t.Errorf("joining an end-to-end room without a key: got %v, want %v", err, ErrEndToEndRoom)
+	}
+	if _, err := rooms.Join("jam", servers[2], [E2EKeySize]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rooms.Join("jam", servers[3], e2eKey); !errors.Is(err, ErrEndToEndRoom) {
+		t.Errorf("joining a plain room with a key: got %v, want %v", err, ErrEndToEndRoom)
+	}
+}
+
+func TestRoomPackets(t *testing.T) {
+	keyPair, err := NewE2EKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	participant := &Participant{Room: "jam", StreamID: 3, E2EKey: keyPair.Public}
+	tests := []struct {
+		name   string
+		packet *Packet
+		room   string
+		e2eKey [E2EKeySize]byte
+	}{
+		{"join", JoinPacket(1, "jam"), "jam", [E2EKeySize]byte{}},
+		{"leave", LeavePacket(2, "jam", 3), "jam", [E2EKeySize]byte{}},
+		{"announcement", joinAnnouncement(3, participant), "jam", keyPair.Public},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var decoded Packet
+			if err := decoded.decodeCopy(encodeDatagram(t, test.packet)); err != nil {
+				t.Fatal(err)
+			}
+			if room, err := decoded.RoomName(); room != test.room || err != nil {
+				t.Errorf("got room %q (%v), want %q", room, err, test.room)
+			}
+			if key := decoded.RoomE2EKey(); key != test.e2eKey {
+				t.Errorf("got key %x, want %x", key, test.e2eKey)
+			}
+		})
+	}
+
+	for _, data := range [][]byte{nil, {0}, {4, 'j', 'a', 'm'}, {MaxRoomName + 1}} {
+		packet := InitPacket(PacketJoin, 0, 0, 0, len(data))
+		packet.SetData(data)
+		if _, err := packet.RoomName(); !errors.Is(err, ErrBadRoomName) {
+			t.Errorf("room of %v: got %v, want %v", data, err, ErrBadRoomName)
+		}
+	}
+}
+
+func encodeDatagram(t *testing.T, packet *Packet) []byte {
+	t.Helper()
+	buf, err := packet.AppendDatagram(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
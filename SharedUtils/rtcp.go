@@ -0,0 +1,323 @@
+package sharedutils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	RTCPSenderReport   = 200             // RTCPSenderReport - The packet type of an SR (RFC 3550)
+	RTCPReceiverReport = 201             // RTCPReceiverReport - The packet type of an RR (RFC 3550)
+	RTCPSourceDesc     = 202             // RTCPSourceDesc - The packet type of an SDES (RFC 3550)
+	RTCPInterval       = 2 * time.Second // RTCPInterval - How often reports are sent while audio is flowing
+	rtcpHeaderSize     = 4
+	rtcpSenderInfoSize = 20
+	rtcpBlockSize      = 24
+	rtcpCNAME          = 1
+	ntpEpochOffset     = 2208988800 // ntpEpochOffset - Seconds from 1900 (NTP) to 1970 (Unix)
+)
+
+// ReceptionReport is a report block of an SR or RR, how well a source is received
+type ReceptionReport struct {
+	SSRC             uint32
+	FractionLost     uint8 // Lost fraction since the previous report, in 1/256
+	CumulativeLost   int32
+	HighestSequence  uint32 // Extended highest sequence number received
+	Jitter           uint32 // Interarrival jitter in RTP timestamp units
+	LastSR           uint32 // Middle 32 bits of the NTP time of the last SR received from the source
+	DelaySinceLastSR uint32 // In units of 1/65536 seconds
+}
+
+// RTCPReport is a parsed SR (IsSender) or RR
+type RTCPReport struct {
+	SSRC        uint32
+	IsSender    bool
+	NTPTime     uint64
+	RTPTime     uint32
+	PacketCount uint32
+	OctetCount  uint32
+	Reports     []ReceptionReport
+}
+
+// NTPTime converts a time to the 64 bit NTP format, seconds since 1900 and a binary fraction
+func NTPTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// ntpMiddle is the middle 32 bits of an NTP time, as used by LSR and DLSR
+func ntpMiddle(ntp uint64) uint32 {
+	return uint32(ntp >> 16)
+}
+
+// isRTCP reports whether an RTP version packet is RTCP, told apart by its packet type (RFC 5761)
+func isRTCP(buf []byte) bool {
+	return len(buf) > 1 && buf[1] >= 192 && buf[1] <= 223
+}
+
+// Marshal encodes the report as a compound RTCP packet, an SR or RR followed by an SDES with the CNAME
+func (report *RTCPReport) Marshal(cname string) []byte {
+	packetType, size := RTCPReceiverReport, rtcpHeaderSize+4
+	if report.IsSender {
+		packetType, size = RTCPSenderReport, size+rtcpSenderInfoSize
+	}
+	blocks := report.Reports[:min(len(report.Reports), 31)]
+	size += len(blocks) * rtcpBlockSize
+
+	sdesSize := rtcpHeaderSize + 4 + 2 + len(cname) + 1 // SSRC, CNAME item and the END item
+	sdesSize = (sdesSize + 3) &^ 3
+
+	buf := make([]byte, size+sdesSize)
+	buf[0] = RTPVersion<<6 | byte(len(blocks))
+	buf[1] = byte(packetType)
+	binary.BigEndian.PutUint16(buf[2:], uint16(size/4-1))
+	binary.BigEndian.PutUint32(buf[4:], report.SSRC)
+	offset := 8
+	if report.IsSender {
+		binary.BigEndian.PutUint64(buf[offset:], report.NTPTime)
+		binary.BigEndian.PutUint32(buf[offset+8:], report.RTPTime)
+		binary.BigEndian.PutUint32(buf[offset+12:], report.PacketCount)
+		binary.BigEndian.PutUint32(buf[offset+16:], report.OctetCount)
+		offset += rtcpSenderInfoSize
+	}
+	for _, block := range blocks {
+		binary.BigEndian.PutUint32(buf[offset:], block.SSRC)
+		binary.BigEndian.PutUint32(buf[offset+4:], uint32(block.FractionLost)<<24|uint32(block.CumulativeLost)&0xffffff)
+		binary.BigEndian.PutUint32(buf[offset+8:], block.HighestSequence)
+		binary.BigEndian.PutUint32(buf[offset+12:], block.Jitter)
+		binary.BigEndian.PutUint32(buf[offset+16:], block.LastSR)
+		binary.BigEndian.PutUint32(buf[offset+20:], block.DelaySinceLastSR)
+		offset += rtcpBlockSize
+	}
+
+	sdes := buf[size:]
+	sdes[0] = RTPVersion<<6 | 1
+	sdes[1] = RTCPSourceDesc
+	binary.BigEndian.PutUint16(sdes[2:], uint16(sdesSize/4-1))
+	binary.BigEndian.PutUint32(sdes[4:], report.SSRC)
+	sdes[8] = rtcpCNAME
+	sdes[9] = byte(len(cname))
+	copy(sdes[10:], cname) // The END item and the padding are already zero
+	return buf
+}
+
+// ParseRTCP returns the first SR or RR of a compound RTCP packet, other packet types are skipped
+func ParseRTCP(buf []byte) (RTCPReport, error) {
+	for len(buf) >= rtcpHeaderSize {
+		if buf[0]>>6 != RTPVersion {
+			return RTCPReport{}, fmt.Errorf("%w: bad RTCP version", ErrBadHeader)
+		}
+		packetLen := 4 * (int(binary.BigEndian.Uint16(buf[2:4])) + 1)
+		if packetLen > len(buf) {
+			return RTCPReport{}, fmt.Errorf("%w: truncated RTCP packet", ErrBadHeader)
+		}
+		packet, count := buf[:packetLen], int(buf[0]&0x1f)
+		buf = buf[packetLen:]
+
+		var report RTCPReport
+		offset := 8
+		switch packet[1] {
+		case RTCPSenderReport:
+			report.IsSender = true
+			offset += rtcpSenderInfoSize
+		case RTCPReceiverReport:
+		default:
+			continue
+		}
+		if len(packet) < offset+count*rtcpBlockSize {
+			return RTCPReport{}, fmt.Errorf("%w: truncated RTCP report", ErrBadHeader)
+		}
+		report.SSRC = binary.BigEndian.Uint32(packet[4:])
+		if report.IsSender {
+			report.NTPTime = binary.BigEndian.Uint64(packet[8:])
+			report.RTPTime = binary.BigEndian.Uint32(packet[16:])
+			report.PacketCount = binary.BigEndian.Uint32(packet[20:])
+			report.OctetCount = binary.BigEndian.Uint32(packet[24:])
+		}
+		for i := 0; i < count; i++ {
+			block := packet[offset+i*rtcpBlockSize:]
+			lost := binary.BigEndian.Uint32(block[4:])
+			report.Reports = append(report.Reports, ReceptionReport{
+				SSRC:             binary.BigEndian.Uint32(block[0:]),
+				FractionLost:     uint8(lost >> 24),
+				CumulativeLost:   int32(lost<<8) >> 8, // Sign extend the 24 bit value
+				HighestSequence:  binary.BigEndian.Uint32(block[8:]),
+				Jitter:           binary.BigEndian.Uint32(block[12:]),
+				LastSR:           binary.BigEndian.Uint32(block[16:]),
+				DelaySinceLastSR: binary.BigEndian.Uint32(block[20:]),
+			})
+		}
+		return report, nil
+	}
+	return RTCPReport{}, fmt.Errorf("%w: no SR or RR in RTCP packet", ErrBadHeader)
+}
+
+// RTCPFeedback is the live quality of the session as seen from one end
+type RTCPFeedback struct {
+	Remote ReceptionReport // How the peer receives our stream, from its last report
+	Local  ReceptionReport // How we receive the stream of the peer
+	RTT    time.Duration   // From the LSR and DLSR of the last report of the peer
+}
+
+func (feedback RTCPFeedback) String() string {
+	return fmt.Sprintf("RTCP | Peer receives: lost %5.2f%% (%d total), jitter %6d us | We receive: lost %5.2f%% (%d total), jitter %6d us | RTT %6d us",
+		100*float64(feedback.Remote.FractionLost)/256, feedback.Remote.CumulativeLost, rtpUnitsToMicros(feedback.Remote.Jitter),
+		100*float64(feedback.Local.FractionLost)/256, feedback.Local.CumulativeLost, rtpUnitsToMicros(feedback.Local.Jitter),
+		feedback.RTT.Microseconds())
+}
+
+func rtpUnitsToMicros(units uint32) int64 {
+	return int64(units) * rtpMicrosPerMilli / rtpTicksPerMilli
+}
+
+// RTCPSession keeps the sender and receiver statistics of one end of a session and produces its reports
+type RTCPSession struct {
+	mutex      sync.Mutex
+	ssrc       uint32
+	remoteSSRC uint32
+	cname      string
+
+	sentPackets, sentOctets uint32
+	lastReport              time.Time
+	reports                 int // Reports built, the serial of the next one
+
+	// Reception statistics of the stream of the peer (RFC 3550 A.3 and A.8)
+	sequence                     SequenceTracker
+	expectedPrior, receivedPrior int64
+	jitter                       float64
+	lastTransit                  int64
+
+	lastSR        uint32 // Middle of the NTP time of the last SR of the peer
+	lastSRArrival time.Time
+
+	feedback RTCPFeedback
+}
+
+// NewRTCPSession creates the statistics of an end that sends its stream with the given SSRC
+func NewRTCPSession(ssrc uint32, cname string) *RTCPSession {
+	return &RTCPSession{ssrc: ssrc, cname: cname}
+}
+
+// OnSend counts a media packet sent to the peer
+func (session *RTCPSession) OnSend(packet *Packet) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.sentPackets++
+	session.sentOctets += packet.DataSize
+}
+
+// OnReceive updates the reception statistics with a media packet from the peer
+func (session *RTCPSession) OnReceive(packet *Packet, arrival time.Time) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.sequence.Update(packet.SerialNumber)
+
+	// Interarrival jitter, RFC 3550 A.8, the difference of 32 bit timestamps is taken modulo 2^32
+	transit := int64(int32(RTPTimestamp(uint64(arrival.UnixMicro())) - RTPTimestamp(packet.InitTime)))
+	if session.sequence.Received() > 1 {
+		delta := math.Abs(float64(transit - session.lastTransit))
+		session.jitter += (delta - session.jitter) / 16
+	}
+	session.lastTransit = transit
+}
+
+// ReportDue reports whether RTCPInterval passed since the last report was built
+func (session *RTCPSession) ReportDue(now time.Time) bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return now.Sub(session.lastReport) >= RTCPInterval
+}
+
+// BuildReport returns a PacketRTCP packet holding an SR about our stream with a report block about the stream of the peer
+func (session *RTCPSession) BuildReport(now time.Time) *Packet {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.lastReport = now
+
+	report := RTCPReport{
+		SSRC:        session.ssrc,
+		IsSender:    true,
+		NTPTime:     NTPTime(now),
+		RTPTime:     RTPTimestamp(uint64(now.UnixMicro())),
+		PacketCount: session.sentPackets,
+		OctetCount:  session.sentOctets,
+	}
+	if session.sequence.Received() > 0 {
+		report.Reports = []ReceptionReport{session.receptionReport(now)}
+	}
+
+	data := report.Marshal(session.cname)
+	packet := InitPacket(PacketRTCP, session.reports, now.UnixMicro(), 0, len(data))
+	session.reports++
+	packet.SetData(data)
+	return packet
+}
+
+// receptionReport fills a report block about the stream of the peer (RFC 3550 A.3)
+func (session *RTCPSession) receptionReport(now time.Time) ReceptionReport {
+	expected, received := session.sequence.Expected(), session.sequence.Received()
+	expectedInterval := expected - session.expectedPrior
+	receivedInterval := received - session.receivedPrior
+	session.expectedPrior, session.receivedPrior = expected, received
+
+	var fractionLost uint8
+	if lostInterval := expectedInterval - receivedInterval; expectedInterval > 0 && lostInterval > 0 {
+		fractionLost = uint8(min(lostInterval<<8/expectedInterval, 255))
+	}
+	var delaySinceLastSR uint32
+	if session.lastSR != 0 {
+		delaySinceLastSR = uint32(now.Sub(session.lastSRArrival) * 65536 / time.Second)
+	}
+	block := ReceptionReport{
+		SSRC:             session.remoteSSRC,
+		FractionLost:     fractionLost,
+		CumulativeLost:   int32(max(-1<<23, min(session.sequence.Lost(), 1<<23-1))),
+		HighestSequence:  uint32(session.sequence.Highest()),
+		Jitter:           uint32(session.jitter),
+		LastSR:           session.lastSR,
+		DelaySinceLastSR: delaySinceLastSR,
+	}
+	session.feedback.Local = block
+	return block
+}
+
+// HandleRTCP processes a compound RTCP packet from the peer: the SR is remembered for LSR/DLSR
+// and a report block about our stream updates the feedback and the round trip time
+func (session *RTCPSession) HandleRTCP(data []byte, arrival time.Time) (RTCPFeedback, error) {
+	report, err := ParseRTCP(data)
+	if err != nil {
+		return RTCPFeedback{}, err
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.remoteSSRC = report.SSRC
+	if report.IsSender {
+		session.lastSR = ntpMiddle(report.NTPTime)
+		session.lastSRArrival = arrival
+	}
+	for _, block := range report.Reports {
+		if block.SSRC != session.ssrc {
+			continue
+		}
+		session.feedback.Remote = block
+		if block.LastSR != 0 {
+			// RFC 3550 6.4.1: RTT = A - LSR - DLSR, in units of 1/65536 seconds
+			units := ntpMiddle(NTPTime(arrival)) - block.LastSR - block.DelaySinceLastSR
+			session.feedback.RTT = time.Duration(units) * time.Second / 65536
+		}
+	}
+	return session.feedback, nil
+}
+
+// Feedback returns the latest quality feedback of the session
+func (session *RTCPSession) Feedback() RTCPFeedback {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.feedback
+}
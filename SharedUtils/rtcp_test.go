@@ -0,0 +1,146 @@
+package sharedutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRTCPMarshalParse(t *testing.T) {
+	block := ReceptionReport{SSRC: 0x2222, FractionLost: 25, CumulativeLost: 1, HighestSequence: 1<<16 + 10,
+		Jitter: 42, LastSR: 0xb7052000, DelaySinceLastSR: 0x00054000}
+	tests := []struct {
+		name       string
+		report     RTCPReport
+		packetType byte
+		length     uint16 // In 32 bit words minus one (RFC 3550 6.4.1)
+	}{
+		{"SR", RTCPReport{SSRC: 0x1111, IsSender: true, NTPTime: 0xb7108000_80000000, RTPTime: 48000, PacketCount: 100,
+			OctetCount: 12000, Reports: []ReceptionReport{block}}, RTCPSenderReport, 12},
+		{"SR without blocks", RTCPReport{SSRC: 0x1111, IsSender: true, NTPTime: 1, RTPTime: 2}, RTCPSenderReport, 6},
+		{"RR", RTCPReport{SSRC: 0x1111, Reports: []ReceptionReport{block}}, RTCPReceiverReport, 7},
+		{"RR with a negative loss", RTCPReport{SSRC: 0x1111, Reports: []ReceptionReport{{SSRC: 3, CumulativeLost: -2}}}, RTCPReceiverReport, 7},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := test.report.Marshal("studio")
+			if buf[0] != RTPVersion<<6|byte(len(test.report.Reports)) || buf[1] != test.packetType || binary.BigEndian.Uint16(buf[2:]) != test.length {
+				t.Errorf("got header % x, want type %d, %d blocks and length %d", buf[:4], test.packetType, len(test.report.Reports), test.length)
+			}
+			if sdes := buf[4*(test.length+1):]; sdes[1] != RTCPSourceDesc || len(sdes)%4 != 0 || string(sdes[10:16]) != "studio" {
+				t.Errorf("got SDES % x after the report", sdes)
+			}
+			parsed, err := ParseRTCP(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(parsed, test.report) {
+				t.Errorf("got %+v, want %+v", parsed, test.report)
+			}
+		})
+	}
+}
+
+func TestParseRTCPErrors(t *testing.T) {
+	report := RTCPReport{SSRC: 1, Reports: []ReceptionReport{{SSRC: 2}}}
+	valid := report.Marshal("studio")
+	badVersion := append([]byte(nil), valid...)
+	badVersion[0] = 1<<6 | 1
+	tooManyBlocks := append([]byte(nil), valid...)
+	tooManyBlocks[0] = RTPVersion<<6 | 2
+	sdesOnly := valid[8+rtcpBlockSize:]
+	for name, buf := range map[string][]byte{
+		"bad version":            badVersion,
+		"truncated":              valid[:20],
+		"more blocks than bytes": tooManyBlocks,
+		"no SR or RR":            sdesOnly,
+	} {
+		if _, err := ParseRTCP(buf); !errors.Is(err, ErrBadHeader) {
+			t.Errorf("%s: got %v, want %v", name, err, ErrBadHeader)
+		}
+	}
+}
+
+func TestNTPTime(t *testing.T) {
+	if ntp := NTPTime(time.Unix(0, 0)); ntp != ntpEpochOffset<<32 {
+		t.Errorf("the Unix epoch is NTP %#x, want %#x", ntp, uint64(ntpEpochOffset)<<32)
+	}
+	if ntp := NTPTime(time.Unix(0, int64(time.Second/2))); uint32(ntp) != 0x80000000 {
+		t.Errorf("half a second is the fraction %#x, want 0x80000000", uint32(ntp))
+	}
+}
+
+func TestRTCPRoundTripTime(t *testing.T) {
+	// The example of RFC 3550 6.4.1: A = 0xb710:8000, LSR = 0xb705:2000 and DLSR = 0x0005:4000 give 6.125 s
+	base := time.Unix(1718000000, 0).Unix()
+	seconds := base + (0xb710-(base+ntpEpochOffset))&0xffff
+	arrival := time.Unix(seconds, int64(time.Second/2))
+	if middle := ntpMiddle(NTPTime(arrival)); middle != 0xb7108000 {
+		t.Fatalf("the arrival is %#x, want 0xb7108000", middle)
+	}
+	session := NewRTCPSession(0x1111, "studio")
+	peer := RTCPReport{SSRC: 0x2222, Reports: []ReceptionReport{{SSRC: 0x1111, LastSR: 0xb7052000, DelaySinceLastSR: 0x00054000}}}
+	feedback, err := session.HandleRTCP(peer.Marshal("peer"), arrival)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feedback.RTT != 6125*time.Millisecond {
+		t.Errorf("got RTT %v, want 6.125s", feedback.RTT)
+	}
+
+	// The block of another source does not move it
+	other := RTCPReport{SSRC: 0x2222, Reports: []ReceptionReport{{SSRC: 0x3333, LastSR: 0xb7100000}}}
+	if feedback, err = session.HandleRTCP(other.Marshal("peer"), arrival); err != nil || feedback.RTT != 6125*time.Millisecond {
+		t.Errorf("after a block of another source got RTT %v (%v)", feedback.RTT, err)
+	}
+}
+
+func TestRTCPReceptionReport(t *testing.T) {
+	const (
+		packets   = 10
+		lost      = 5 // The serial that never arrives
+		delta     = 2 * time.Millisecond
+		deltaRTP  = 2 * rtpTicksPerMilli
+		frameTime = 20000
+	)
+	tests := []struct {
+		name   string
+		jitter func(arrived int) time.Duration // Added to the transit of the packet, by the count of the packets before it
+		want   uint32
+	}{
+		{"constant transit", func(int) time.Duration { return 0 }, 0},
+		// Every transit differs by delta from the one before: J = D * (1 - (15/16)^n) after n differences (RFC 3550 A.8)
+		{"alternating transit", func(arrived int) time.Duration { return time.Duration(arrived%2) * delta },
+			uint32(deltaRTP * (1 - math.Pow(15.0/16, packets-2)))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session := NewRTCPSession(0x1111, "studio")
+			start, arrived := uint64(1718000000000000), 0
+			for serial := 1; serial <= packets; serial++ {
+				if serial == lost {
+					continue
+				}
+				packet := InitPacket(PacketRecord, serial, int64(start)+int64(serial*frameTime), 0, 0)
+				arrival := time.UnixMicro(int64(packet.InitTime)).Add(10*time.Millisecond + test.jitter(arrived))
+				session.OnReceive(packet, arrival)
+				arrived++
+			}
+			report, err := ParseRTCP(session.BuildReport(time.Now()).Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block := report.Reports[0]
+			if block.Jitter != test.want {
+				t.Errorf("got jitter %d, want %d", block.Jitter, test.want)
+			}
+			// One lost of the ten expected from 1 to 10 (RFC 3550 A.3)
+			if block.HighestSequence != packets || block.CumulativeLost != 1 || block.FractionLost != 256/packets {
+				t.Errorf("got highest %d, lost %d, fraction %d, want %d, 1, %d", block.HighestSequence, block.CumulativeLost, block.FractionLost, packets, 256/packets)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package sharedutils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"slices"
+	"time"
+)
+
+const (
+	RTPVersion        = 2     // RTPVersion - The version field of RFC 3550
+	RTPHeaderSize     = 12    // RTPHeaderSize - The fixed RTP header, without CSRCs and extensions
+	OpusPayloadType   = 111   // OpusPayloadType - The dynamic payload type used for Opus (RFC 7587)
+	OpusClockRate     = 48000 // OpusClockRate - The RTP timestamp clock of Opus is always 48 kHz (RFC 7587)
+	rtpExtensionSize  = 28    // rtpExtensionSize - The one-byte header extension (RFC 8285) that carries the processing time and the server timestamps
+	rtpProcessingID   = 1     // rtpProcessingID - The extension element ID of the processing time
+	rtpServerRecvID   = 2     // rtpServerRecvID - The extension element ID of the 8 byte server receive time
+	rtpServerSendID   = 3     // rtpServerSendID - The extension element ID of the 8 byte server transmit time
+	rtpOneByteProfile = 0xBEDE
+	rtpMaxProcessing  = 1<<24 - 1 // rtpMaxProcessing - The processing time is carried in 3 bytes of microseconds
+	rtpTicksPerMilli  = OpusClockRate / 1000
+	rtpMicrosPerMilli = 1000
+)
+
+// RTPPacketizer turns PacketRecord packets into RTP packets with an Opus payload, and PacketRedundant packets into RTP packets with a redundant payload.
+// The SerialNumber is mapped to the sequence number and the InitTime to the timestamp,
+// the ProcessingTime and the server timestamps travel in a header extension. The server forwarding the stream of a
+// room participant acts as a mixer (RFC 3550 7.1): the StreamID of the participant is the only CSRC
+type RTPPacketizer struct {
+	SSRC    uint32
+	started bool
+}
+
+// NewRTPPacketizer creates a packetizer with a random SSRC
+func NewRTPPacketizer() *RTPPacketizer {
+	return &RTPPacketizer{SSRC: rand.Uint32()}
+}
+
+// RTPDepacketizer turns RTP packets with an Opus or redundant payload back into PacketRecord or PacketRedundant packets.
+// It extends the 16 bit sequence numbers into a 32 bit SerialNumber, for each SSRC on its own: the server forwards
+// every stream of a room as an RTP stream of its own. The zero value is ready to use
+type RTPDepacketizer struct {
+	sequences map[uint32]*rtpSequence // By SSRC
+}
+
+// rtpSequence is the highest serial received in an RTP stream
+type rtpSequence struct {
+	started       bool
+	highestSerial uint32
+}
+
+// isRTP reports whether an encoded packet is RTP (or RTCP) rather than a native packet.
+// The version bits of RTP are 10, native packets start with MagicNumber whose first byte has them as 01
+func isRTP(buf []byte) bool {
+	return len(buf) > 0 && buf[0]>>6 == RTPVersion
+}
+
+// RTPTimestamp converts a time in microseconds to the 48 kHz RTP clock
+func RTPTimestamp(micros uint64) uint32 {
+	return uint32(micros * rtpTicksPerMilli / rtpMicrosPerMilli)
+}
+
+// AppendPacket appends the packet as an RTP packet to dst and returns the extended buffer
+func (packetizer *RTPPacketizer) AppendPacket(dst []byte, packet *Packet) ([]byte, error) {
+	if err := packet.checkFields(); err != nil {
+		return dst, err
+	}
+	start := len(dst)
+	csrcCount := 0
+	if packet.StreamID != 0 {
+		csrcCount = 1
+	}
+	headerLen := RTPHeaderSize + 4*csrcCount
+	packetLen := headerLen + rtpExtensionSize + int(packet.DataSize)
+	dst = slices.Grow(dst, packetLen)[:start+packetLen]
+	buf := dst[start:]
+
+	buf[0] = RTPVersion<<6 | 1<<4 | byte(csrcCount) // Version 2, no padding, with extension
+	buf[1] = OpusPayloadType
+	if packet.PacketType == PacketRedundant {
+		buf[1] = RedPayloadType
+	}
+	if !packetizer.started {
+		buf[1] |= 1 << 7 // The marker bit flags the first packet of the stream
+		packetizer.started = true
+	}
+	binary.BigEndian.PutUint16(buf[2:], uint16(packet.SerialNumber))
+	binary.BigEndian.PutUint32(buf[4:], RTPTimestamp(packet.InitTime))
+	binary.BigEndian.PutUint32(buf[8:], packetizer.SSRC)
+	if csrcCount > 0 {
+		binary.BigEndian.PutUint32(buf[RTPHeaderSize:], packet.StreamID)
+	}
+
+	extension := buf[headerLen:]
+	binary.BigEndian.PutUint16(extension[0:], rtpOneByteProfile)
+	binary.BigEndian.PutUint16(extension[2:], rtpExtensionSize/4-1) // Length in 32 bit words
+	extension[4] = rtpProcessingID<<4 | 2                           // ID and length-1 of a 3 byte element
+	processing := uint32(min(packet.ProcessingTime, rtpMaxProcessing))
+	extension[5], extension[6], extension[7] = byte(processing>>16), byte(processing>>8), byte(processing)
+	extension[8] = rtpServerRecvID<<4 | 7
+	binary.BigEndian.PutUint64(extension[9:], packet.ServerReceive)
+	extension[17] = rtpServerSendID<<4 | 7
+	binary.BigEndian.PutUint64(extension[18:], packet.ServerTransmit)
+	extension[26], extension[27] = 0, 0 // Padding
+
+	copy(buf[headerLen+rtpExtensionSize:], packet.Data[:packet.DataSize])
+	return dst, nil
+}
+
+// Depacketize decodes an RTP packet with an Opus or redundant payload into a PacketRecord or PacketRedundant packet, copying the payload.
+// The InitTime is recovered from the 32 bit timestamp as the time closest to now, the StreamID from the first CSRC
+func (depacketizer *RTPDepacketizer) Depacketize(buf []byte, packet *Packet) error {
+	if len(buf) < RTPHeaderSize || buf[0]>>6 != RTPVersion {
+		return fmt.Errorf("%w: not an RTP packet", ErrBadHeader)
+	}
+	packetType := uint32(PacketRecord)
+	switch buf[1] & 0x7f {
+	case OpusPayloadType:
+	case RedPayloadType:
+		packetType = PacketRedundant
+	default:
+		return fmt.Errorf("%w: unexpected RTP payload type %d", ErrBadHeader, buf[1]&0x7f)
+	}
+
+	headerLen := RTPHeaderSize + 4*int(buf[0]&0x0f) // Skip the CSRCs
+	if len(buf) < headerLen {
+		return fmt.Errorf("%w: truncated RTP header", ErrBadHeader)
+	}
+	payload := buf[headerLen:]
+	if buf[0]&(1<<5) != 0 && len(payload) > 0 { // Padding, the last byte counts the padding bytes
+		payload = payload[:max(0, len(payload)-int(buf[len(buf)-1]))]
+	}
+	var extension rtpExtension
+	if buf[0]&(1<<4) != 0 {
+		if len(payload) < 4 {
+			return fmt.Errorf("%w: truncated RTP header extension", ErrBadHeader)
+		}
+		extensionLen := 4 + 4*int(binary.BigEndian.Uint16(payload[2:4]))
+		if len(payload) < extensionLen {
+			return fmt.Errorf("%w: truncated RTP header extension", ErrBadHeader)
+		}
+		if binary.BigEndian.Uint16(payload[0:2]) == rtpOneByteProfile {
+			extension = readExtensionElements(payload[4:extensionLen])
+		}
+		payload = payload[extensionLen:]
+	}
+	if len(payload) > DataFrameSize {
+		return ErrBadLength
+	}
+
+	ssrc := binary.BigEndian.Uint32(buf[8:12])
+	sequence, ok := depacketizer.sequences[ssrc]
+	if !ok {
+		if depacketizer.sequences == nil {
+			depacketizer.sequences = make(map[uint32]*rtpSequence)
+		}
+		sequence = new(rtpSequence)
+		depacketizer.sequences[ssrc] = sequence
+	}
+	packet.PacketType = packetType
+	packet.SerialNumber = sequence.extend(binary.BigEndian.Uint16(buf[2:4]))
+	packet.InitTime = rtpTimeToMicros(binary.BigEndian.Uint32(buf[4:8]), time.Now())
+	packet.ProcessingTime = uint64(extension.processing)
+	packet.ServerReceive = extension.serverReceive
+	packet.ServerTransmit = extension.serverTransmit
+	packet.StreamID = 0
+	if buf[0]&0x0f > 0 {
+		packet.StreamID = binary.BigEndian.Uint32(buf[RTPHeaderSize:])
+	}
+	packet.DataSize = uint32(len(payload))
+	packet.Data = append(packet.Data[:0], payload...)
+	return nil
+}
+
+// rtpExtension holds the values carried by the one-byte header extension
+type rtpExtension struct {
+	processing                    uint32
+	serverReceive, serverTransmit uint64
+}
+
+// readExtensionElements finds the processing time and the server timestamps among the one-byte extension elements
+func readExtensionElements(elements []byte) rtpExtension {
+	var extension rtpExtension
+	for i := 0; i < len(elements); {
+		id, length := elements[i]>>4, int(elements[i]&0x0f)+1
+		if id == 0 { // Padding byte
+			i++
+			continue
+		}
+		if id == 15 || i+1+length > len(elements) {
+			break
+		}
+		value := elements[i+1 : i+1+length]
+		switch {
+		case id == rtpProcessingID && length == 3:
+			extension.processing = uint32(value[0])<<16 | uint32(value[1])<<8 | uint32(value[2])
+		case id == rtpServerRecvID && length == 8:
+			extension.serverReceive = binary.BigEndian.Uint64(value)
+		case id == rtpServerSendID && length == 8:
+			extension.serverTransmit = binary.BigEndian.Uint64(value)
+		}
+		i += 1 + length
+	}
+	return extension
+}
+
+// extend returns the 32 bit serial of a 16 bit sequence number, the one closest to the highest serial seen so far
+func (sequence *rtpSequence) extend(sequenceID uint16) uint32 {
+	if !sequence.started {
+		sequence.started = true
+		sequence.highestSerial = uint32(sequenceID)
+		return sequence.highestSerial
+	}
+	delta := int32(int16(sequenceID - uint16(sequence.highestSerial)))
+	serial := uint32(int64(sequence.highestSerial) + int64(delta))
+	if delta > 0 {
+		sequence.highestSerial = serial
+	}
+	return serial
+}
+
+// rtpTimeToMicros returns the time in microseconds whose RTP timestamp is rtpTime and is closest to now
+func rtpTimeToMicros(rtpTime uint32, now time.Time) uint64 {
+	nowTicks := now.UnixMicro() * rtpTicksPerMilli / rtpMicrosPerMilli
+	ticks := nowTicks + int64(int32(rtpTime-uint32(nowTicks)))
+	return uint64(ticks * rtpMicrosPerMilli / rtpTicksPerMilli)
+}
@@ -0,0 +1,121 @@
+package sharedutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// rtpTestPacket returns a packet whose InitTime survives the 48 kHz RTP clock, a whole millisecond
+func rtpTestPacket(packetType, serial int, streamID uint32) *Packet {
+	now := time.Now().Truncate(time.Millisecond).UnixMicro()
+	packet := InitPacket(packetType, serial, now, 1234, 4)
+	packet.SetData([]byte{0xfc, 1, 2, 3})
+	packet.ServerReceive, packet.ServerTransmit = uint64(now+100), uint64(now+150)
+	packet.StreamID = streamID
+	return packet
+}
+
+func TestRTPRoundTrip(t *testing.T) {
+	packetizer := NewRTPPacketizer()
+	var depacketizer RTPDepacketizer
+	tests := []struct {
+		name        string
+		packet      *Packet
+		payloadType byte
+		marker      bool
+	}{
+		{"first record", rtpTestPacket(PacketRecord, 65534, 0), OpusPayloadType, true},
+		{"redundant", rtpTestPacket(PacketRedundant, 65535, 0), RedPayloadType, false},
+		{"record across the sequence wrap", rtpTestPacket(PacketRecord, 65536, 0), OpusPayloadType, false},
+		{"record of a room stream", rtpTestPacket(PacketRecord, 65537, 7), OpusPayloadType, false},
+	}
+	for _, test := range tests {
+		buf, err := packetizer.AppendPacket(nil, test.packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csrcCount := byte(0)
+		if test.packet.StreamID != 0 {
+			csrcCount = 1
+		}
+		if buf[0] != RTPVersion<<6|1<<4|csrcCount || buf[1]&0x7f != test.payloadType || (buf[1]&0x80 != 0) != test.marker {
+			t.Errorf("%s: got header % x", test.name, buf[:2])
+		}
+		if profile := binary.BigEndian.Uint16(buf[RTPHeaderSize+4*int(csrcCount):]); profile != rtpOneByteProfile {
+			t.Errorf("%s: got extension profile %#x, want the one-byte header extension", test.name, profile)
+		}
+		var packet Packet
+		if err := depacketizer.Depacketize(buf, &packet); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !samePacket(&packet, test.packet) {
+			t.Errorf("%s: got %+v, want %+v", test.name, packet, *test.packet)
+		}
+	}
+}
+
+func TestRTPClampsProcessingTime(t *testing.T) {
+	packet := rtpTestPacket(PacketRecord, 1, 0)
+	packet.ProcessingTime = rtpMaxProcessing + 1
+	buf, err := NewRTPPacketizer().AppendPacket(nil, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var depacketizer RTPDepacketizer
+	var decoded Packet
+	if err := depacketizer.Depacketize(buf, &decoded); err != nil || decoded.ProcessingTime != rtpMaxProcessing {
+		t.Errorf("got processing time %d (%v), want %d", decoded.ProcessingTime, err, rtpMaxProcessing)
+	}
+}
+
+func TestRTPPadding(t *testing.T) {
+	packet := rtpTestPacket(PacketRecord, 1, 0)
+	buf, err := NewRTPPacketizer().AppendPacket(nil, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[0] |= 1 << 5
+	buf = append(buf, 0, 0, 0, 4) // The last byte counts the padding
+	var depacketizer RTPDepacketizer
+	var decoded Packet
+	if err := depacketizer.Depacketize(buf, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !samePacket(&decoded, packet) {
+		t.Errorf("got %+v with the padding, want %+v", decoded, *packet)
+	}
+}
+
+func TestDepacketizeErrors(t *testing.T) {
+	valid, err := NewRTPPacketizer().AppendPacket(nil, rtpTestPacket(PacketRecord, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := func(modify func(buf []byte) []byte) []byte {
+		return modify(append([]byte(nil), valid...))
+	}
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"shorter than the header", valid[:RTPHeaderSize-1]},
+		{"bad version", modified(func(buf []byte) []byte { buf[0] = 1<<6 | buf[0]&0x3f; return buf })},
+		{"unexpected payload type", modified(func(buf []byte) []byte { buf[1] = 0; return buf })},
+		{"missing CSRC", modified(func(buf []byte) []byte { buf[0] |= 0x0f; return buf[:RTPHeaderSize+8] })},
+		{"truncated extension header", valid[:RTPHeaderSize+2]},
+		{"truncated extension", valid[:RTPHeaderSize+rtpExtensionSize-1]},
+		{"extension longer than the packet", modified(func(buf []byte) []byte {
+			binary.BigEndian.PutUint16(buf[RTPHeaderSize+2:], 0xffff)
+			return buf
+		})},
+	}
+	for _, test := range tests {
+		var depacketizer RTPDepacketizer
+		var packet Packet
+		if err := depacketizer.Depacketize(test.buf, &packet); !errors.Is(err, ErrBadHeader) {
+			t.Errorf("%s: got %v, want %v", test.name, err, ErrBadHeader)
+		}
+	}
+}
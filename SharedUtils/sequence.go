@@ -0,0 +1,171 @@
+package sharedutils
+
+const (
+	sequenceMaxDropout  = 3000 // sequenceMaxDropout - A larger jump ahead is taken for a restart of the sender (RFC 3550 A.1)
+	sequenceMaxMisorder = 100  // sequenceMaxMisorder - A packet further behind is taken for a restart of the sender (RFC 3550 A.1)
+)
+
+// SequenceTracker extends the 32 bit serial numbers of a stream across wraparounds and keeps
+// the counts loss is computed from (RFC 3550 A.1). The stream may start at any serial
+type SequenceTracker struct {
+	started   bool
+	base      int64 // Extended serial of the first packet of the stream
+	highest   int64 // Extended highest serial received
+	received  int64 // Packets received, duplicates included as in RFC 3550
+	unordered int64 // Packets that arrived after a packet with a higher serial
+	badSerial int64 // The serial after a suspicious jump, a restart is accepted if it is followed in sequence
+	badValid  bool
+}
+
+// Update counts a received packet and returns its extended serial
+func (tracker *SequenceTracker) Update(serial uint32) int64 {
+	if !tracker.started {
+		tracker.restart(int64(serial))
+		return tracker.highest
+	}
+
+	// The extended serial closest to the highest one, so wraps of the 32 bit field are followed
+	delta := int64(int32(serial - uint32(tracker.highest)))
+	extended := tracker.highest + delta
+
+	switch {
+	case delta > 0 && delta < sequenceMaxDropout:
+		tracker.highest = extended
+	case delta <= 0 && delta >= -sequenceMaxMisorder:
+		if delta < 0 {
+			tracker.unordered++
+		}
+		if extended < tracker.base {
+			tracker.base = extended // The first packets of the stream were reordered
+		}
+	default:
+		// A large jump: the sender restarted, or a stray packet. Restart once two packets agree on it
+		if tracker.badValid && int64(serial) == tracker.badSerial {
+			tracker.restart(int64(serial))
+			return tracker.highest
+		}
+		tracker.badSerial, tracker.badValid = int64(serial+1), true
+		return extended
+	}
+	tracker.badValid = false
+	tracker.received++
+	return extended
+}
+
+func (tracker *SequenceTracker) restart(serial int64) {
+	*tracker = SequenceTracker{started: true, base: serial, highest: serial, received: 1}
+}
+
+// Highest returns the extended highest serial received
+func (tracker *SequenceTracker) Highest() int64 {
+	return tracker.highest
+}
+
+// Expected returns the number of packets sent from the first serial to the highest one
+func (tracker *SequenceTracker) Expected() int64 {
+	if !tracker.started {
+		return 0
+	}
+	return tracker.highest - tracker.base + 1
+}
+
+// Received returns the number of packets received
+func (tracker *SequenceTracker) Received() int64 {
+	return tracker.received
+}
+
+// Lost returns the number of expected packets that were not received, negative when duplicates arrived
+func (tracker *SequenceTracker) Lost() int64 {
+	return tracker.Expected() - tracker.received
+}
+
+// Unordered returns the number of packets that arrived after a packet with a higher serial
+func (tracker *SequenceTracker) Unordered() int64 {
+	return tracker.unordered
+}
+
+// serialWindow remembers which of the last 64 serials were seen, for dropping duplicates
+type serialWindow struct {
+	started bool
+	highest uint32
+	seen    uint64 // Bit i is set when highest-i was seen
+}
+
+// check reports whether the serial is new and not older than the window, without marking it
+func (window *serialWindow) check(serial uint32) bool {
+	if !window.started {
+		return true
+	}
+	delta := int32(serial - window.highest)
+	if delta > 0 {
+		return true
+	}
+	return delta > -64 && window.seen&(1<<-delta) == 0
+}
+
+// mark records the serial as seen, it must have passed check
+func (window *serialWindow) mark(serial uint32) {
+	if !window.started {
+		window.started, window.highest, window.seen = true, serial, 1
+		return
+	}
+	delta := int32(serial - window.highest)
+	if delta > 0 {
+		window.seen = window.seen<<min(delta, 64) | 1
+		window.highest = serial
+		return
+	}
+	window.seen |= 1 << -delta
+}
+
+// replayWindow remembers which of the last replayWindowSize serials were seen, for dropping replayed packets.
+// It reaches as far back as a SendHistory, so a retransmission of any packet a NACK can ask for is still accepted
+type replayWindow struct {
+	started bool
+	highest uint32
+	seen    [replayWindowSize / 64]uint64 // Bit serial%replayWindowSize is set when the serial was seen
+}
+
+// check reports whether the serial is new and not older than the window, without marking it
+func (window *replayWindow) check(serial uint32) bool {
+	if !window.started {
+		return true
+	}
+	delta := int32(serial - window.highest)
+	if delta > 0 {
+		return true
+	}
+	return delta > -replayWindowSize && !window.bit(serial)
+}
+
+// mark records the serial as seen, it must have passed check
+func (window *replayWindow) mark(serial uint32) {
+	if !window.started {
+		window.started, window.highest = true, serial
+	} else if delta := int32(serial - window.highest); delta > 0 {
+		// The bits of the serials the window moves over held serials replayWindowSize older
+		if delta >= replayWindowSize {
+			window.seen = [replayWindowSize / 64]uint64{}
+		} else {
+			for skipped := window.highest + 1; skipped != serial; skipped++ {
+				window.setBit(skipped, false)
+			}
+		}
+		window.highest = serial
+	}
+	window.setBit(serial, true)
+}
+
+func (window *replayWindow) bit(serial uint32) bool {
+	index := serial % replayWindowSize
+	return window.seen[index/64]&(1<<(index%64)) != 0
+}
+
+func (window *replayWindow) setBit(serial uint32, seen bool) {
+	index := serial % replayWindowSize
+	if seen {
+		window.seen[index/64] |= 1 << (index % 64)
+	} else {
+		window.seen[index/64] &^= 1 << (index % 64)
+	}
+}
@@ -0,0 +1,88 @@
+package sharedutils
+
+import "testing"
+
+func TestReplayWindow(t *testing.T) {
+	var window replayWindow
+	receive := func(serial uint32) bool {
+		if !window.check(serial) {
+			return false
+		}
+		window.mark(serial)
+		return true
+	}
+	for serial := uint32(1000); serial < 1400; serial++ {
+		if serial != 1050 && !receive(serial) { // 1050 is lost
+			t.Fatalf("serial %d refused", serial)
+		}
+	}
+	tests := []struct {
+		name   string
+		serial uint32
+		want   bool
+	}{
+		{"retransmission of a lost packet 350 serials back", 1050, true},
+		{"the retransmission again", 1050, false},
+		{"replay of a recent packet", 1399, false},
+		{"replay of an old packet", 1000, false},
+		{"older than the window", 1399 - replayWindowSize, false},
+		{"next packet", 1400, true},
+		{"far ahead", 1400 + 3*replayWindowSize, true},
+		{"within the window again", 1400 + 3*replayWindowSize - 1, true},
+		{"a serial the jump moved the window over", 1400 + 2*replayWindowSize + 50, true},
+	}
+	for _, test := range tests {
+		if got := receive(test.serial); got != test.want {
+			t.Errorf("%s: serial %d accepted %v, want %v", test.name, test.serial, got, test.want)
+		}
+	}
+}
+
+func TestSequenceTracker(t *testing.T) {
+	const wrap = int64(1) << 32
+	tests := []struct {
+		name      string
+		serials   []uint32
+		last      int64 // The extended serial of the last packet
+		highest   int64
+		expected  int64
+		lost      int64
+		unordered int64
+	}{
+		{"in order from a non-zero start", []uint32{1000, 1001, 1002, 1003}, 1003, 1003, 4, 0, 0},
+		{"a loss", []uint32{5, 6, 8, 9}, 9, 9, 5, 1, 0},
+		{"across the wrap", []uint32{0xFFFFFFFE, 0xFFFFFFFF, 0, 1}, wrap + 1, wrap + 1, 4, 0, 0},
+		{"reordered around the wrap", []uint32{0xFFFFFFFE, 0, 0xFFFFFFFF, 1}, wrap + 1, wrap + 1, 4, 0, 1},
+		{"late packet before the wrap", []uint32{0xFFFFFFFF, 0, 1, 0xFFFFFFFE}, 0xFFFFFFFE, wrap + 1, 4, 0, 1},
+		{"loss across the wrap", []uint32{0xFFFFFFFE, 1, 2}, wrap + 2, wrap + 2, 5, 2, 0},
+		{"first packets reordered", []uint32{10, 9, 11}, 11, 11, 3, 0, 1},
+		{"a duplicate", []uint32{1, 2, 2, 3}, 3, 3, 3, -1, 0},
+		{"a stray packet far ahead", []uint32{1, 2, 100000, 3}, 3, 3, 3, 0, 0},
+		{"a stray packet far behind", []uint32{1000, 1001, 800, 1002}, 1002, 1002, 3, 0, 0},
+		{"restart after a large jump", []uint32{1, 2, 3, 100000, 100001, 100003}, 100003, 100003, 3, 1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var tracker SequenceTracker
+			var last int64
+			for _, serial := range test.serials {
+				last = tracker.Update(serial)
+			}
+			if last != test.last || tracker.Highest() != test.highest {
+				t.Errorf("got last %d and highest %d, want %d and %d", last, tracker.Highest(), test.last, test.highest)
+			}
+			if tracker.Expected() != test.expected || tracker.Lost() != test.lost || tracker.Unordered() != test.unordered {
+				t.Errorf("got expected %d, lost %d, unordered %d, want %d, %d, %d",
+					tracker.Expected(), tracker.Lost(), tracker.Unordered(), test.expected, test.lost, test.unordered)
+			}
+			if tracker.Received() != tracker.Expected()-tracker.Lost() {
+				t.Errorf("received %d is not expected %d minus lost %d", tracker.Received(), tracker.Expected(), tracker.Lost())
+			}
+		})
+	}
+
+	var tracker SequenceTracker
+	if tracker.Expected() != 0 || tracker.Lost() != 0 {
+		t.Errorf("a tracker without packets expected %d and lost %d", tracker.Expected(), tracker.Lost())
+	}
+}
@@ -0,0 +1,177 @@
+package sharedutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+const (
+	CodecOpus         = 1  // CodecOpus - The data of PacketRecord packets are Opus frames
+	CodecMP3          = 2  // CodecMP3 - The data of PacketRequestSong packets are chunks of an mp3 file
+	sessionParamsSize = 12 // sessionParamsSize - The size of the data of Hello and Accept packets, followed by the salt of encrypted sessions and the end-to-end key
+)
+
+// opusSampleRates and opusFrameDurations are the combinations the Opus codec can encode
+var (
+	opusSampleRates    = []uint32{8000, 12000, 16000, 24000, 48000}
+	opusFrameDurations = []time.Duration{
+		2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond,
+		20 * time.Millisecond, 40 * time.Millisecond, 60 * time.Millisecond,
+	}
+)
+
+// ErrBadSessionParams is returned for Hello and Accept packets that do not carry session parameters
+var ErrBadSessionParams = errors.New("sharedutils: bad session parameters")
+
+// SessionParams are the audio parameters the client and the server agree on before any audio is sent
+type SessionParams struct {
+	Version       uint8
+	Codec         uint8
+	Channels      uint8
+	SampleRate    uint32
+	FrameDuration time.Duration
+	Cipher        CipherSuite    // Cipher - How the packets after the handshake are sealed
+	Salt          [SaltSize]byte // Salt - Picked by the client for the keys of an encrypted session
+	// E2EKey - The X25519 public key of the client in a Hello packet, zero when the audio is not encrypted end-to-end.
+	// The Accept packet echoes it, the client being its own peer for the echo. The keys of the other participants
+	// of a room come with their Join packets
+	E2EKey [E2EKeySize]byte
+}
+
+// EndToEnd reports whether the Opus frames of the session are encrypted end-to-end
+func (params SessionParams) EndToEnd() bool {
+	return params.E2EKey != [E2EKeySize]byte{}
+}
+
+// FrameSize is the number of samples (per channel) in one frame
+func (params SessionParams) FrameSize() int {
+	return int(time.Duration(params.SampleRate) * params.FrameDuration / time.Second)
+}
+
+func (params SessionParams) String() string {
+	codec := "opus"
+	if params.Codec == CodecMP3 {
+		codec = "mp3"
+	}
+	encryption := ""
+	if params.Cipher != CipherNone {
+		encryption = " " + params.Cipher.String()
+	}
+	if params.EndToEnd() {
+		encryption += " end-to-end"
+	}
+	return fmt.Sprintf("%s %dHz %dch %v%s (protocol version %d)",
+		codec, params.SampleRate, params.Channels, params.FrameDuration, encryption, params.Version)
+}
+
+// HelloPacket opens a session by asking the server for the given parameters
+func HelloPacket(params SessionParams) *Packet {
+	return sessionPacket(PacketHello, params)
+}
+
+// AcceptPacket answers a Hello packet with the parameters the server agreed to
+func AcceptPacket(params SessionParams) *Packet {
+	return sessionPacket(PacketAccept, params)
+}
+
+// RejectPacket answers a Hello or Join packet the server cannot serve, the reason is sent as text
+func RejectPacket(reason string) *Packet {
+	packet := InitPacket(PacketReject, 0, time.Now().UnixMicro(), 0, min(len(reason), DataFrameSize))
+	packet.SetData([]byte(reason))
+	return packet
+}
+
+func sessionPacket(packetType int, params SessionParams) *Packet {
+	size := sessionParamsSize
+	if params.Cipher != CipherNone || params.EndToEnd() {
+		size += SaltSize // Zero for end-to-end encryption alone
+	}
+	if params.EndToEnd() {
+		size += E2EKeySize
+	}
+	data := make([]byte, size)
+	data[0] = params.Version
+	data[1] = params.Codec
+	data[2] = params.Channels
+	data[3] = uint8(params.Cipher)
+	binary.LittleEndian.PutUint32(data[4:], params.SampleRate)
+	binary.LittleEndian.PutUint32(data[8:], uint32(params.FrameDuration/time.Microsecond))
+	copy(data[sessionParamsSize:], params.Salt[:])
+	if params.EndToEnd() {
+		copy(data[sessionParamsSize+SaltSize:], params.E2EKey[:])
+	}
+
+	packet := InitPacket(packetType, 0, time.Now().UnixMicro(), 0, len(data))
+	packet.SetData(data)
+	return packet
+}
+
+// SessionParams decodes the parameters carried by a Hello or Accept packet
+func (packet *Packet) SessionParams() (SessionParams, error) {
+	if packet.PacketType != PacketHello && packet.PacketType != PacketAccept || packet.DataSize < sessionParamsSize {
+		return SessionParams{}, ErrBadSessionParams
+	}
+	data := packet.Data[:packet.DataSize]
+	params := SessionParams{
+		Version:       data[0],
+		Codec:         data[1],
+		Channels:      data[2],
+		Cipher:        CipherSuite(data[3]),
+		SampleRate:    binary.LittleEndian.Uint32(data[4:]),
+		FrameDuration: time.Duration(binary.LittleEndian.Uint32(data[8:])) * time.Microsecond,
+	}
+	if params.Cipher != CipherNone {
+		if len(data) < sessionParamsSize+SaltSize {
+			return SessionParams{}, ErrBadSessionParams
+		}
+		copy(params.Salt[:], data[sessionParamsSize:])
+	}
+	if len(data) >= sessionParamsSize+SaltSize+E2EKeySize {
+		copy(params.E2EKey[:], data[sessionParamsSize+SaltSize:])
+	}
+	return params, nil
+}
+
+// NegotiateSession returns the parameters the server can serve for the requested ones.
+// Unsupported sample rates, channel counts and frame durations are adapted to the closest supported value,
+// other protocol versions and unknown codecs are rejected
+func NegotiateSession(requested SessionParams) (SessionParams, error) {
+	if requested.Version != ProtocolVersion {
+		return SessionParams{}, &VersionError{Version: requested.Version}
+	}
+	if requested.Cipher > CipherChaCha20Poly1305 {
+		return SessionParams{}, fmt.Errorf("sharedutils: unsupported %v", requested.Cipher)
+	}
+
+	params := requested // The end-to-end key is echoed as it is, a client checks it was not replaced
+	switch requested.Codec {
+	case CodecMP3:
+		return params, nil
+
+	case CodecOpus:
+		if !slices.Contains(opusSampleRates, params.SampleRate) {
+			params.SampleRate = 48000
+		}
+		params.Channels = max(1, min(params.Channels, 2))
+		if !slices.Contains(opusFrameDurations, params.FrameDuration) {
+			params.FrameDuration = closestDuration(opusFrameDurations, params.FrameDuration)
+		}
+		return params, nil
+
+	default:
+		return SessionParams{}, fmt.Errorf("sharedutils: unsupported codec %d", requested.Codec)
+	}
+}
+
+func closestDuration(durations []time.Duration, duration time.Duration) time.Duration {
+	closest := durations[0]
+	for _, d := range durations {
+		if (d - duration).Abs() < (closest - duration).Abs() {
+			closest = d
+		}
+	}
+	return closest
+}
@@ -0,0 +1,72 @@
+package sharedutils
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNegotiateSession(t *testing.T) {
+	opus := SessionParams{Version: ProtocolVersion, Codec: CodecOpus, Channels: 2, SampleRate: 48000,
+		FrameDuration: 10 * time.Millisecond, Cipher: CipherAESGCM, Salt: [SaltSize]byte{1}, E2EKey: [E2EKeySize]byte{2}}
+	with := func(change func(params *SessionParams)) SessionParams {
+		params := opus
+		change(&params)
+		return params
+	}
+	tests := []struct {
+		name      string
+		requested SessionParams
+		want      SessionParams
+	}{
+		{"supported", opus, opus},
+		{"mp3", with(func(params *SessionParams) { params.Codec, params.SampleRate = CodecMP3, 44100 }),
+			with(func(params *SessionParams) { params.Codec, params.SampleRate = CodecMP3, 44100 })},
+		{"every Opus sample rate", with(func(params *SessionParams) { params.SampleRate = 8000 }), with(func(params *SessionParams) { params.SampleRate = 8000 })},
+		{"unsupported sample rate", with(func(params *SessionParams) { params.SampleRate = 44100 }), opus},
+		{"no channels", with(func(params *SessionParams) { params.Channels = 0 }), with(func(params *SessionParams) { params.Channels = 1 })},
+		{"surround", with(func(params *SessionParams) { params.Channels = 6 }), opus},
+		{"frame between durations", with(func(params *SessionParams) { params.FrameDuration = 12 * time.Millisecond }), opus},
+		{"frame too long", with(func(params *SessionParams) { params.FrameDuration = time.Second }),
+			with(func(params *SessionParams) { params.FrameDuration = 60 * time.Millisecond })},
+		{"frame too short", with(func(params *SessionParams) { params.FrameDuration = time.Millisecond }),
+			with(func(params *SessionParams) { params.FrameDuration = 2500 * time.Microsecond })},
+	}
+	for _, test := range tests {
+		if params, err := NegotiateSession(test.requested); err != nil || params != test.want {
+			t.Errorf("%s: got %v (%v), want %v", test.name, params, err, test.want)
+		}
+	}
+
+	var versionError *VersionError
+	if _, err := NegotiateSession(with(func(params *SessionParams) { params.Version = ProtocolVersion + 1 })); !errors.As(err, &versionError) {
+		t.Errorf("another protocol version: got %v, want a VersionError", err)
+	}
+	for name, requested := range map[string]SessionParams{
+		"unknown codec":  with(func(params *SessionParams) { params.Codec = 9 }),
+		"unknown cipher": with(func(params *SessionParams) { params.Cipher = CipherChaCha20Poly1305 + 1 }),
+	} {
+		if params, err := NegotiateSession(requested); err == nil {
+			t.Errorf("%s: accepted as %v", name, params)
+		}
+	}
+}
+
+func TestSessionPackets(t *testing.T) {
+	for _, params := range []SessionParams{
+		{Version: ProtocolVersion, Codec: CodecOpus, Channels: 1, SampleRate: 24000, FrameDuration: 5 * time.Millisecond},
+		{Version: ProtocolVersion, Codec: CodecOpus, Channels: 2, SampleRate: 48000, FrameDuration: 2500 * time.Microsecond,
+			Cipher: CipherChaCha20Poly1305, Salt: [SaltSize]byte{1, 2, 3}},
+		{Version: ProtocolVersion, Codec: CodecOpus, Channels: 2, SampleRate: 48000, FrameDuration: 10 * time.Millisecond,
+			E2EKey: [E2EKeySize]byte{4, 5, 6}},
+	} {
+		for _, packet := range []*Packet{HelloPacket(params), AcceptPacket(params)} {
+			if decoded, err := packet.SessionParams(); err != nil || decoded != params {
+				t.Errorf("packet type %d: got %v (%v), want %v", packet.PacketType, decoded, err, params)
+			}
+		}
+	}
+	if _, err := RejectPacket("no").SessionParams(); !errors.Is(err, ErrBadSessionParams) {
+		t.Errorf("a Reject packet: got %v, want %v", err, ErrBadSessionParams)
+	}
+}
@@ -3,16 +3,42 @@ package sharedutils
 
 import (
 	"bufio"
-	"encoding/binary"
+	"errors"
 	"log"
 	"net"
 )
 
 const (
 	//BufferSize is the size of a buffer
-	BufferSize    = bufio.MaxScanTokenSize / 64 // BufferSize - The size of the packets when transmitting a song
-	MetadataSize  = 28                          // MetadataSize - Packet information such as bitrate, audio channels, etc
-	DataFrameSize = BufferSize - MetadataSize   // DataFrameSize - The max size of the data part in a packet
+	BufferSize      = bufio.MaxScanTokenSize / 64 // BufferSize - The max size of an encoded packet on the wire
+	MetadataSize    = 44                          // MetadataSize - The size of the packet header (magic, version, type, sizes, timestamps, stream ID and checksum)
+	DataFrameSize   = BufferSize - MetadataSize   // DataFrameSize - The max size of the data part in a packet
+	LengthPrefix    = 2                           // LengthPrefix - The size of the frame length that precedes every packet on stream connections
+	MagicNumber     = 0x5352                      // MagicNumber - "RS" on the wire, the first two bytes of every header
+	ProtocolVersion = 4                           // ProtocolVersion - The version of the wire format, follows the magic number
+	checksumOffset  = MetadataSize - 4            // checksumOffset - The CRC32 is the last field of the header
+)
+
+const (
+	PacketRequestSong  = iota + 1 // PacketRequestSong - A chunk of the song file
+	PacketCloseChannel            // PacketCloseChannel - The sender is done, the session ends
+	PacketRecord                  // PacketRecord - For recording a stream with microphone
+	PacketHello                   // PacketHello - Opens a session with the SessionParams the client asks for
+	PacketAccept                  // PacketAccept - The SessionParams the server agreed to
+	PacketReject                  // PacketReject - The server refused the session or a Join, the data holds the reason
+	PacketRTCP                    // PacketRTCP - The data holds a compound RTCP packet with the reports of the sender
+	PacketClockProbe              // PacketClockProbe - Asks the server for its receive and transmit times to synchronize clocks
+	PacketRedundant               // PacketRedundant - A PacketRecord whose data also carries the previous frames (RFC 2198)
+	PacketParity                  // PacketParity - The XOR of a block of packets, rebuilds one missing packet of the block
+	PacketNack                    // PacketNack - The data holds the serials the receiver misses and asks to be sent again
+	PacketHeartbeat               // PacketHeartbeat - Sent when nothing else was for a while, so the peer knows the session is alive
+	PacketRendezvous              // PacketRendezvous - Asks the server for the address of the peer that gives the same token, the data
+	PacketPeerAddress             // PacketPeerAddress - The public address of the peer as the server sees it, the data holds it as text
+	PacketPunch                   // PacketPunch - Sent between peers to open their NATs, the data holds whether the sender heard the peer and the token
+	PacketRelay                   // PacketRelay - Asks the server to relay to the peer when punching failed, echoed once the server relays
+	PacketMTUProbe                // PacketMTUProbe - Padded to a size the path must carry without fragmenting, the server echoes it
+	PacketJoin                    // PacketJoin - Joins the room named by the data, answered with the stream ID of the client and announced to the room
+	PacketLeave                   // PacketLeave - Leaves the room, answered and announced to the room with the stream ID that left
 )
 
 // Packet is the definition for a packet in the module
@@ -21,8 +47,11 @@ type Packet struct {
 	SerialNumber   uint32
 	InitTime       uint64
 	ProcessingTime uint64
+	ServerReceive  uint64 // ServerReceive - When the server received the packet, microseconds on the server clock
+	ServerTransmit uint64 // ServerTransmit - When the server echoed the packet, microseconds on the server clock
+	StreamID       uint32 // StreamID - The participant of a room whose stream the server forwarded the packet from, zero outside rooms
 	DataSize       uint32
-	Data           [DataFrameSize]byte
+	Data           []byte // Data holds at least DataSize bytes
 }
 
 // ConnSpecs structs the specifications for the connection
@@ -50,45 +79,37 @@ func CheckError(err error) {
 	}
 }
 
-// ReadPacket accepts a binary byte slice from the link and decode it into a packet structure
+// ReadPacket reads one packet from the link and decode it into a packet structure.
+// Malformed packets are counted (see PacketsRejected) and reported by returning false,
+// any other error is fatal. Use Receive to handle errors
 func (packet *Packet) ReadPacket(conn net.Conn) bool {
-	buf := make([]byte, BufferSize)
-	packetRead := false
+	return checkPacketError(packet.Receive(conn))
+}
 
-	for {
-		packetLen, err := conn.Read(buf)
-		CheckError(err)
+// SendPacket encodes a packet into a binary byte slice and send it through a link
+func (packet *Packet) SendPacket(conn net.Conn) {
+	CheckError(packet.Send(conn))
+}
 
-		if packetLen == BufferSize {
-			packetRead = true
-			break
-		}
-	}
+// ReadPacketFrom reads one datagram from a listening (unconnected) socket and decode it into a packet structure.
+// It returns the address of the sender and false if the datagram is not a valid packet
+func (packet *Packet) ReadPacketFrom(conn net.PacketConn) (net.Addr, bool) {
+	address, err := packet.ReceiveFrom(conn)
+	return address, checkPacketError(err)
+}
 
-	if packetRead {
-		packet.PacketType = binary.LittleEndian.Uint32(buf[0:4])
-		packet.SerialNumber = binary.LittleEndian.Uint32(buf[4:8])
-		packet.InitTime = binary.LittleEndian.Uint64(buf[8:16])
-		packet.ProcessingTime = binary.LittleEndian.Uint64(buf[16:24])
-		packet.DataSize = binary.LittleEndian.Uint32(buf[24:28])
-		if packet.DataSize != 0 {
-			copy(packet.Data[0:DataFrameSize], buf[28:BufferSize])
-		}
-	}
-	return packetRead
+// SendPacketTo encodes a packet into a single datagram and send it to address through a listening socket
+func (packet *Packet) SendPacketTo(conn net.PacketConn, address net.Addr) {
+	CheckError(packet.SendTo(conn, address))
 }
 
-// SendPacket encodes a packet into a binary byte slice and send it through a link
-func (packet *Packet) SendPacket(conn net.Conn) {
-	buf := make([]byte, BufferSize)
-	binary.LittleEndian.PutUint32(buf[0:], packet.PacketType)
-	binary.LittleEndian.PutUint32(buf[4:], packet.SerialNumber)
-	binary.LittleEndian.PutUint64(buf[8:], packet.InitTime)
-	binary.LittleEndian.PutUint64(buf[16:], packet.ProcessingTime)
-	binary.LittleEndian.PutUint32(buf[24:], packet.DataSize)
-	copy(buf[28:BufferSize], packet.Data[0:packet.DataSize])
-	_, err := conn.Write(buf)
+// checkPacketError is false for malformed packets and fatal for any other error
+func checkPacketError(err error) bool {
+	if errors.Is(err, ErrBadHeader) {
+		return false
+	}
 	CheckError(err)
+	return true
 }
 
 // InitPacket initializing a packet
@@ -102,7 +123,8 @@ func InitPacket(packetType, serialNumber int, initTime, processingTime int64, da
 	}
 }
 
-// SetData sets the data for a packet
+// SetData sets the data for a packet. The packet refers to dataBuffer rather than copying it,
+// so it must not change until the packet is sent
 func (packet *Packet) SetData(dataBuffer []byte) {
-	copy(packet.Data[:], dataBuffer)
+	packet.Data = dataBuffer
 }
@@ -0,0 +1,248 @@
+package sharedutils
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	STUNHeaderSize      = 20                     // STUNHeaderSize - Type, length, magic cookie and transaction ID of every STUN message
+	STUNMagicCookie     = 0x2112A442             // STUNMagicCookie - Tells RFC 5389 messages from the older ones and from the other protocols of a port
+	STUNBindingRequest  = 0x0001                 // STUNBindingRequest - Asks the server for the address it sees the request come from
+	STUNBindingResponse = 0x0101                 // STUNBindingResponse - The success response to a binding request
+	STUNBindingError    = 0x0111                 // STUNBindingError - The error response to a binding request
+	STUNTimeout         = 500 * time.Millisecond // STUNTimeout - The first retransmission timeout of a binding request, doubled after every one (RFC 5389 7.2.1)
+	STUNAttempts        = 5                      // STUNAttempts - Binding requests sent before the STUN server is given up on
+	STUNSoftware        = "remotestudiolive"     // STUNSoftware - The SOFTWARE attribute of the responses of the server
+)
+
+const (
+	stunMappedAddress    = 0x0001     // stunMappedAddress - The reflexive address in the clear, from servers older than RFC 5389
+	stunErrorCode        = 0x0009     // stunErrorCode - The class, number and reason of an error response
+	stunXORMappedAddress = 0x0020     // stunXORMappedAddress - The reflexive address XORed with the magic cookie, so NATs do not rewrite it
+	stunSoftware         = 0x8022     // stunSoftware - Describes the agent that sent the message
+	stunFingerprint      = 0x8028     // stunFingerprint - CRC32 of the message, tells STUN from other protocols multiplexed on the port
+	stunFingerprintXOR   = 0x5354554e // stunFingerprintXOR - XORed with the CRC32 of the fingerprint
+	stunFamilyIPv4       = 0x01
+	stunFamilyIPv6       = 0x02
+)
+
+// ErrBadSTUN is returned for datagrams that are not well formed STUN messages
+var ErrBadSTUN = errors.New("sharedutils: bad STUN message")
+
+// STUNMessage is the part of a STUN message (RFC 5389) a binding needs
+type STUNMessage struct {
+	Type          uint16
+	TransactionID [12]byte
+	MappedAddress *net.UDPAddr // The address the server saw the request come from
+	ErrorCode     int          // The error of an error response, 300 to 699
+	ErrorReason   string
+	Software      string
+}
+
+// IsSTUN reports whether a datagram looks like a STUN message: its two first bits are zero, unlike the native and RTP
+// packets the server gets on the same port, and it carries the magic cookie
+func IsSTUN(buf []byte) bool {
+	return len(buf) >= STUNHeaderSize && buf[0]&0xC0 == 0 && binary.BigEndian.Uint32(buf[4:]) == STUNMagicCookie
+}
+
+// NewSTUNBindingRequest creates a binding request with a random transaction ID
+func NewSTUNBindingRequest() (*STUNMessage, error) {
+	request := &STUNMessage{Type: STUNBindingRequest}
+	if _, err := rand.Read(request.TransactionID[:]); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// Marshal encodes the message with its attributes and a FINGERPRINT
+func (message *STUNMessage) Marshal() []byte {
+	buf := make([]byte, STUNHeaderSize, STUNHeaderSize+64)
+	binary.BigEndian.PutUint16(buf[0:], message.Type)
+	binary.BigEndian.PutUint32(buf[4:], STUNMagicCookie)
+	copy(buf[8:], message.TransactionID[:])
+	if message.MappedAddress != nil {
+		buf = appendSTUNAttribute(buf, stunXORMappedAddress, message.xorAddress(message.MappedAddress))
+	}
+	if message.ErrorCode != 0 {
+		value := []byte{0, 0, byte(message.ErrorCode / 100), byte(message.ErrorCode % 100)}
+		buf = appendSTUNAttribute(buf, stunErrorCode, append(value, message.ErrorReason...))
+	}
+	if message.Software != "" {
+		buf = appendSTUNAttribute(buf, stunSoftware, []byte(message.Software))
+	}
+	// The length counts the fingerprint before its CRC is computed (RFC 5389 15.5)
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)-STUNHeaderSize+8))
+	fingerprint := binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(buf)^stunFingerprintXOR)
+	return appendSTUNAttribute(buf, stunFingerprint, fingerprint)
+}
+
+// appendSTUNAttribute appends an attribute padded to 4 bytes and updates the length in the header
+func appendSTUNAttribute(buf []byte, attributeType uint16, value []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, attributeType)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(value)))
+	buf = append(buf, value...)
+	buf = append(buf, make([]byte, (4-len(value)%4)%4)...)
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)-STUNHeaderSize))
+	return buf
+}
+
+// xorAddress encodes an address as the value of a XOR-MAPPED-ADDRESS, the same XOR decodes it
+func (message *STUNMessage) xorAddress(address *net.UDPAddr) []byte {
+	family, ip := byte(stunFamilyIPv4), address.IP.To4()
+	if ip == nil {
+		family, ip = stunFamilyIPv6, address.IP.To16()
+	}
+	value := []byte{0, family, 0, 0}
+	binary.BigEndian.PutUint16(value[2:], uint16(address.Port)^uint16(STUNMagicCookie>>16))
+	return append(value, message.xorIP(ip)...)
+}
+
+// xorIP XORs an address with the magic cookie, followed by the transaction ID for IPv6
+func (message *STUNMessage) xorIP(ip net.IP) net.IP {
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[:], STUNMagicCookie)
+	copy(key[4:], message.TransactionID[:])
+	xored := make(net.IP, len(ip))
+	for i := range ip {
+		xored[i] = ip[i] ^ key[i]
+	}
+	return xored
+}
+
+// ParseSTUNMessage decodes a STUN message, checking its FINGERPRINT when it has one.
+// Attributes that a binding does not need are skipped
+func ParseSTUNMessage(buf []byte) (*STUNMessage, error) {
+	if !IsSTUN(buf) {
+		return nil, ErrBadSTUN
+	}
+	length := int(binary.BigEndian.Uint16(buf[2:]))
+	if length%4 != 0 || STUNHeaderSize+length != len(buf) {
+		return nil, fmt.Errorf("%w: length %d in a datagram of %d bytes", ErrBadSTUN, length, len(buf))
+	}
+	message := &STUNMessage{Type: binary.BigEndian.Uint16(buf)}
+	copy(message.TransactionID[:], buf[8:STUNHeaderSize])
+	for offset := STUNHeaderSize; offset < len(buf); {
+		if offset+4 > len(buf) {
+			return nil, fmt.Errorf("%w: truncated attribute", ErrBadSTUN)
+		}
+		attributeType, size := binary.BigEndian.Uint16(buf[offset:]), int(binary.BigEndian.Uint16(buf[offset+2:]))
+		if offset+4+size > len(buf) {
+			return nil, fmt.Errorf("%w: attribute 0x%04x overruns the message", ErrBadSTUN, attributeType)
+		}
+		value := buf[offset+4 : offset+4+size]
+		switch attributeType {
+		case stunXORMappedAddress:
+			address, err := message.parseAddress(value, true)
+			if err != nil {
+				return nil, err
+			}
+			message.MappedAddress = address
+		case stunMappedAddress:
+			if message.MappedAddress == nil {
+				address, err := message.parseAddress(value, false)
+				if err != nil {
+					return nil, err
+				}
+				message.MappedAddress = address
+			}
+		case stunErrorCode:
+			if size < 4 {
+				return nil, fmt.Errorf("%w: short ERROR-CODE", ErrBadSTUN)
+			}
+			message.ErrorCode, message.ErrorReason = int(value[2]&0x07)*100+int(value[3]), string(value[4:])
+		case stunSoftware:
+			message.Software = string(value)
+		case stunFingerprint:
+			if size != 4 || offset+8 != len(buf) {
+				return nil, fmt.Errorf("%w: FINGERPRINT is not the last attribute", ErrBadSTUN)
+			}
+			if binary.BigEndian.Uint32(value) != crc32.ChecksumIEEE(buf[:offset])^stunFingerprintXOR {
+				return nil, fmt.Errorf("%w: wrong FINGERPRINT", ErrBadSTUN)
+			}
+		}
+		offset += 4 + size + (4-size%4)%4
+	}
+	return message, nil
+}
+
+// parseAddress decodes the value of a MAPPED-ADDRESS, or of a XOR-MAPPED-ADDRESS when xored is set
+func (message *STUNMessage) parseAddress(value []byte, xored bool) (*net.UDPAddr, error) {
+	if len(value) < 4 || (value[1] == stunFamilyIPv4 && len(value) != 8) || (value[1] == stunFamilyIPv6 && len(value) != 20) ||
+		(value[1] != stunFamilyIPv4 && value[1] != stunFamilyIPv6) {
+		return nil, fmt.Errorf("%w: bad mapped address", ErrBadSTUN)
+	}
+	port, ip := binary.BigEndian.Uint16(value[2:]), net.IP(append([]byte(nil), value[4:]...))
+	if xored {
+		port ^= uint16(STUNMagicCookie >> 16)
+		ip = message.xorIP(ip)
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// STUNBindingAnswer returns the response to a datagram that is a binding request from address, nil for anything else
+func STUNBindingAnswer(buf []byte, address net.Addr) []byte {
+	request, err := ParseSTUNMessage(buf)
+	if err != nil || request.Type != STUNBindingRequest {
+		return nil
+	}
+	response := &STUNMessage{Type: STUNBindingResponse, TransactionID: request.TransactionID, Software: STUNSoftware}
+	if udpAddress, ok := address.(*net.UDPAddr); ok {
+		response.MappedAddress = udpAddress
+	} else {
+		response.Type, response.ErrorCode, response.ErrorReason = STUNBindingError, 400, "Bad Request: not over udp"
+	}
+	return response.Marshal()
+}
+
+// QuerySTUN asks a STUN server for the reflexive address of the socket, the address its NAT maps it to.
+// The request is sent again with a doubled timeout until the server answers (RFC 5389 7.2.1)
+func QuerySTUN(conn net.PacketConn, server string) (*net.UDPAddr, error) {
+	serverAddress, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	request, err := NewSTUNBindingRequest()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	buffer := make([]byte, BufferSize)
+	timeout := STUNTimeout
+	for attempt := 0; attempt < STUNAttempts; attempt++ {
+		if _, err := conn.WriteTo(request.Marshal(), serverAddress); err != nil {
+			return nil, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		for {
+			bytesRead, _, err := conn.ReadFrom(buffer)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			response, err := ParseSTUNMessage(buffer[:bytesRead])
+			if err != nil || response.TransactionID != request.TransactionID {
+				continue // Another protocol, or the answer to an earlier request
+			}
+			if response.Type == STUNBindingError {
+				return nil, fmt.Errorf("sharedutils: STUN server %s refused the binding: %d %s", server, response.ErrorCode, response.ErrorReason)
+			}
+			if response.Type != STUNBindingResponse || response.MappedAddress == nil {
+				return nil, fmt.Errorf("%w: no mapped address from %s", ErrBadSTUN, server)
+			}
+			return response.MappedAddress, nil
+		}
+		timeout *= 2
+	}
+	return nil, fmt.Errorf("sharedutils: no answer from STUN server %s", server)
+}
@@ -0,0 +1,141 @@
+package sharedutils
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// The sample responses of RFC 5769 2.2 and 2.3, with their MESSAGE-INTEGRITY, which a binding skips
+const (
+	rfc5769IPv4Response = "0101003c2112a442b7e7a701bc34d686fa87dfae" +
+		"8022000b7465737420766563746f7220" +
+		"00200008" + "0001a147e112a643" +
+		"000800142b91f599fd9e90c38c7489f92af9ba53f06be7d7" +
+		"80280004c07d4c96"
+	rfc5769IPv6Response = "010100482112a442b7e7a701bc34d686fa87dfae" +
+		"8022000b7465737420766563746f7220" +
+		"00200014" + "0002a1470113a9faa5d3f179bc25f4b5bed2b9d9" +
+		"00080014a382954e4be67bf11784c97c8292c275bfe3ed41" +
+		"80280004c8fb0b4c"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestParseSTUNTestVectors(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		expected string
+	}{
+		{"IPv4", rfc5769IPv4Response, "192.0.2.1:32853"},
+		{"IPv6", rfc5769IPv6Response, "[2001:db8:1234:5678:11:2233:4455:6677]:32853"},
+	}
+	for _, test := range tests {
+		message, err := ParseSTUNMessage(decodeHex(t, test.message))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if message.Type != STUNBindingResponse || message.Software != "test vector" || message.MappedAddress.String() != test.expected {
+			t.Errorf("%s: got type %#04x, software %q and address %v, want a response from %q for %s",
+				test.name, message.Type, message.Software, message.MappedAddress, "test vector", test.expected)
+		}
+		if id := hex.EncodeToString(message.TransactionID[:]); id != "b7e7a701bc34d686fa87dfae" {
+			t.Errorf("%s: got transaction ID %s", test.name, id)
+		}
+	}
+}
+
+func TestSTUNRoundTrip(t *testing.T) {
+	id := [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	tests := []struct {
+		name    string
+		message STUNMessage
+	}{
+		{"request", STUNMessage{Type: STUNBindingRequest, TransactionID: id}},
+		{"IPv4 response", STUNMessage{Type: STUNBindingResponse, TransactionID: id, Software: STUNSoftware,
+			MappedAddress: &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}}},
+		{"IPv6 response", STUNMessage{Type: STUNBindingResponse, TransactionID: id,
+			MappedAddress: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 3478}}},
+		{"error", STUNMessage{Type: STUNBindingError, TransactionID: id, ErrorCode: 400, ErrorReason: "Bad Request"}},
+	}
+	for _, test := range tests {
+		buf := test.message.Marshal()
+		if !IsSTUN(buf) || len(buf)%4 != 0 {
+			t.Errorf("%s: % x is not a STUN message", test.name, buf)
+		}
+		parsed, err := ParseSTUNMessage(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		want := test.message
+		if parsed.Type != want.Type || parsed.TransactionID != want.TransactionID || parsed.Software != want.Software ||
+			parsed.ErrorCode != want.ErrorCode || parsed.ErrorReason != want.ErrorReason ||
+			(parsed.MappedAddress == nil) != (want.MappedAddress == nil) ||
+			(want.MappedAddress != nil && parsed.MappedAddress.String() != want.MappedAddress.String()) {
+			t.Errorf("%s: got %+v, want %+v", test.name, *parsed, want)
+		}
+	}
+}
+
+func TestParseSTUNErrors(t *testing.T) {
+	response := (&STUNMessage{Type: STUNBindingResponse, Software: STUNSoftware,
+		MappedAddress: &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}}).Marshal()
+	tampered := append([]byte(nil), response...)
+	tampered[len(tampered)-12] ^= 1 // In the SOFTWARE, the FINGERPRINT no longer matches
+	vector := decodeHex(t, rfc5769IPv4Response)
+	vector[len(vector)-1] ^= 1
+	afterFingerprint := append(append([]byte(nil), response...), 0x80, 0x22, 0, 0)
+	afterFingerprint[3] += 4
+	overrun := append([]byte(nil), response...)
+	overrun[STUNHeaderSize+3] = 0xff // The length of the first attribute
+	native := encodeDatagram(t, opusFramePacket())
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"tampered attribute", tampered},
+		{"wrong FINGERPRINT of a test vector", vector},
+		{"attribute after the FINGERPRINT", afterFingerprint},
+		{"attribute overrunning the message", overrun},
+		{"length of another datagram", response[:len(response)-4]},
+		{"native packet", native},
+		{"shorter than the header", response[:STUNHeaderSize-1]},
+	}
+	for _, test := range tests {
+		if _, err := ParseSTUNMessage(test.buf); !errors.Is(err, ErrBadSTUN) {
+			t.Errorf("%s: got %v, want %v", test.name, err, ErrBadSTUN)
+		}
+	}
+}
+
+func TestSTUNBindingAnswer(t *testing.T) {
+	request, err := NewSTUNBindingRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 20), Port: 51000}
+	response, err := ParseSTUNMessage(STUNBindingAnswer(request.Marshal(), from))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Type != STUNBindingResponse || response.TransactionID != request.TransactionID || response.MappedAddress.String() != from.String() {
+		t.Errorf("got %+v, want the response to the request from %v", *response, from)
+	}
+	if answer := STUNBindingAnswer(response.Marshal(), from); answer != nil {
+		t.Error("answered a response")
+	}
+	refused, err := ParseSTUNMessage(STUNBindingAnswer(request.Marshal(), &net.TCPAddr{IP: from.IP, Port: from.Port}))
+	if err != nil || refused.Type != STUNBindingError || !strings.HasPrefix(refused.ErrorReason, "Bad Request") {
+		t.Errorf("a request over tcp got %+v (%v), want an error response", refused, err)
+	}
+}
@@ -0,0 +1,205 @@
+package sharedutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SelfSignedValidity  = 365 * 24 * time.Hour // SelfSignedValidity - How long a generated lab certificate is valid
+	TLSHandshakeTimeout = 5 * time.Second      // TLSHandshakeTimeout - How long a TLS handshake may take on either end
+)
+
+// ErrPinMismatch is returned when the certificate of the server is not the pinned one
+var ErrPinMismatch = errors.New("sharedutils: server certificate does not match the pinned fingerprint")
+
+// SelfSignedCertificate generates an ECDSA P-256 certificate for the hosts, names or IP addresses, for lab use
+func SelfSignedCertificate(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"RemoteStudioLive lab"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(SelfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// WriteCertificate writes a generated certificate and its key as PEM files, the key readable only by the owner
+func WriteCertificate(certificate tls.Certificate, certFile, keyFile string) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]})
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+// ServerTLSConfig is the TLS configuration of a server with the certificate, TLS 1.3 only
+func ServerTLSConfig(certificate tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS13,
+	}
+}
+
+// ClientTLSConfig is the TLS configuration of a client. Without a pin the certificate of the server is verified
+// against the system roots for serverName, with a pin only a certificate with that fingerprint is trusted
+func ClientTLSConfig(serverName, pin string) *tls.Config {
+	config := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS13}
+	if pin == "" {
+		return config
+	}
+	// A pinned certificate is usually self-signed, the chain is not verified but the fingerprint is
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 || !MatchesPin(rawCerts[0], pin) {
+			return ErrPinMismatch
+		}
+		return nil
+	}
+	return config
+}
+
+// CertificateFingerprint is the SHA-256 fingerprint of a DER certificate, as printed by openssl x509 -fingerprint -sha256
+func CertificateFingerprint(der []byte) string {
+	hash := sha256.Sum256(der)
+	hexBytes := make([]string, len(hash))
+	for i, b := range hash {
+		hexBytes[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hexBytes, ":")
+}
+
+// MatchesPin reports whether a DER certificate has the pinned fingerprint, given with or without colons in any case
+func MatchesPin(der []byte, pin string) bool {
+	fingerprint := strings.ReplaceAll(CertificateFingerprint(der), ":", "")
+	return strings.EqualFold(fingerprint, strings.ReplaceAll(pin, ":", ""))
+}
+
+// countingConn counts the bytes written to a connection
+type countingConn struct {
+	net.Conn
+	written atomic.Uint64
+}
+
+func (conn *countingConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	conn.written.Add(uint64(n))
+	return n, err
+}
+
+// TLSConn is a TLS connection that measures what TLS costs: the time of the handshake
+// and the bytes every write adds on the wire, the record header and the authentication tag
+type TLSConn struct {
+	*tls.Conn
+	HandshakeTime  time.Duration
+	raw            *countingConn
+	handshakeBytes uint64
+	plainBytes     atomic.Uint64
+	writes         atomic.Uint64
+}
+
+// DialTLS connects to a TLS server over TCP and completes the handshake
+func DialTLS(address string, config *tls.Config) (*TLSConn, error) {
+	tcpConn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	raw := &countingConn{Conn: tcpConn}
+	conn := &TLSConn{Conn: tls.Client(raw, config), raw: raw}
+	if err := conn.CompleteHandshake(); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// CompleteHandshake runs the handshake within TLSHandshakeTimeout and measures it
+func (conn *TLSConn) CompleteHandshake() error {
+	start := time.Now()
+	if err := conn.SetDeadline(start.Add(TLSHandshakeTimeout)); err != nil {
+		return err
+	}
+	if err := conn.Conn.Handshake(); err != nil {
+		return err
+	}
+	conn.HandshakeTime = time.Since(start)
+	conn.handshakeBytes = conn.raw.written.Load()
+	return conn.SetDeadline(time.Time{})
+}
+
+// Datagram is false, TLS runs over a stream
+func (conn *TLSConn) Datagram() bool {
+	return false
+}
+
+func (conn *TLSConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	conn.plainBytes.Add(uint64(n))
+	conn.writes.Add(1)
+	return n, err
+}
+
+// Overhead is the mean number of bytes TLS added to every write after the handshake
+func (conn *TLSConn) Overhead() float64 {
+	writes := conn.writes.Load()
+	if writes == 0 {
+		return 0
+	}
+	added := int64(conn.raw.written.Load()) - int64(conn.handshakeBytes) - int64(conn.plainBytes.Load())
+	return float64(max(0, added)) / float64(writes)
+}
+
+// tlsListener accepts TLS connections, their handshake is left to the goroutine serving them
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func (ln *tlsListener) Accept() (Conn, error) {
+	tcpConn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	raw := &countingConn{Conn: tcpConn}
+	return &TLSConn{Conn: tls.Server(raw, ln.config), raw: raw}, nil
+}
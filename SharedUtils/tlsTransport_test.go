@@ -0,0 +1,33 @@
+package sharedutils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchesPin(t *testing.T) {
+	// The SHA-256 of "abc" (FIPS 180-2)
+	der := []byte("abc")
+	fingerprint := "BA:78:16:BF:8F:01:CF:EA:41:41:40:DE:5D:AE:22:23:B0:03:61:A3:96:17:7A:9C:B4:10:FF:61:F2:00:15:AD"
+	if got := CertificateFingerprint(der); got != fingerprint {
+		t.Fatalf("fingerprint %s, want %s", got, fingerprint)
+	}
+
+	tests := []struct {
+		name  string
+		pin   string
+		match bool
+	}{
+		{"fingerprint", fingerprint, true},
+		{"lower case", strings.ToLower(fingerprint), true},
+		{"without colons", strings.ReplaceAll(fingerprint, ":", ""), true},
+		{"other certificate", CertificateFingerprint([]byte("abd")), false},
+		{"truncated", fingerprint[:len(fingerprint)-3], false},
+		{"empty", "", false},
+	}
+	for _, test := range tests {
+		if match := MatchesPin(der, test.pin); match != test.match {
+			t.Errorf("%s: match %v, want %v", test.name, match, test.match)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package sharedutils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TraceEntry is what happened to one packet of a recorded session
+type TraceEntry struct {
+	Lost     bool
+	Uplink   time.Duration // One way delays, half the round trip when the log has no clock corrected delays
+	Downlink time.Duration
+}
+
+// NetworkTrace is the per packet delay and loss of a recorded session, in the order of the serials
+type NetworkTrace struct {
+	Entries []TraceEntry
+}
+
+// LoadNetworkTrace reads a trace from a StatisticsLog of the client
+func LoadNetworkTrace(fileName string) (*NetworkTrace, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseNetworkTrace(file)
+}
+
+// ParseNetworkTrace reads a trace from the lines of a StatisticsLog, "Packet <serial> | <measure>: <value> <unit> | ...".
+// Every log format written so far is understood, from round trip times in milliseconds to the one way delays in
+// microseconds. The serials missing from the log are the lost packets
+func ParseNetworkTrace(reader io.Reader) (*NetworkTrace, error) {
+	received := make(map[int64]TraceEntry)
+	first, last := int64(0), int64(-1)
+	scanner := bufio.NewScanner(reader)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "Packet") {
+			continue // Empty lines and the averages some logs end with
+		}
+		serial, measures, err := parseTraceLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		entry, ok := traceEntry(measures)
+		if !ok {
+			return nil, fmt.Errorf("line %d: no delay in %q", lineNumber, line)
+		}
+		if len(received) == 0 || serial < first {
+			first = serial
+		}
+		if len(received) == 0 || serial > last {
+			last = serial
+		}
+		received[serial] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(received) == 0 {
+		return nil, fmt.Errorf("sharedutils: no packets in the trace")
+	}
+
+	trace := &NetworkTrace{Entries: make([]TraceEntry, 0, last-first+1)}
+	for serial := first; serial <= last; serial++ {
+		entry, ok := received[serial]
+		if !ok {
+			entry.Lost = true
+		}
+		trace.Entries = append(trace.Entries, entry)
+	}
+	return trace, nil
+}
+
+// parseTraceLine splits a log line into its serial and its measures
+func parseTraceLine(line string) (int64, map[string]time.Duration, error) {
+	fields := strings.Split(line, "|")
+	serial, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(fields[0], "Packet")), 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("bad serial in %q", line)
+	}
+	measures := make(map[string]time.Duration)
+	for _, field := range fields[1:] {
+		name, value, ok := strings.Cut(field, ":")
+		words := strings.Fields(value)
+		if !ok || len(words) != 2 {
+			return 0, nil, fmt.Errorf("bad measure %q", field)
+		}
+		number, err := strconv.ParseInt(words[0], 10, 64)
+		if err != nil {
+			return 0, nil, fmt.Errorf("bad measure %q", field)
+		}
+		unit := time.Microsecond
+		if words[1] == "milliseconds" {
+			unit = time.Millisecond
+		}
+		measures[strings.TrimSpace(name)] = time.Duration(number) * unit
+	}
+	return serial, measures, nil
+}
+
+// traceEntry takes the one way delays of a packet from its measures. Negative one way delays come from
+// a clock offset that was not estimated yet, half the round trip is used for them instead
+func traceEntry(measures map[string]time.Duration) (TraceEntry, bool) {
+	uplink, hasUplink := measures["Uplink"]
+	downlink, hasDownlink := measures["Downlink"]
+	if hasUplink && hasDownlink && uplink >= 0 && downlink >= 0 {
+		return TraceEntry{Uplink: uplink, Downlink: downlink}, true
+	}
+	roundTrip, ok := measures["Round Trip Time"]
+	if !ok {
+		roundTrip, ok = measures["End To End"]
+	}
+	roundTrip = max(0, roundTrip)
+	return TraceEntry{Uplink: roundTrip / 2, Downlink: roundTrip - roundTrip/2}, ok
+}
+
+// Delays are the delays of the packets going one way, to be replayed by an Impairer. The lost packets are lost on
+// the uplink, with a negative delay, so the downlink replays the delays of the packets that were received only
+func (trace *NetworkTrace) Delays(downlink bool) []time.Duration {
+	delays := make([]time.Duration, 0, len(trace.Entries))
+	for _, entry := range trace.Entries {
+		switch {
+		case !downlink && entry.Lost:
+			delays = append(delays, -1)
+		case !downlink:
+			delays = append(delays, entry.Uplink)
+		case !entry.Lost:
+			delays = append(delays, entry.Downlink)
+		}
+	}
+	return delays
+}
+
+func (trace *NetworkTrace) String() string {
+	var lost int
+	var uplink, downlink time.Duration
+	for _, entry := range trace.Entries {
+		if entry.Lost {
+			lost++
+			continue
+		}
+		uplink += entry.Uplink
+		downlink += entry.Downlink
+	}
+	received := max(1, len(trace.Entries)-lost)
+	return fmt.Sprintf("%d packets, %d lost (%.2f%%), mean uplink %v, mean downlink %v",
+		len(trace.Entries), lost, float64(lost)*100/float64(len(trace.Entries)),
+		(uplink / time.Duration(received)).Round(time.Microsecond), (downlink / time.Duration(received)).Round(time.Microsecond))
+}
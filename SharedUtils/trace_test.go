@@ -0,0 +1,88 @@
+package sharedutils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTraceLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		serial   int64
+		measures map[string]time.Duration
+	}{
+		{"Packet   12 | End To End:  5123 microseconds | Round Trip Time: 3000 microseconds | Uplink:  1400 microseconds | Downlink:  1600 microseconds | Server Dwell:   20 microseconds",
+			12, map[string]time.Duration{"End To End": 5123 * time.Microsecond, "Round Trip Time": 3000 * time.Microsecond,
+				"Uplink": 1400 * time.Microsecond, "Downlink": 1600 * time.Microsecond, "Server Dwell": 20 * time.Microsecond}},
+		{"Packet    0 | Round Trip Time:    20 milliseconds", 0, map[string]time.Duration{"Round Trip Time": 20 * time.Millisecond}},
+		{"Packet    3 | Uplink:  -250 microseconds", 3, map[string]time.Duration{"Uplink": -250 * time.Microsecond}},
+	}
+	for _, test := range tests {
+		serial, measures, err := parseTraceLine(test.line)
+		if err != nil || serial != test.serial || !reflect.DeepEqual(measures, test.measures) {
+			t.Errorf("%q: got %d %v (%v), want %d %v", test.line, serial, measures, err, test.serial, test.measures)
+		}
+	}
+	for _, line := range []string{
+		"Packet x | Round Trip Time: 20 milliseconds",
+		"Packet 1 | Round Trip Time 20 milliseconds",
+		"Packet 1 | Round Trip Time: twenty milliseconds",
+		"Packet 1 | Round Trip Time: 20",
+	} {
+		if _, _, err := parseTraceLine(line); err == nil {
+			t.Errorf("%q: parsed without an error", line)
+		}
+	}
+}
+
+func TestParseNetworkTrace(t *testing.T) {
+	// Packet 2 is lost, packet 4 was received before the clock offset was estimated
+	log := strings.Join([]string{
+		"Packet    1 | End To End:  5000 microseconds | Round Trip Time: 3000 microseconds | Uplink:  1400 microseconds | Downlink:  1600 microseconds | Server Dwell:   20 microseconds",
+		"Packet    3 | End To End:  5000 microseconds | Round Trip Time: 4000 microseconds | Uplink:  1000 microseconds | Downlink:  3000 microseconds | Server Dwell:   20 microseconds",
+		"Packet    4 | End To End:  5000 microseconds | Round Trip Time: 5000 microseconds | Uplink:  -300 microseconds | Downlink:  5300 microseconds | Server Dwell:   20 microseconds",
+		"",
+		"Round Trip Time Jitter:          19 milliseconds",
+	}, "\n")
+	trace, err := ParseNetworkTrace(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TraceEntry{
+		{Uplink: 1400 * time.Microsecond, Downlink: 1600 * time.Microsecond},
+		{Lost: true},
+		{Uplink: 1000 * time.Microsecond, Downlink: 3000 * time.Microsecond},
+		{Uplink: 2500 * time.Microsecond, Downlink: 2500 * time.Microsecond},
+	}
+	if !reflect.DeepEqual(trace.Entries, want) {
+		t.Errorf("got %+v, want %+v", trace.Entries, want)
+	}
+	if uplink := trace.Delays(false); !reflect.DeepEqual(uplink, []time.Duration{1400 * time.Microsecond, -1, 1000 * time.Microsecond, 2500 * time.Microsecond}) {
+		t.Errorf("got uplink delays %v", uplink)
+	}
+	if downlink := trace.Delays(true); !reflect.DeepEqual(downlink, []time.Duration{1600 * time.Microsecond, 3000 * time.Microsecond, 2500 * time.Microsecond}) {
+		t.Errorf("got downlink delays %v", downlink)
+	}
+
+	for _, bad := range []string{"", "Round Trip Time Jitter: 19 milliseconds", "Packet 1 | Server Dwell: 20 microseconds"} {
+		if _, err := ParseNetworkTrace(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: parsed without an error", bad)
+		}
+	}
+}
+
+func TestLoadNetworkTrace(t *testing.T) {
+	// The log of the client in the repository, in the round trip format of the first versions
+	trace, err := LoadNetworkTrace("../LocalServer/Client/Stats/StatisticsLog.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace.Entries) == 0 {
+		t.Fatal("no packets in the log")
+	}
+	if first := trace.Entries[0]; first != (TraceEntry{Uplink: 10 * time.Millisecond, Downlink: 10 * time.Millisecond}) {
+		t.Errorf("got %+v first, want the 20 ms round trip of packet 0 split", first)
+	}
+}
@@ -0,0 +1,323 @@
+package sharedutils
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	udpPeerQueue = 256 // udpPeerQueue - Datagrams kept for a peer of a UDP listener that is not read, like the buffer of its own socket
+)
+
+// Conn is a connection made by a Transport. Datagram connections keep the boundaries of the packets written,
+// stream connections need the packets to be framed (see Link)
+type Conn interface {
+	net.Conn
+	Datagram() bool
+}
+
+// Listener accepts the connections of the clients of a Transport.
+// Datagram transports accept a connection for every address a datagram arrives from
+type Listener interface {
+	Accept() (Conn, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// Transport creates the connections of the client and the server, so their logic is the same over any of them
+type Transport interface {
+	Name() string
+	Address(host, port string) string // The address to dial or listen on, an empty host listens on every interface
+	Dial(address string) (Conn, error)
+	Listen(address string) (Listener, error)
+}
+
+// ErrUnknownTransport is returned for transports that can not be picked by name
+var ErrUnknownTransport = errors.New("sharedutils: unknown transport (tcp, udp or unix)")
+
+// NewTransport returns the transport of a connection type as given on the command line. The in-memory transport
+// only connects a client and a server of the same process, so it is not one of them: see NewMemoryTransport
+func NewTransport(name string) (Transport, error) {
+	switch name {
+	case "tcp":
+		return &TCPTransport{}, nil
+	case "udp":
+		return &UDPTransport{}, nil
+	case "unix":
+		return &UnixTransport{}, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownTransport, name)
+}
+
+// streamConn is a connection of a stream transport
+type streamConn struct {
+	net.Conn
+}
+
+func (conn streamConn) Datagram() bool {
+	return false
+}
+
+// datagramConn is a connected datagram socket
+type datagramConn struct {
+	net.Conn
+}
+
+func (conn datagramConn) Datagram() bool {
+	return true
+}
+
+// streamListener accepts the connections of a stream transport
+type streamListener struct {
+	net.Listener
+}
+
+func (ln streamListener) Accept() (Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return streamConn{conn}, nil
+}
+
+// TCPTransport connects over TCP, wrapped in TLS when it has a configuration
+type TCPTransport struct {
+	TLSConfig *tls.Config
+}
+
+func (transport *TCPTransport) Name() string {
+	if transport.TLSConfig != nil {
+		return "tls"
+	}
+	return "tcp"
+}
+
+func (transport *TCPTransport) Address(host, port string) string {
+	return net.JoinHostPort(host, port)
+}
+
+// Dial connects to a server, over TLS the handshake is completed and the connection is a *TLSConn
+func (transport *TCPTransport) Dial(address string) (Conn, error) {
+	if transport.TLSConfig != nil {
+		conn, err := DialTLS(address, transport.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return streamConn{conn}, nil
+}
+
+// Listen accepts the clients of a server, over TLS the connections are *TLSConn whose handshake is not done yet
+func (transport *TCPTransport) Listen(address string) (Listener, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if transport.TLSConfig != nil {
+		return &tlsListener{Listener: ln, config: transport.TLSConfig}, nil
+	}
+	return streamListener{ln}, nil
+}
+
+// UnixTransport connects over a Unix domain stream socket, for a client and a server on the same machine
+type UnixTransport struct{}
+
+func (transport *UnixTransport) Name() string {
+	return "unix"
+}
+
+// Address is a socket file in the temporary directory named after the port, the host is not used
+func (transport *UnixTransport) Address(host, port string) string {
+	return filepath.Join(os.TempDir(), "remotestudiolive-"+port+".sock")
+}
+
+func (transport *UnixTransport) Dial(address string) (Conn, error) {
+	conn, err := net.Dial("unix", address)
+	if err != nil {
+		return nil, err
+	}
+	return streamConn{conn}, nil
+}
+
+// Listen removes the socket file a server that did not close its listener left behind
+func (transport *UnixTransport) Listen(address string) (Listener, error) {
+	if err := os.Remove(address); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", address)
+	if err != nil {
+		return nil, err
+	}
+	return streamListener{ln}, nil
+}
+
+// UDPTransport connects over UDP. The listener demultiplexes the datagrams of its socket by the address they come from
+type UDPTransport struct {
+	AnswerSTUN bool // The listener answers STUN binding requests itself, so clients learn their public address from the server
+}
+
+func (transport *UDPTransport) Name() string {
+	return "udp"
+}
+
+func (transport *UDPTransport) Address(host, port string) string {
+	return net.JoinHostPort(host, port)
+}
+
+func (transport *UDPTransport) Dial(address string) (Conn, error) {
+	udpAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, udpAddress)
+	if err != nil {
+		return nil, err
+	}
+	return datagramConn{conn}, nil
+}
+
+func (transport *UDPTransport) Listen(address string) (Listener, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	ln := &udpListener{
+		conn:       conn,
+		answerSTUN: transport.AnswerSTUN,
+		peers:      make(map[string]*udpPeerConn),
+		accepts:    make(chan *udpPeerConn),
+		closed:     make(chan struct{}),
+	}
+	go ln.readRoutine()
+	return ln, nil
+}
+
+// udpListener shares one socket between the peers that send to it
+type udpListener struct {
+	conn       net.PacketConn
+	answerSTUN bool
+	mutex      sync.Mutex
+	peers      map[string]*udpPeerConn
+	accepts    chan *udpPeerConn
+	closed     chan struct{}
+	closeOnce  sync.Once
+	err        error // Why the socket stopped reading, set before closed is
+}
+
+// readRoutine reads the socket and queues every datagram for the connection of the address it came from,
+// which is accepted with the first one. Datagrams for a peer that does not keep up are dropped.
+// STUN messages never open a connection, binding requests are answered when answerSTUN is set
+func (ln *udpListener) readRoutine() {
+	buffer := make([]byte, BufferSize)
+	for {
+		bytesRead, address, err := ln.conn.ReadFrom(buffer)
+		if err != nil {
+			ln.close(err)
+			return
+		}
+		if ln.answerSTUN && IsSTUN(buffer[:bytesRead]) {
+			if response := STUNBindingAnswer(buffer[:bytesRead], address); response != nil {
+				ln.conn.WriteTo(response, address)
+			}
+			continue
+		}
+		ln.mutex.Lock()
+		peer, ok := ln.peers[address.String()]
+		if !ok {
+			peer = &udpPeerConn{listener: ln, remote: address, queue: newMessageQueue(udpPeerQueue)}
+			ln.peers[address.String()] = peer
+		}
+		ln.mutex.Unlock()
+		if !ok {
+			select {
+			case ln.accepts <- peer:
+			case <-ln.closed:
+				return
+			}
+		}
+		peer.queue.push(append([]byte(nil), buffer[:bytesRead]...), address, time.Time{}, false)
+	}
+}
+
+func (ln *udpListener) Accept() (Conn, error) {
+	select {
+	case peer := <-ln.accepts:
+		return peer, nil
+	case <-ln.closed:
+		if ln.err != nil {
+			return nil, ln.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the socket and the connections of every peer
+func (ln *udpListener) Close() error {
+	return ln.close(nil)
+}
+
+// close closes the listener once, with the read error that stopped it or nil when it was closed
+func (ln *udpListener) close(readErr error) error {
+	var err error
+	ln.closeOnce.Do(func() {
+		ln.err = readErr
+		close(ln.closed)
+		err = ln.conn.Close()
+		ln.mutex.Lock()
+		defer ln.mutex.Unlock()
+		for _, peer := range ln.peers {
+			peer.queue.close()
+		}
+	})
+	return err
+}
+
+func (ln *udpListener) Addr() net.Addr {
+	return ln.conn.LocalAddr()
+}
+
+// udpPeerConn is the connection of a UDP listener to one peer. Closing it forgets the peer,
+// the next datagram from its address is accepted as a new connection
+type udpPeerConn struct {
+	listener *udpListener
+	remote   net.Addr
+	queue    *messageQueue
+}
+
+func (conn *udpPeerConn) Read(b []byte) (int, error) {
+	return conn.queue.read(b)
+}
+
+func (conn *udpPeerConn) Write(b []byte) (int, error) {
+	return conn.listener.conn.WriteTo(b, conn.remote)
+}
+
+func (conn *udpPeerConn) Close() error {
+	conn.listener.mutex.Lock()
+	if conn.listener.peers[conn.remote.String()] == conn {
+		delete(conn.listener.peers, conn.remote.String())
+	}
+	conn.listener.mutex.Unlock()
+	conn.queue.close()
+	return nil
+}
+
+func (conn *udpPeerConn) Datagram() bool                    { return true }
+func (conn *udpPeerConn) LocalAddr() net.Addr               { return conn.listener.Addr() }
+func (conn *udpPeerConn) RemoteAddr() net.Addr              { return conn.remote }
+func (conn *udpPeerConn) SetDeadline(t time.Time) error     { return conn.SetReadDeadline(t) }
+func (conn *udpPeerConn) SetReadDeadline(t time.Time) error { return conn.queue.setDeadline(t) }
+
+// SetWriteDeadline is not supported, writes to the shared socket do not block
+func (conn *udpPeerConn) SetWriteDeadline(t time.Time) error { return nil }